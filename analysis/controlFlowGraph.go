@@ -0,0 +1,342 @@
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//pathSeparator joins node labels to the keys of recorded paths
+const pathSeparator = " -> "
+
+//CFGNode is a code page or, if symbols are available, a function
+type CFGNode struct {
+	Label string `json:"label"`
+	//Visits is the number of times the node was entered
+	Visits uint64 `json:"visits"`
+	//Runs is the number of runs that visited the node
+	Runs uint64 `json:"runs"`
+}
+
+//CFGEdge is a transition between two nodes
+type CFGEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	//Weight is the number of observed transitions
+	Weight uint64 `json:"weight"`
+}
+
+//CFGPath is a sequence of nodes that was observed Count times as a whole run
+type CFGPath struct {
+	Nodes []string `json:"nodes"`
+	Count uint64   `json:"count"`
+}
+
+func (p CFGPath) String() string {
+	return fmt.Sprintf("%dx %s", p.Count, strings.Join(p.Nodes, pathSeparator))
+}
+
+type cfgEdgeKey struct {
+	from, to string
+}
+
+//ControlFlowGraph is a weighted directed graph of the transitions between code pages, built from
+//the faults of PageTrackExec traces. Consecutive faults on the same node, e.g. due to retracking
+//a page before the guest made progress, are merged.
+//Events are added to the current run with Add until EndRun is called. Transitions are only
+//counted inside a run, which allows to merge traces of many executions of the victim. The nodes,
+//edges and paths of the graph only contain finished runs
+type ControlFlowGraph struct {
+	//Symbolizer, if set, labels nodes by the function containing the RIP instead of the page.
+	//Must not be changed after the first event was added
+	Symbolizer *sevStep.Symbolizer
+
+	nodes map[string]*CFGNode
+	edges map[cfgEdgeKey]*CFGEdge
+	//entries counts the first node of each run
+	entries map[string]uint64
+	paths   map[string]*CFGPath
+	runs    uint64
+
+	//current is the unfinished run
+	current []string
+}
+
+//NewControlFlowGraph creates an empty graph. If symbolizer is nil, nodes are pages
+func NewControlFlowGraph(symbolizer *sevStep.Symbolizer) *ControlFlowGraph {
+	return &ControlFlowGraph{
+		Symbolizer: symbolizer,
+		nodes:      make(map[string]*CFGNode),
+		edges:      make(map[cfgEdgeKey]*CFGEdge),
+		entries:    make(map[string]uint64),
+		paths:      make(map[string]*CFGPath),
+		current:    make([]string, 0),
+	}
+}
+
+//NodeLabel returns the label of the node for ev. This is the function containing the RIP, if a
+//Symbolizer is set and resolves it. Otherwise, it is the page of the RIP, or the page of the faulted
+//GPA for events without RIP
+func (g *ControlFlowGraph) NodeLabel(ev *sevStep.Event) string {
+	if !ev.HaveRipInfo {
+		return fmt.Sprintf("gpa:0x%x", ev.FaultedGPA&^0xfff)
+	}
+	if g.Symbolizer != nil {
+		if loc, ok := g.Symbolizer.Lookup(ev.RIP); ok {
+			return loc.Symbol.QualifiedName()
+		}
+	}
+	return fmt.Sprintf("0x%x", ev.RIP&^0xfff)
+}
+
+//Add appends ev to the current run. The graph is updated once the run is finished with EndRun
+func (g *ControlFlowGraph) Add(ev *sevStep.Event) {
+	label := g.NodeLabel(ev)
+	if len(g.current) > 0 && g.current[len(g.current)-1] == label {
+		return
+	}
+	g.current = append(g.current, label)
+}
+
+func (g *ControlFlowGraph) addEdge(from, to string, weight uint64) {
+	key := cfgEdgeKey{from: from, to: to}
+	edge, ok := g.edges[key]
+	if !ok {
+		edge = &CFGEdge{From: from, To: to}
+		g.edges[key] = edge
+	}
+	edge.Weight += weight
+}
+
+//EndRun finishes the current run and adds its nodes, edges and path to the graph. Empty runs are ignored
+func (g *ControlFlowGraph) EndRun() {
+	if len(g.current) == 0 {
+		return
+	}
+	visited := make(map[string]bool)
+	for i, label := range g.current {
+		node, ok := g.nodes[label]
+		if !ok {
+			node = &CFGNode{Label: label}
+			g.nodes[label] = node
+		}
+		node.Visits++
+		if !visited[label] {
+			visited[label] = true
+			node.Runs++
+		}
+		if i > 0 {
+			g.addEdge(g.current[i-1], label, 1)
+		}
+	}
+	g.entries[g.current[0]]++
+	g.runs++
+	key := strings.Join(g.current, pathSeparator)
+	path, ok := g.paths[key]
+	if !ok {
+		path = &CFGPath{Nodes: g.current}
+		g.paths[key] = path
+	}
+	path.Count++
+	g.current = make([]string, 0)
+}
+
+//AddRun adds events as a complete run
+func (g *ControlFlowGraph) AddRun(events []*sevStep.Event) {
+	for _, v := range events {
+		g.Add(v)
+	}
+	g.EndRun()
+}
+
+//AddStream adds all events from events, e.g. from sevStep.EventLoop.Events, as one run.
+//Returns once events is closed
+func (g *ControlFlowGraph) AddStream(events <-chan *sevStep.Event) {
+	for ev := range events {
+		g.Add(ev)
+	}
+	g.EndRun()
+}
+
+//Merge adds all finished runs of other to g. The unfinished run of other is not merged.
+//Both graphs should use the same kind of labels
+func (g *ControlFlowGraph) Merge(other *ControlFlowGraph) {
+	for label, v := range other.nodes {
+		node, ok := g.nodes[label]
+		if !ok {
+			node = &CFGNode{Label: label}
+			g.nodes[label] = node
+		}
+		node.Visits += v.Visits
+		node.Runs += v.Runs
+	}
+	for _, v := range other.edges {
+		g.addEdge(v.From, v.To, v.Weight)
+	}
+	for label, count := range other.entries {
+		g.entries[label] += count
+	}
+	for key, v := range other.paths {
+		path, ok := g.paths[key]
+		if !ok {
+			path = &CFGPath{Nodes: v.Nodes}
+			g.paths[key] = path
+		}
+		path.Count += v.Count
+	}
+	g.runs += other.runs
+}
+
+//Runs returns the number of finished runs
+func (g *ControlFlowGraph) Runs() uint64 {
+	return g.runs
+}
+
+//Nodes returns copies of all nodes, sorted by label
+func (g *ControlFlowGraph) Nodes() []CFGNode {
+	res := make([]CFGNode, 0, len(g.nodes))
+	for _, v := range g.nodes {
+		res = append(res, *v)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Label < res[j].Label
+	})
+	return res
+}
+
+//Edges returns copies of all edges, sorted by descending weight and then by labels
+func (g *ControlFlowGraph) Edges() []CFGEdge {
+	res := make([]CFGEdge, 0, len(g.edges))
+	for _, v := range g.edges {
+		res = append(res, *v)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Weight != res[j].Weight {
+			return res[i].Weight > res[j].Weight
+		}
+		if res[i].From != res[j].From {
+			return res[i].From < res[j].From
+		}
+		return res[i].To < res[j].To
+	})
+	return res
+}
+
+//Entry returns the most frequent first node of all runs
+func (g *ControlFlowGraph) Entry() (string, bool) {
+	best := ""
+	bestCount := uint64(0)
+	for label, count := range g.entries {
+		if count > bestCount || (count == bestCount && label < best) {
+			best, bestCount = label, count
+		}
+	}
+	return best, bestCount > 0
+}
+
+//DominantPath follows the heaviest outgoing edge, starting at from, until a node repeats or has no
+//successors. Use Entry to start at the usual start of the runs
+func (g *ControlFlowGraph) DominantPath(from string) []string {
+	successors := make(map[string]CFGEdge)
+	//Edges is sorted by descending weight, thus the first edge per node is the heaviest
+	for _, v := range g.Edges() {
+		if _, ok := successors[v.From]; !ok {
+			successors[v.From] = v
+		}
+	}
+	path := []string{from}
+	visited := map[string]bool{from: true}
+	for {
+		edge, ok := successors[path[len(path)-1]]
+		if !ok || visited[edge.To] {
+			return path
+		}
+		visited[edge.To] = true
+		path = append(path, edge.To)
+	}
+}
+
+//FrequentPaths returns the n most frequent complete runs, sorted by descending count.
+//n <= 0 returns all paths
+func (g *ControlFlowGraph) FrequentPaths(n int) []CFGPath {
+	res := make([]CFGPath, 0, len(g.paths))
+	for _, v := range g.paths {
+		res = append(res, CFGPath{Nodes: append([]string{}, v.Nodes...), Count: v.Count})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return strings.Join(res[i].Nodes, pathSeparator) < strings.Join(res[j].Nodes, pathSeparator)
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+//WriteDOT writes the graph in the Graphviz DOT format. Edges on the dominant path from Entry are highlighted
+func (g *ControlFlowGraph) WriteDOT(w io.Writer) error {
+	onDominantPath := make(map[cfgEdgeKey]bool)
+	if entry, ok := g.Entry(); ok {
+		path := g.DominantPath(entry)
+		for i := 1; i < len(path); i++ {
+			onDominantPath[cfgEdgeKey{from: path[i-1], to: path[i]}] = true
+		}
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString("digraph cfg {\n")
+	sb.WriteString("\tnode [shape=box];\n")
+	for _, v := range g.Nodes() {
+		fmt.Fprintf(&sb, "\t%q [label=%q];\n", v.Label, fmt.Sprintf("%s\n%d visits", v.Label, v.Visits))
+	}
+	for _, v := range g.Edges() {
+		attributes := fmt.Sprintf("label=\"%d\"", v.Weight)
+		if onDominantPath[cfgEdgeKey{from: v.From, to: v.To}] {
+			attributes += ", color=red, penwidth=2"
+		}
+		fmt.Fprintf(&sb, "\t%q -> %q [%s];\n", v.From, v.To, attributes)
+	}
+	sb.WriteString("}\n")
+	if _, err := io.WriteString(w, sb.String()); err != nil {
+		return fmt.Errorf("failed to write DOT graph : %w", err)
+	}
+	return nil
+}
+
+//cfgJSON is the JSON representation of ControlFlowGraph
+type cfgJSON struct {
+	Runs          uint64    `json:"runs"`
+	Entry         string    `json:"entry"`
+	Nodes         []CFGNode `json:"nodes"`
+	Edges         []CFGEdge `json:"edges"`
+	DominantPath  []string  `json:"dominant_path"`
+	FrequentPaths []CFGPath `json:"frequent_paths"`
+}
+
+//WriteJSON writes the nodes, edges and paths of the graph as JSON. frequentPaths limits the
+//number of exported FrequentPaths
+func (g *ControlFlowGraph) WriteJSON(w io.Writer, frequentPaths int) error {
+	data := cfgJSON{
+		Runs:          g.runs,
+		Nodes:         g.Nodes(),
+		Edges:         g.Edges(),
+		DominantPath:  []string{},
+		FrequentPaths: g.FrequentPaths(frequentPaths),
+	}
+	if entry, ok := g.Entry(); ok {
+		data.Entry = entry
+		data.DominantPath = g.DominantPath(entry)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(data); err != nil {
+		return fmt.Errorf("failed to encode graph : %w", err)
+	}
+	return nil
+}
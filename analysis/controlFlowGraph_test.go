@@ -0,0 +1,137 @@
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//ripEvents creates one exec event per rip
+func ripEvents(rips ...uint64) []*sevStep.Event {
+	events := make([]*sevStep.Event, 0, len(rips))
+	for _, v := range rips {
+		events = append(events, &sevStep.Event{HaveRipInfo: true, RIP: v, FaultedGPA: v})
+	}
+	return events
+}
+
+func TestControlFlowGraph(t *testing.T) {
+	g := NewControlFlowGraph(nil)
+	//the repeated fault on 0x1000 is merged
+	g.AddRun(ripEvents(0x1000, 0x1010, 0x2000, 0x3000, 0x1000))
+	g.AddRun(ripEvents(0x1000, 0x2000, 0x3000, 0x1000))
+	g.AddRun(ripEvents(0x1000, 0x4000))
+	g.EndRun()
+
+	if g.Runs() != 3 {
+		t.Errorf("Runs() = %v, want 3", g.Runs())
+	}
+	wantEdges := []CFGEdge{
+		{From: "0x1000", To: "0x2000", Weight: 2},
+		{From: "0x2000", To: "0x3000", Weight: 2},
+		{From: "0x3000", To: "0x1000", Weight: 2},
+		{From: "0x1000", To: "0x4000", Weight: 1},
+	}
+	if got := g.Edges(); !reflect.DeepEqual(got, wantEdges) {
+		t.Errorf("Edges() = %v, want %v", got, wantEdges)
+	}
+	wantNodes := []CFGNode{
+		{Label: "0x1000", Visits: 5, Runs: 3},
+		{Label: "0x2000", Visits: 2, Runs: 2},
+		{Label: "0x3000", Visits: 2, Runs: 2},
+		{Label: "0x4000", Visits: 1, Runs: 1},
+	}
+	if got := g.Nodes(); !reflect.DeepEqual(got, wantNodes) {
+		t.Errorf("Nodes() = %v, want %v", got, wantNodes)
+	}
+
+	entry, ok := g.Entry()
+	if !ok || entry != "0x1000" {
+		t.Fatalf("Entry() = %v, %v, want 0x1000", entry, ok)
+	}
+	if got, want := g.DominantPath(entry), []string{"0x1000", "0x2000", "0x3000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DominantPath() = %v, want %v", got, want)
+	}
+	wantPaths := []CFGPath{
+		{Nodes: []string{"0x1000", "0x2000", "0x3000", "0x1000"}, Count: 2},
+		{Nodes: []string{"0x1000", "0x4000"}, Count: 1},
+	}
+	if got := g.FrequentPaths(0); !reflect.DeepEqual(got, wantPaths) {
+		t.Errorf("FrequentPaths() = %v, want %v", got, wantPaths)
+	}
+	if got := g.FrequentPaths(1); len(got) != 1 {
+		t.Errorf("FrequentPaths(1) returned %v paths", len(got))
+	}
+}
+
+func TestControlFlowGraph_Merge(t *testing.T) {
+	a := NewControlFlowGraph(nil)
+	a.AddRun(ripEvents(0x1000, 0x2000))
+	b := NewControlFlowGraph(nil)
+	b.AddRun(ripEvents(0x1000, 0x2000))
+	b.AddRun(ripEvents(0x3000))
+	//the unfinished run of b is not merged
+	for _, v := range ripEvents(0x3000, 0x4000) {
+		b.Add(v)
+	}
+
+	a.Merge(b)
+	all := NewControlFlowGraph(nil)
+	all.AddRun(ripEvents(0x1000, 0x2000))
+	all.AddRun(ripEvents(0x1000, 0x2000))
+	all.AddRun(ripEvents(0x3000))
+
+	if a.Runs() != all.Runs() || !reflect.DeepEqual(a.Nodes(), all.Nodes()) || !reflect.DeepEqual(a.Edges(), all.Edges()) ||
+		!reflect.DeepEqual(a.FrequentPaths(0), all.FrequentPaths(0)) {
+		t.Errorf("merged graph differs from graph of all runs")
+	}
+}
+
+func TestControlFlowGraph_Symbols(t *testing.T) {
+	symbolizer := sevStep.NewSymbolizer()
+	systemMap := "ffffffff81001000 T entry_SYSCALL_64\nffffffff81002000 T do_syscall_64\nffffffff81003000 T _etext\n"
+	if err := symbolizer.AddSystemMap(strings.NewReader(systemMap), "vmlinux", 0); err != nil {
+		t.Fatalf("AddSystemMap failed : %v", err)
+	}
+	g := NewControlFlowGraph(symbolizer)
+	events := ripEvents(0xffffffff81001000, 0xffffffff81002010, 0x401000)
+	events = append(events, &sevStep.Event{FaultedGPA: 0x5123})
+	g.AddRun(events)
+
+	want := []string{"vmlinux!entry_SYSCALL_64", "vmlinux!do_syscall_64", "0x401000", "gpa:0x5000"}
+	if got := g.FrequentPaths(0)[0].Nodes; !reflect.DeepEqual(got, want) {
+		t.Errorf("nodes = %v, want %v", got, want)
+	}
+}
+
+func TestControlFlowGraph_Export(t *testing.T) {
+	g := NewControlFlowGraph(nil)
+	g.AddRun(ripEvents(0x1000, 0x2000, 0x1000, 0x3000))
+
+	dot := bytes.Buffer{}
+	if err := g.WriteDOT(&dot); err != nil {
+		t.Fatalf("WriteDOT failed : %v", err)
+	}
+	for _, want := range []string{"digraph cfg {", "\"0x1000\" -> \"0x2000\" [label=\"1\", color=red, penwidth=2];",
+		"\"0x1000\" -> \"0x3000\" [label=\"1\"];"} {
+		if !strings.Contains(dot.String(), want) {
+			t.Errorf("DOT output misses %q:\n%v", want, dot.String())
+		}
+	}
+
+	buf := bytes.Buffer{}
+	if err := g.WriteJSON(&buf, 10); err != nil {
+		t.Fatalf("WriteJSON failed : %v", err)
+	}
+	decoded := cfgJSON{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("failed to decode JSON : %v", err)
+	}
+	if decoded.Runs != 1 || decoded.Entry != "0x1000" || len(decoded.Nodes) != 3 || len(decoded.Edges) != 3 {
+		t.Errorf("decoded graph = %+v", decoded)
+	}
+}
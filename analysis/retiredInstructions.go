@@ -0,0 +1,312 @@
+//Package analysis contains offline analyses of page fault traces recorded with sevStep
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//StepKind classifies the progress of the guest between two page fault events
+type StepKind int
+
+const (
+	//StepUnknown means that the event has no retired instructions count
+	StepUnknown = StepKind(iota)
+	//StepZero means that the guest did not retire any instruction
+	StepZero
+	//StepSingle means that the guest retired exactly one instruction
+	StepSingle
+	//StepMulti means that the guest retired more than one instruction
+	StepMulti
+)
+
+func (k StepKind) String() string {
+	switch k {
+	case StepUnknown:
+		return "Unknown"
+	case StepZero:
+		return "ZeroStep"
+	case StepSingle:
+		return "SingleStep"
+	case StepMulti:
+		return "MultiStep"
+	default:
+		return "Invalid"
+	}
+}
+
+//defaultCounterOverhead mirrors the kernel's batch retrack logic, which considers a retired
+//instructions delta below 2 as no progress
+const defaultCounterOverhead = 1
+
+//defaultMinZeroStepRun is the default length from which zero-step runs are reported as suspicious
+const defaultMinZeroStepRun = 10
+
+//StepHistogram counts the step kinds and the instruction counts of a set of events
+type StepHistogram struct {
+	Unknown uint64 `json:"unknown"`
+	Zero    uint64 `json:"zero"`
+	Single  uint64 `json:"single"`
+	Multi   uint64 `json:"multi"`
+	//Instructions maps the number of retired instructions, after subtracting the counter
+	//overhead, to the number of events
+	Instructions map[uint64]uint64 `json:"instructions"`
+}
+
+func newStepHistogram() *StepHistogram {
+	return &StepHistogram{Instructions: make(map[uint64]uint64)}
+}
+
+func (h *StepHistogram) add(kind StepKind, instructions uint64) {
+	switch kind {
+	case StepUnknown:
+		h.Unknown++
+		return
+	case StepZero:
+		h.Zero++
+	case StepSingle:
+		h.Single++
+	case StepMulti:
+		h.Multi++
+	}
+	h.Instructions[instructions]++
+}
+
+//Total returns the number of events
+func (h *StepHistogram) Total() uint64 {
+	return h.Unknown + h.Zero + h.Single + h.Multi
+}
+
+//SuspiciousRun is a sequence of events that indicates a problem with the stepping setup
+type SuspiciousRun struct {
+	//Start and End are the indices of the first and last event of the run
+	Start int `json:"start"`
+	End   int `json:"end"`
+	//Pages are the faulted pages inside the run, in order of their first occurrence
+	Pages  []uint64 `json:"pages"`
+	Reason string   `json:"reason"`
+}
+
+//Len returns the number of events in the run
+func (r SuspiciousRun) Len() int {
+	return r.End - r.Start + 1
+}
+
+func (r SuspiciousRun) String() string {
+	return fmt.Sprintf("events %d to %d (%d events, %d pages) : %s", r.Start, r.End, r.Len(), len(r.Pages), r.Reason)
+}
+
+//Summary contains statistics for a whole trace
+type Summary struct {
+	Events  uint64 `json:"events"`
+	Unknown uint64 `json:"unknown"`
+	Zero    uint64 `json:"zero"`
+	Single  uint64 `json:"single"`
+	Multi   uint64 `json:"multi"`
+	//SingleStepRate is the fraction of single-steps among all events with retired instructions
+	SingleStepRate float64 `json:"single_step_rate"`
+	//MaxInstructions is the largest number of instructions retired between two events
+	MaxInstructions uint64 `json:"max_instructions"`
+	//MeanMultiStep is the average number of instructions of the multi-steps
+	MeanMultiStep float64 `json:"mean_multi_step"`
+	//LongestZeroStepRun is the length of the longest sequence of consecutive zero-steps
+	LongestZeroStepRun int `json:"longest_zero_step_run"`
+	Pages              int `json:"pages"`
+}
+
+func (s Summary) String() string {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "Events: %d (%d without retired instructions)\n", s.Events, s.Unknown)
+	fmt.Fprintf(&sb, "Zero-steps: %d, Single-steps: %d, Multi-steps: %d\n", s.Zero, s.Single, s.Multi)
+	fmt.Fprintf(&sb, "Single-step rate: %.2f%%\n", 100*s.SingleStepRate)
+	fmt.Fprintf(&sb, "Max instructions: %d, mean multi-step: %.2f\n", s.MaxInstructions, s.MeanMultiStep)
+	fmt.Fprintf(&sb, "Longest zero-step run: %d, faulted pages: %d", s.LongestZeroStepRun, s.Pages)
+	return sb.String()
+}
+
+//Report is the result of an Analyzer
+type Report struct {
+	Summary Summary `json:"summary"`
+	//Pages contains a histogram for each faulted page, by GPA of the page
+	Pages map[uint64]*StepHistogram `json:"pages"`
+	//Suspicious lists runs that indicate problems, ordered by Start
+	Suspicious []SuspiciousRun `json:"suspicious"`
+}
+
+//SortedPages returns the keys of Pages in ascending order
+func (r *Report) SortedPages() []uint64 {
+	res := make([]uint64, 0, len(r.Pages))
+	for gpa := range r.Pages {
+		res = append(res, gpa)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
+
+//Analyzer classifies events by their retired instructions. Events are added one by one with
+//Add, which allows to analyze traces that do not fit into memory, e.g. with sevStep.EventScanner.
+//The zero value is ready to use, but subtracts no counter overhead and reports every zero-step run.
+//Use NewAnalyzer for the defaults. The exported fields must not be changed after the first call to Add
+type Analyzer struct {
+	//CounterOverhead is subtracted from Event.RetiredInstructions before classification.
+	//Defaults to 1, as the kernel's retrack logic considers deltas below 2 as no progress
+	CounterOverhead uint64
+	//MinZeroStepRun is the number of consecutive zero-steps from which the run is reported as
+	//suspicious, e.g. due to a retrack loop. Defaults to 10
+	MinZeroStepRun int
+
+	summary      Summary
+	pages        map[uint64]*StepHistogram
+	suspicious   []SuspiciousRun
+	multiStepSum uint64
+	//zeroRun is the current run of zero-steps. Only valid if inZeroRun is set
+	zeroRun   SuspiciousRun
+	inZeroRun bool
+}
+
+//NewAnalyzer creates an Analyzer with the default settings
+func NewAnalyzer() *Analyzer {
+	return &Analyzer{
+		CounterOverhead: defaultCounterOverhead,
+		MinZeroStepRun:  defaultMinZeroStepRun,
+		pages:           make(map[uint64]*StepHistogram),
+		suspicious:      make([]SuspiciousRun, 0),
+	}
+}
+
+//Classify returns the StepKind of ev and the number of retired instructions without the counter overhead
+func (a *Analyzer) Classify(ev *sevStep.Event) (StepKind, uint64) {
+	if !ev.HaveRetiredInstructions {
+		return StepUnknown, 0
+	}
+	instructions := uint64(0)
+	if ev.RetiredInstructions > a.CounterOverhead {
+		instructions = ev.RetiredInstructions - a.CounterOverhead
+	}
+	switch instructions {
+	case 0:
+		return StepZero, instructions
+	case 1:
+		return StepSingle, instructions
+	default:
+		return StepMulti, instructions
+	}
+}
+
+//Add classifies ev and updates the statistics
+func (a *Analyzer) Add(ev *sevStep.Event) StepKind {
+	kind, instructions := a.Classify(ev)
+	idx := int(a.summary.Events)
+	page := ev.FaultedGPA &^ 0xfff
+
+	if a.pages == nil {
+		a.pages = make(map[uint64]*StepHistogram)
+	}
+	histogram, ok := a.pages[page]
+	if !ok {
+		histogram = newStepHistogram()
+		a.pages[page] = histogram
+	}
+	histogram.add(kind, instructions)
+
+	a.summary.Events++
+	switch kind {
+	case StepUnknown:
+		a.summary.Unknown++
+	case StepZero:
+		a.summary.Zero++
+	case StepSingle:
+		a.summary.Single++
+	case StepMulti:
+		a.summary.Multi++
+		a.multiStepSum += instructions
+	}
+	if instructions > a.summary.MaxInstructions {
+		a.summary.MaxInstructions = instructions
+	}
+
+	if kind != StepZero {
+		if run, ok := a.finishZeroRun(); ok {
+			a.suspicious = append(a.suspicious, run)
+		}
+		a.inZeroRun = false
+		return kind
+	}
+	if !a.inZeroRun {
+		a.zeroRun = SuspiciousRun{Start: idx, Pages: make([]uint64, 0)}
+		a.inZeroRun = true
+	}
+	a.zeroRun.End = idx
+	for _, v := range a.zeroRun.Pages {
+		if v == page {
+			return kind
+		}
+	}
+	a.zeroRun.Pages = append(a.zeroRun.Pages, page)
+	return kind
+}
+
+//finishZeroRun updates the longest run with the current zero-step run and returns it if it is suspicious
+func (a *Analyzer) finishZeroRun() (SuspiciousRun, bool) {
+	if !a.inZeroRun {
+		return SuspiciousRun{}, false
+	}
+	run := a.zeroRun
+	if run.Len() > a.summary.LongestZeroStepRun {
+		a.summary.LongestZeroStepRun = run.Len()
+	}
+	if run.Len() < a.MinZeroStepRun {
+		return SuspiciousRun{}, false
+	}
+	run.Reason = fmt.Sprintf("%d consecutive zero-steps", run.Len())
+	//the retrack logic keeps refaulting on the same few pages if the guest cannot make progress
+	if len(run.Pages) <= 2 {
+		run.Reason += ", likely a retrack loop"
+	}
+	return run, true
+}
+
+//Report returns the analysis of all events added so far. A trailing zero-step run is included.
+//Further events may be added afterwards
+func (a *Analyzer) Report() *Report {
+	suspicious := append([]SuspiciousRun{}, a.suspicious...)
+	if run, ok := a.finishZeroRun(); ok {
+		suspicious = append(suspicious, run)
+	}
+	summary := a.summary
+	summary.Pages = len(a.pages)
+	if measured := summary.Events - summary.Unknown; measured > 0 {
+		summary.SingleStepRate = float64(summary.Single) / float64(measured)
+	}
+	if summary.Multi > 0 {
+		summary.MeanMultiStep = float64(a.multiStepSum) / float64(summary.Multi)
+	}
+	pages := make(map[uint64]*StepHistogram, len(a.pages))
+	for gpa, v := range a.pages {
+		histogram := *v
+		histogram.Instructions = make(map[uint64]uint64, len(v.Instructions))
+		for instructions, count := range v.Instructions {
+			histogram.Instructions[instructions] = count
+		}
+		pages[gpa] = &histogram
+	}
+	return &Report{
+		Summary:    summary,
+		Pages:      pages,
+		Suspicious: suspicious,
+	}
+}
+
+//Analyze classifies all events with the default settings
+func Analyze(events []*sevStep.Event) *Report {
+	a := NewAnalyzer()
+	for _, v := range events {
+		a.Add(v)
+	}
+	return a.Report()
+}
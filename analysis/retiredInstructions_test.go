@@ -0,0 +1,184 @@
+package analysis
+
+import (
+	"testing"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//testEvents creates one event per entry of retInstr, all faulting on gpa. Negative entries
+//create events without retired instructions
+func testEvents(gpa uint64, retInstr ...int) []*sevStep.Event {
+	events := make([]*sevStep.Event, 0, len(retInstr))
+	for _, v := range retInstr {
+		ev := &sevStep.Event{
+			ID:         uint64(len(events) + 2),
+			FaultedGPA: gpa,
+		}
+		if v >= 0 {
+			ev.HaveRetiredInstructions = true
+			ev.RetiredInstructions = uint64(v)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func repeat(value, count int) []int {
+	res := make([]int, count)
+	for i := range res {
+		res[i] = value
+	}
+	return res
+}
+
+func TestAnalyzer_Classify(t *testing.T) {
+	tests := []struct {
+		name     string
+		overhead uint64
+		retInstr int
+		want     StepKind
+		wantInst uint64
+	}{
+		{name: "no counter", overhead: 1, retInstr: -1, want: StepUnknown, wantInst: 0},
+		{name: "zero", overhead: 1, retInstr: 0, want: StepZero, wantInst: 0},
+		{name: "only overhead", overhead: 1, retInstr: 1, want: StepZero, wantInst: 0},
+		{name: "single", overhead: 1, retInstr: 2, want: StepSingle, wantInst: 1},
+		{name: "multi", overhead: 1, retInstr: 5, want: StepMulti, wantInst: 4},
+		{name: "no overhead single", overhead: 0, retInstr: 1, want: StepSingle, wantInst: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAnalyzer()
+			a.CounterOverhead = tt.overhead
+			got, gotInst := a.Classify(testEvents(0x1000, tt.retInstr)[0])
+			if got != tt.want || gotInst != tt.wantInst {
+				t.Errorf("Classify() = %v, %v, want %v, %v", got, gotInst, tt.want, tt.wantInst)
+			}
+		})
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	events := testEvents(0x1000, 2, 2, -1, 5)
+	events = append(events, testEvents(0x2abc, 1, 2)...)
+	got := Analyze(events)
+
+	wantSummary := Summary{
+		Events:             6,
+		Unknown:            1,
+		Zero:               1,
+		Single:             3,
+		Multi:              1,
+		SingleStepRate:     0.6,
+		MaxInstructions:    4,
+		MeanMultiStep:      4,
+		LongestZeroStepRun: 1,
+		Pages:              2,
+	}
+	if got.Summary != wantSummary {
+		t.Errorf("Summary = %+v, want %+v", got.Summary, wantSummary)
+	}
+	if len(got.Suspicious) != 0 {
+		t.Errorf("Suspicious = %v, want none", got.Suspicious)
+	}
+
+	pages := got.SortedPages()
+	if len(pages) != 2 || pages[0] != 0x1000 || pages[1] != 0x2000 {
+		t.Fatalf("SortedPages() = %x, want [1000 2000]", pages)
+	}
+	first := got.Pages[0x1000]
+	if first.Single != 2 || first.Multi != 1 || first.Unknown != 1 || first.Total() != 4 {
+		t.Errorf("histogram of 0x1000 = %+v", first)
+	}
+	if first.Instructions[1] != 2 || first.Instructions[4] != 1 {
+		t.Errorf("instructions of 0x1000 = %v", first.Instructions)
+	}
+	second := got.Pages[0x2000]
+	if second.Zero != 1 || second.Single != 1 || second.Instructions[0] != 1 {
+		t.Errorf("histogram of 0x2000 = %+v", second)
+	}
+}
+
+func TestAnalyzer_SuspiciousRuns(t *testing.T) {
+	tests := []struct {
+		name        string
+		events      []*sevStep.Event
+		wantRuns    [][2]int
+		wantLongest int
+		wantLoop    bool
+	}{
+		{
+			name:        "short run",
+			events:      testEvents(0x1000, append(repeat(0, 9), 2)...),
+			wantRuns:    [][2]int{},
+			wantLongest: 9,
+		},
+		{
+			name:        "retrack loop",
+			events:      testEvents(0x1000, append(append([]int{2}, repeat(1, 12)...), 2)...),
+			wantRuns:    [][2]int{{1, 12}},
+			wantLongest: 12,
+			wantLoop:    true,
+		},
+		{
+			name:        "trailing run",
+			events:      testEvents(0x1000, append([]int{5}, repeat(0, 10)...)...),
+			wantRuns:    [][2]int{{1, 10}},
+			wantLongest: 10,
+			wantLoop:    true,
+		},
+		{
+			name: "run across many pages",
+			events: func() []*sevStep.Event {
+				events := make([]*sevStep.Event, 0)
+				for i := 0; i < 10; i++ {
+					events = append(events, testEvents(uint64(i)<<12, 0)...)
+				}
+				return events
+			}(),
+			wantRuns:    [][2]int{{0, 9}},
+			wantLongest: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAnalyzer()
+			for _, v := range tt.events {
+				a.Add(v)
+			}
+			got := a.Report()
+			if got.Summary.LongestZeroStepRun != tt.wantLongest {
+				t.Errorf("LongestZeroStepRun = %v, want %v", got.Summary.LongestZeroStepRun, tt.wantLongest)
+			}
+			if len(got.Suspicious) != len(tt.wantRuns) {
+				t.Fatalf("Suspicious = %v, want %v runs", got.Suspicious, len(tt.wantRuns))
+			}
+			for i, v := range tt.wantRuns {
+				run := got.Suspicious[i]
+				if run.Start != v[0] || run.End != v[1] {
+					t.Errorf("run %d = [%d,%d], want %v", i, run.Start, run.End, v)
+				}
+				if gotLoop := len(run.Pages) <= 2; gotLoop != tt.wantLoop {
+					t.Errorf("run %d spans %d pages, want retrack loop %v", i, len(run.Pages), tt.wantLoop)
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyzer_ZeroValue(t *testing.T) {
+	a := &Analyzer{}
+	for _, v := range testEvents(0x1000, 0, 1, 2) {
+		a.Add(v)
+	}
+	got := a.Report()
+	want := Summary{Events: 3, Zero: 1, Single: 1, Multi: 1, SingleStepRate: 1.0 / 3, MaxInstructions: 2,
+		MeanMultiStep: 2, LongestZeroStepRun: 1, Pages: 1}
+	if got.Summary != want {
+		t.Errorf("Summary = %+v, want %+v", got.Summary, want)
+	}
+	if len(got.Suspicious) != 1 {
+		t.Errorf("Suspicious = %v, want the zero-step run", got.Suspicious)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/UzL-ITS/sev-step/analysis"
+	"github.com/UzL-ITS/sev-step/internal/cmdHelpers"
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//addrRange is an address range with exclusive end
+type addrRange struct {
+	start, end uint64
+}
+
+func (r addrRange) contains(addr uint64) bool {
+	return addr >= r.start && addr < r.end
+}
+
+//parseRanges parses "start-end" ranges with exclusive end. A single address selects its page
+func parseRanges(specs []string) ([]addrRange, error) {
+	ranges := make([]addrRange, 0, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "-", 2)
+		start, err := cmdHelpers.ParseUint(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 1 {
+			ranges = append(ranges, addrRange{start: start &^ 0xfff, end: start&^0xfff + 0x1000})
+			continue
+		}
+		end, err := cmdHelpers.ParseUint(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if end <= start {
+			return nil, fmt.Errorf("invalid range %q : end must be larger than start", spec)
+		}
+		ranges = append(ranges, addrRange{start: start, end: end})
+	}
+	return ranges, nil
+}
+
+func inAnyRange(ranges []addrRange, addr uint64) bool {
+	for _, v := range ranges {
+		if v.contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+//statsResult is the JSON output of the stats subcommand
+type statsResult struct {
+	Summary        analysis.Summary         `json:"summary"`
+	EventsWithRIP  uint64                   `json:"events_with_rip"`
+	ErrorCodes     map[string]uint64        `json:"error_codes"`
+	VCPUs          map[int]uint64           `json:"vcpus"`
+	TopPages       []pageCount              `json:"top_pages"`
+	SuspiciousRuns []analysis.SuspiciousRun `json:"suspicious_runs"`
+}
+
+type pageCount struct {
+	GPA    uint64 `json:"gpa"`
+	Faults uint64 `json:"faults"`
+}
+
+func runStats(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("stats", "Prints the number of events per error code, vCPU and page as well as the retired instruction statistics")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	topPages := fs.Int("top", 10, "number of most frequently faulted pages to print")
+	minZeroRun := fs.Int("min-zero-run", 10, "length from which zero-step runs are reported as suspicious")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *topPages < 0 || *minZeroRun < 0 {
+		return fmt.Errorf("-top and -min-zero-run must not be negative")
+	}
+
+	analyzer := analysis.NewAnalyzer()
+	analyzer.MinZeroStepRun = *minZeroRun
+	res := statsResult{
+		ErrorCodes: make(map[string]uint64),
+		VCPUs:      make(map[int]uint64),
+	}
+	faultsPerPage := make(map[uint64]uint64)
+	err := forEachEvent(fs.Args(), stdin, func(ev *sevStep.Event) error {
+		analyzer.Add(ev)
+		if ev.HaveRipInfo {
+			res.EventsWithRIP++
+		}
+		res.ErrorCodes[ev.ErrorCode.String()]++
+		res.VCPUs[ev.VCPU]++
+		faultsPerPage[ev.FaultedGPA&^0xfff]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	report := analyzer.Report()
+	res.Summary = report.Summary
+	res.SuspiciousRuns = report.Suspicious
+	res.TopPages = make([]pageCount, 0, len(faultsPerPage))
+	for gpa, count := range faultsPerPage {
+		res.TopPages = append(res.TopPages, pageCount{GPA: gpa, Faults: count})
+	}
+	sort.Slice(res.TopPages, func(i, j int) bool {
+		if res.TopPages[i].Faults != res.TopPages[j].Faults {
+			return res.TopPages[i].Faults > res.TopPages[j].Faults
+		}
+		return res.TopPages[i].GPA < res.TopPages[j].GPA
+	})
+	if len(res.TopPages) > *topPages {
+		res.TopPages = res.TopPages[:*topPages]
+	}
+
+	if *asJSON {
+		return writeJSON(stdout, res)
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%v\n", res.Summary)
+	fmt.Fprintf(tw, "Events with RIP: %d\n\n", res.EventsWithRIP)
+	fmt.Fprintf(tw, "ERROR CODE\tEVENTS\n")
+	codes := make([]string, 0, len(res.ErrorCodes))
+	for code := range res.ErrorCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, v := range codes {
+		fmt.Fprintf(tw, "%s\t%d\n", v, res.ErrorCodes[v])
+	}
+	fmt.Fprintf(tw, "\nVCPU\tEVENTS\n")
+	vcpus := make([]int, 0, len(res.VCPUs))
+	for vcpu := range res.VCPUs {
+		vcpus = append(vcpus, vcpu)
+	}
+	sort.Ints(vcpus)
+	for _, v := range vcpus {
+		fmt.Fprintf(tw, "%d\t%d\n", v, res.VCPUs[v])
+	}
+	fmt.Fprintf(tw, "\nPAGE\tFAULTS\n")
+	for _, v := range res.TopPages {
+		fmt.Fprintf(tw, "0x%x\t%d\n", v.GPA, v.Faults)
+	}
+	if len(res.SuspiciousRuns) > 0 {
+		fmt.Fprintf(tw, "\nSuspicious runs:\n")
+		for _, v := range res.SuspiciousRuns {
+			fmt.Fprintf(tw, "%v\n", v)
+		}
+	}
+	return tw.Flush()
+}
+
+//eventFilter contains the predicates of the filter subcommand. All predicates must match
+type eventFilter struct {
+	//withBits must all be set, withoutBits must all be clear
+	withBits, withoutBits sevStep.ErrorCode
+	gpaRanges, ripRanges  []addrRange
+}
+
+func (f *eventFilter) match(ev *sevStep.Event) bool {
+	if ev.ErrorCode&f.withBits != f.withBits || ev.ErrorCode&f.withoutBits != 0 {
+		return false
+	}
+	if len(f.gpaRanges) > 0 && !inAnyRange(f.gpaRanges, ev.FaultedGPA) {
+		return false
+	}
+	if len(f.ripRanges) > 0 && (!ev.HaveRipInfo || !inAnyRange(f.ripRanges, ev.RIP)) {
+		return false
+	}
+	return true
+}
+
+func runFilter(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("filter", "Prints the events matching all given predicates")
+	withBits := fs.String("error-code", "", "error code bits that must be set, e.g. \"Write|User\"")
+	withoutBits := fs.String("not-error-code", "", "error code bits that must not be set, e.g. \"User\" for kernel faults")
+	var gpas, rips cmdHelpers.StringList
+	fs.Var(&gpas, "gpa", "faulted GPA range \"start-end\" (exclusive end) or address of a page. May be repeated")
+	fs.Var(&rips, "rip", "RIP range \"start-end\" (exclusive end) or address of a page. May be repeated")
+	format := fs.String("format", sevStep.EventFormatJSON, "output format: json (JSON lines) or trace (binary trace)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter := &eventFilter{}
+	var err error
+	if *withBits != "" {
+		if filter.withBits, err = sevStep.ParseErrorCode(*withBits); err != nil {
+			return err
+		}
+	}
+	if *withoutBits != "" {
+		if filter.withoutBits, err = sevStep.ParseErrorCode(*withoutBits); err != nil {
+			return err
+		}
+	}
+	if filter.gpaRanges, err = parseRanges(gpas); err != nil {
+		return fmt.Errorf("invalid GPA range : %w", err)
+	}
+	if filter.ripRanges, err = parseRanges(rips); err != nil {
+		return fmt.Errorf("invalid RIP range : %w", err)
+	}
+
+	out, err := newEventOutput(stdout, *format, sevStep.TraceHeader{})
+	if err != nil {
+		return err
+	}
+	events, header, err := readEvents(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+	if err := out.open(header); err != nil {
+		return err
+	}
+	for _, v := range sevStep.FilterEvents(events, filter.match) {
+		if err := out.Write(v); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+//segment is the JSON output of the segment subcommand
+type segment struct {
+	Index    int      `json:"index"`
+	EventIDs []uint64 `json:"event_ids"`
+	//Pages is the number of distinct faulted pages
+	Pages int `json:"pages"`
+}
+
+func runSegment(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("segment", "Splits the events at faults whose RIP is on the marker page and prints the events between two markers")
+	marker := fs.String("marker", "", "virtual address of the marker page (required)")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *marker == "" {
+		return fmt.Errorf("-marker is required")
+	}
+	markerAddr, err := cmdHelpers.ParseUint(*marker)
+	if err != nil {
+		return err
+	}
+	events, _, err := readEvents(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	segments := make([]segment, 0)
+	for i, indices := range sevStep.EventsBetweenMarkerPage(events, markerAddr) {
+		s := segment{Index: i, EventIDs: make([]uint64, 0, len(indices))}
+		pages := make(map[uint64]bool)
+		for _, idx := range indices {
+			s.EventIDs = append(s.EventIDs, events[idx].ID)
+			pages[events[idx].FaultedGPA&^0xfff] = true
+		}
+		s.Pages = len(pages)
+		segments = append(segments, s)
+	}
+
+	if *asJSON {
+		return writeJSON(stdout, segments)
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "SEGMENT\tEVENTS\tPAGES\tFIRST ID\tLAST ID\n")
+	for _, v := range segments {
+		if len(v.EventIDs) == 0 {
+			fmt.Fprintf(tw, "%d\t0\t0\t-\t-\n", v.Index)
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\n", v.Index, len(v.EventIDs), v.Pages, v.EventIDs[0], v.EventIDs[len(v.EventIDs)-1])
+	}
+	return tw.Flush()
+}
+
+func runConvert(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("convert", "Converts the events to the given format. The input format is detected automatically")
+	format := fs.String("to", sevStep.EventFormatTrace, "output format: json (JSON lines) or trace (binary trace)")
+	trackMode := fs.String("mode", sevStep.PageTrackExec.String(), "track mode stored in the header of binary traces converted from JSON lines. Binary trace inputs keep their header")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	mode, err := sevStep.ParsePageTrackMode(*trackMode)
+	if err != nil {
+		return err
+	}
+	out, err := newEventOutput(stdout, *format, sevStep.TraceHeader{TrackMode: mode})
+	if err != nil {
+		return err
+	}
+	err = forEachInput(fs.Args(), stdin, func(name string, in *eventInput) error {
+		if err := out.open(in.header()); err != nil {
+			return err
+		}
+		return in.forEach(name, out.Write)
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func runDecode(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := newFlagSet("decode", "Prints the names of the error codes given as arguments or, with -events, of all events")
+	events := fs.Bool("events", false, "decode the error codes of the events in the files given as arguments or stdin")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	if !*events {
+		if fs.NArg() == 0 {
+			return fmt.Errorf("no error codes given")
+		}
+		fmt.Fprintf(tw, "CODE\tNAMES\n")
+		for _, v := range fs.Args() {
+			code, err := cmdHelpers.ParseUint(v)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "0x%x\t%v\n", code, sevStep.ErrorCode(code))
+		}
+		return tw.Flush()
+	}
+
+	fmt.Fprintf(tw, "ID\tFAULTED GPA\tCODE\tNAMES\n")
+	err := forEachEvent(fs.Args(), stdin, func(ev *sevStep.Event) error {
+		_, err := fmt.Fprintf(tw, "%d\t0x%x\t0x%x\t%v\n", ev.ID, ev.FaultedGPA, uint64(ev.ErrorCode), ev.ErrorCode)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,242 @@
+//Command sevstep-analyze provides offline analyses of recorded page fault events as subcommands.
+//Inputs are JSON lines, as accepted by sevStep.ParseInputFile, or binary traces. They are read
+//from the files given as arguments or from stdin. Run "sevstep-analyze help" for a list of subcommands
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//subcommand is a single analysis. run gets the arguments after the subcommand name
+type subcommand struct {
+	description string
+	run         func(args []string, stdin io.Reader, stdout io.Writer) error
+}
+
+var subcommands = map[string]subcommand{
+	"stats":   {description: "print summary statistics of the events", run: runStats},
+	"filter":  {description: "keep events matching error code, GPA and RIP predicates", run: runFilter},
+	"segment": {description: "split the events at accesses to a marker page", run: runSegment},
+	"convert": {description: "convert between JSON lines and the binary trace format", run: runConvert},
+	"decode":  {description: "print the names of page fault error codes", run: runDecode},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: sevstep-analyze <subcommand> [flags] [files...]\n\nSubcommands:\n")
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, v := range names {
+		fmt.Fprintf(w, "  %-8s %s\n", v, subcommands[v].description)
+	}
+	fmt.Fprintf(w, "\nRun \"sevstep-analyze <subcommand> -h\" for the flags of a subcommand\n")
+}
+
+//run executes the subcommand in args
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(stdout)
+		return nil
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown subcommand %q, run \"sevstep-analyze help\"", args[0])
+	}
+	return cmd.run(args[1:], stdin, stdout)
+}
+
+//eventInput reads the events of one input in either format
+type eventInput struct {
+	scanner *sevStep.EventScanner
+	reader  *sevStep.EventReader
+}
+
+//openEventInput detects the format of r
+func openEventInput(r io.Reader) (*eventInput, error) {
+	br := bufio.NewReader(r)
+	if sevStep.IsBinaryTrace(br) {
+		reader, err := sevStep.NewEventReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return &eventInput{reader: reader}, nil
+	}
+	return &eventInput{scanner: sevStep.NewEventScanner(br)}, nil
+}
+
+//header returns the header of binary traces and nil for JSON lines
+func (in *eventInput) header() *sevStep.TraceHeader {
+	if in.reader == nil {
+		return nil
+	}
+	header := in.reader.Header()
+	return &header
+}
+
+//next returns the next event or io.EOF
+func (in *eventInput) next() (*sevStep.Event, error) {
+	if in.reader != nil {
+		return in.reader.Read()
+	}
+	if in.scanner.Scan() {
+		return in.scanner.Event(), nil
+	}
+	if err := in.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+//forEach calls fn for all remaining events. name is used in errors
+func (in *eventInput) forEach(name string, fn func(ev *sevStep.Event) error) error {
+	for {
+		ev, err := in.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %v : %w", name, err)
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+}
+
+//forEachInput calls fn for each of the files in paths, or for stdin if paths is empty
+func forEachInput(paths []string, stdin io.Reader, fn func(name string, in *eventInput) error) error {
+	readAll := func(name string, r io.Reader) error {
+		in, err := openEventInput(r)
+		if err != nil {
+			return fmt.Errorf("failed to open %v : %w", name, err)
+		}
+		return fn(name, in)
+	}
+	if len(paths) == 0 {
+		return readAll("stdin", stdin)
+	}
+	for _, v := range paths {
+		f, err := os.Open(v)
+		if err != nil {
+			return fmt.Errorf("failed to open input : %w", err)
+		}
+		err = readAll(v, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//forEachEvent calls fn for all events of the files in paths, or of stdin if paths is empty
+func forEachEvent(paths []string, stdin io.Reader, fn func(ev *sevStep.Event) error) error {
+	return forEachInput(paths, stdin, func(name string, in *eventInput) error {
+		return in.forEach(name, fn)
+	})
+}
+
+//readEvents returns all events of the inputs and the header of the first input, which is nil for
+//JSON lines. See forEachEvent
+func readEvents(paths []string, stdin io.Reader) ([]*sevStep.Event, *sevStep.TraceHeader, error) {
+	events := make([]*sevStep.Event, 0)
+	var firstHeader *sevStep.TraceHeader
+	first := true
+	err := forEachInput(paths, stdin, func(name string, in *eventInput) error {
+		if first {
+			firstHeader = in.header()
+			first = false
+		}
+		return in.forEach(name, func(ev *sevStep.Event) error {
+			events = append(events, ev)
+			return nil
+		})
+	})
+	return events, firstHeader, err
+}
+
+//eventOutput writes events in one of the formats. Binary traces keep the header of the first
+//binary trace input, thus the sink is only created once the header of the first input is known
+type eventOutput struct {
+	w      io.Writer
+	format string
+	//defaultHeader is used for JSON lines inputs
+	defaultHeader sevStep.TraceHeader
+	sink          sevStep.EventSink
+}
+
+func newEventOutput(w io.Writer, format string, defaultHeader sevStep.TraceHeader) (*eventOutput, error) {
+	if format != sevStep.EventFormatJSON && format != sevStep.EventFormatTrace {
+		return nil, fmt.Errorf("invalid format %q, expected %q or %q", format, sevStep.EventFormatJSON, sevStep.EventFormatTrace)
+	}
+	return &eventOutput{w: w, format: format, defaultHeader: defaultHeader}, nil
+}
+
+//open creates the sink with header, the header of the first input, unless it was already created.
+//If header is nil, e.g. for JSON lines inputs, the default header is used
+func (o *eventOutput) open(header *sevStep.TraceHeader) error {
+	if o.sink != nil {
+		return nil
+	}
+	if header == nil {
+		header = &o.defaultHeader
+	}
+	var err error
+	o.sink, err = sevStep.NewEventSink(o.w, o.format, *header)
+	return err
+}
+
+//Write writes ev. Requires open to be called before
+func (o *eventOutput) Write(ev *sevStep.Event) error {
+	if err := o.sink.Write(ev); err != nil {
+		return fmt.Errorf("failed to write event %v : %w", ev.ID, err)
+	}
+	return nil
+}
+
+//Flush writes buffered events. Without inputs, a binary trace with the default header is written
+func (o *eventOutput) Flush() error {
+	if err := o.open(nil); err != nil {
+		return err
+	}
+	return o.sink.Flush()
+}
+
+//writeJSON prints v as indented JSON
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+//newFlagSet creates the flag set of a subcommand
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: sevstep-analyze %s [flags] [files...]\n%s\n\nFlags:\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Printf("sevstep-analyze failed : %v", err)
+		os.Exit(1)
+	}
+}
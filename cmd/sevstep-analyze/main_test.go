@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//testInput contains user and kernel fetches with two visits of the marker page at 0x400000
+const testInput = `{"id":1,"faulted_gpa":4096,"error_code":20,"have_rip_info":true,"rip":4194304,"have_retired_instructions":true,"retired_instructions":2}
+{"id":2,"faulted_gpa":8192,"error_code":20,"have_rip_info":true,"rip":4198400,"have_retired_instructions":true,"retired_instructions":2}
+{"id":3,"faulted_gpa":12288,"error_code":17,"have_rip_info":true,"rip":4202496,"have_retired_instructions":true,"retired_instructions":7}
+{"id":4,"faulted_gpa":4096,"error_code":20,"have_rip_info":true,"rip":4194320,"have_retired_instructions":true,"retired_instructions":2}
+{"id":5,"faulted_gpa":16384,"error_code":6,"have_rip_info":false,"rip":0}
+`
+
+func runCommand(t *testing.T, args []string, stdin string) string {
+	t.Helper()
+	stdout := bytes.Buffer{}
+	if err := run(args, strings.NewReader(stdin), &stdout); err != nil {
+		t.Fatalf("run(%v) error = %v", args, err)
+	}
+	return stdout.String()
+}
+
+func eventIDs(t *testing.T, input string) []uint64 {
+	t.Helper()
+	events, err := sevStep.ParseInputFile(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseInputFile failed : %v", err)
+	}
+	ids := make([]uint64, 0, len(events))
+	for _, v := range events {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
+
+func TestRun_Filter(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantIDs []uint64
+	}{
+		{name: "no predicates", args: []string{}, wantIDs: []uint64{1, 2, 3, 4, 5}},
+		{name: "user fetches", args: []string{"-error-code", "User|Fetch"}, wantIDs: []uint64{1, 2, 4}},
+		{name: "kernel", args: []string{"-not-error-code", "User"}, wantIDs: []uint64{3}},
+		{name: "gpa page", args: []string{"-gpa", "0x1fff"}, wantIDs: []uint64{1, 4}},
+		{name: "gpa ranges", args: []string{"-gpa", "0x2000-0x4000", "-gpa", "0x4000"}, wantIDs: []uint64{2, 3, 5}},
+		{name: "rip range skips events without rip", args: []string{"-rip", "0x0-0x401000"}, wantIDs: []uint64{1, 4}},
+		{name: "combined", args: []string{"-error-code", "0x10", "-rip", "0x401000,0x402000"}, wantIDs: []uint64{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := eventIDs(t, runCommand(t, append([]string{"filter"}, tt.args...), testInput))
+			if !reflect.DeepEqual(got, tt.wantIDs) {
+				t.Errorf("filter returned %v, want %v", got, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestRun_InvalidArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "unknown subcommand", args: []string{"plot"}},
+		{name: "unknown error bit", args: []string{"filter", "-error-code", "Read"}},
+		{name: "empty range", args: []string{"filter", "-gpa", "0x2000-0x1000"}},
+		{name: "invalid format", args: []string{"filter", "-format", "csv"}},
+		{name: "segment without marker", args: []string{"segment"}},
+		{name: "invalid mode", args: []string{"convert", "-mode", "read"}},
+		{name: "decode without codes", args: []string{"decode"}},
+		{name: "negative top", args: []string{"stats", "-top", "-1"}},
+		{name: "negative zero run", args: []string{"stats", "-min-zero-run", "-1"}},
+		{name: "missing file", args: []string{"stats", filepath.Join(os.TempDir(), "sevstep-analyze-missing.json")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := run(tt.args, strings.NewReader(testInput), io.Discard); err == nil {
+				t.Errorf("run(%v) should fail", tt.args)
+			}
+		})
+	}
+}
+
+func TestRun_Stats(t *testing.T) {
+	var res statsResult
+	if err := json.Unmarshal([]byte(runCommand(t, []string{"stats", "-json", "-top", "1"}, testInput)), &res); err != nil {
+		t.Fatalf("failed to parse output : %v", err)
+	}
+	if res.Summary.Events != 5 || res.Summary.Single != 3 || res.Summary.Multi != 1 || res.Summary.Unknown != 1 {
+		t.Errorf("unexpected summary %+v", res.Summary)
+	}
+	if res.EventsWithRIP != 4 {
+		t.Errorf("EventsWithRIP = %v, want 4", res.EventsWithRIP)
+	}
+	wantCodes := map[string]uint64{"User|Fetch": 3, "Present|Fetch": 1, "Write|User": 1}
+	if !reflect.DeepEqual(res.ErrorCodes, wantCodes) {
+		t.Errorf("ErrorCodes = %v, want %v", res.ErrorCodes, wantCodes)
+	}
+	if want := []pageCount{{GPA: 0x1000, Faults: 2}}; !reflect.DeepEqual(res.TopPages, want) {
+		t.Errorf("TopPages = %v, want %v", res.TopPages, want)
+	}
+
+	table := runCommand(t, []string{"stats"}, testInput)
+	if !strings.Contains(table, "User|Fetch") || !strings.Contains(table, "0x1000") {
+		t.Errorf("unexpected table\n%v", table)
+	}
+}
+
+func TestRun_Segment(t *testing.T) {
+	var segments []segment
+	if err := json.Unmarshal([]byte(runCommand(t, []string{"segment", "-marker", "0x400000", "-json"}, testInput)), &segments); err != nil {
+		t.Fatalf("failed to parse output : %v", err)
+	}
+	want := []segment{{Index: 0, EventIDs: []uint64{2, 3}, Pages: 2}}
+	if !reflect.DeepEqual(segments, want) {
+		t.Errorf("segment returned %+v, want %+v", segments, want)
+	}
+}
+
+func TestRun_ConvertRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "events.json")
+	if err := os.WriteFile(input, []byte(testInput), 0644); err != nil {
+		t.Fatalf("failed to write input : %v", err)
+	}
+	trace := runCommand(t, []string{"convert", "-mode", "write", input}, "")
+	er, err := sevStep.NewEventReader(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("NewEventReader failed : %v", err)
+	}
+	if er.Header().TrackMode != sevStep.PageTrackWrite {
+		t.Errorf("TrackMode = %v, want %v", er.Header().TrackMode, sevStep.PageTrackWrite)
+	}
+
+	//the input format of convert and the other subcommands is detected automatically
+	back := runCommand(t, []string{"convert", "-to", "json"}, trace)
+	if got := eventIDs(t, back); !reflect.DeepEqual(got, []uint64{1, 2, 3, 4, 5}) {
+		t.Errorf("round trip returned %v", got)
+	}
+	if got := eventIDs(t, runCommand(t, []string{"filter", "-not-error-code", "User"}, trace)); !reflect.DeepEqual(got, []uint64{3}) {
+		t.Errorf("filter on trace returned %v", got)
+	}
+}
+
+func TestRun_Decode(t *testing.T) {
+	got := runCommand(t, []string{"decode", "0x14", "6"}, "")
+	for _, want := range []string{"User|Fetch", "Write|User"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("decode output does not contain %q\n%v", want, got)
+		}
+	}
+	got = runCommand(t, []string{"decode", "-events"}, testInput)
+	if lines := strings.Split(strings.TrimSpace(got), "\n"); len(lines) != 6 || !strings.Contains(lines[3], "Present|Fetch") {
+		t.Errorf("unexpected event decode output\n%v", got)
+	}
+}
+
+func TestRun_KeepsTraceHeader(t *testing.T) {
+	header := sevStep.TraceHeader{TrackMode: sevStep.PageTrackAccess, Metadata: map[string]string{"victim": "openssl"}}
+	trace := &strings.Builder{}
+	if _, err := sevStep.ConvertJSONToTrace(strings.NewReader(testInput), trace, header); err != nil {
+		t.Fatalf("ConvertJSONToTrace failed : %v", err)
+	}
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "convert", args: []string{"convert", "-to", "trace"}},
+		{name: "filter", args: []string{"filter", "-format", "trace", "-not-error-code", "User"}},
+		{name: "filter without matches", args: []string{"filter", "-format", "trace", "-gpa", "0x100000"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			er, err := sevStep.NewEventReader(strings.NewReader(runCommand(t, tt.args, trace.String())))
+			if err != nil {
+				t.Fatalf("NewEventReader failed : %v", err)
+			}
+			if got := er.Header(); got.TrackMode != header.TrackMode || !reflect.DeepEqual(got.Metadata, header.Metadata) {
+				t.Errorf("header = %+v, want %+v", got, header)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+//Command sevstep-gdbserver lets GDB and other tools speaking the GDB remote serial protocol inspect
+//a guest through the sev-step kernel patch, see package gdbStub. Connect with e.g.
+//"target remote localhost:1234" in GDB. Addresses are guest physical, unless -cr3 is given
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/UzL-ITS/sev-step/gdbStub"
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//serverConfig are the command line options
+type serverConfig struct {
+	kvmPath       string
+	listen        string
+	getRIP        bool
+	cr3           string
+	pagingMode    int
+	cBit          int
+	hostDecrypted bool
+	wbinvdCPU     int
+}
+
+func parseArgs(args []string) (*serverConfig, error) {
+	fs := flag.NewFlagSet("sevstep-gdbserver", flag.ContinueOnError)
+	cfg := &serverConfig{}
+	fs.StringVar(&cfg.kvmPath, "kvm", "/dev/kvm", "device file of the patched kernel")
+	fs.StringVar(&cfg.listen, "listen", "localhost:1234", "TCP address or unix socket with \"unix:\" prefix to listen on")
+	fs.BoolVar(&cfg.getRIP, "rip", true, "request the RIP for each event. Required to report the RIP to GDB")
+	fs.StringVar(&cfg.cr3, "cr3", "", "guest CR3. If set, addresses are translated as guest virtual addresses")
+	fs.IntVar(&cfg.pagingMode, "paging", int(sevStep.PagingMode4Level), "number of page table levels of the guest: 4 or 5")
+	fs.IntVar(&cfg.cBit, "cbit", -1, "position of the C-bit in page table entries of SEV guests. -1 disables masking")
+	fs.BoolVar(&cfg.hostDecrypted, "host-decrypted", false, "read memory and page tables with the host's key instead of the ciphertext")
+	fs.IntVar(&cfg.wbinvdCPU, "wbinvd-cpu", -1, "CPU to flush the caches on before reading memory, required for SEV-ES. -1 disables flushing")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	return cfg, nil
+}
+
+//newServer creates the server for tracker as configured
+func (cfg *serverConfig) newServer(tracker sevStep.Tracker) (*gdbStub.Server, error) {
+	server := gdbStub.NewServer(tracker)
+	if cfg.hostDecrypted {
+		server.View = sevStep.MemoryViewHostDecrypted
+	}
+	if cfg.cr3 == "" {
+		return server, nil
+	}
+	cr3, err := strconv.ParseUint(cfg.cr3, 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cr3 %q", cfg.cr3)
+	}
+	mode := sevStep.PagingMode(cfg.pagingMode)
+	if mode != sevStep.PagingMode4Level && mode != sevStep.PagingMode5Level {
+		return nil, fmt.Errorf("unsupported paging mode %d", cfg.pagingMode)
+	}
+	server.CR3 = cr3
+	server.Walker = sevStep.NewTrackerPageTableWalker(tracker, mode, cfg.hostDecrypted, cfg.wbinvdCPU)
+	if cfg.cBit >= 0 {
+		server.Walker.CBitMask = uint64(1) << uint(cfg.cBit)
+	}
+	return server, nil
+}
+
+func run(ctx context.Context, args []string) error {
+	cfg, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	api, err := sevStep.NewIoctlAPI(cfg.kvmPath, cfg.getRIP)
+	if err != nil {
+		return fmt.Errorf("failed to open %v : %w", cfg.kvmPath, err)
+	}
+	defer func() {
+		if err := api.Close(); err != nil {
+			log.Printf("Close failed : %v", err)
+		}
+	}()
+	server, err := cfg.newServer(api)
+	if err != nil {
+		return err
+	}
+	l, err := gdbStub.Listen(cfg.listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen : %w", err)
+	}
+	log.Printf("Listening on %v", l.Addr())
+	err = server.Serve(ctx, l)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Printf("sevstep-gdbserver failed : %v", err)
+		stop()
+		os.Exit(1)
+	}
+}
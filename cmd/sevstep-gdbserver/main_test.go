@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+func TestNewServer(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantWalker bool
+		wantCBit   uint64
+		wantView   sevStep.MemoryView
+		wantErr    bool
+	}{
+		{name: "physical addresses", args: []string{}, wantView: sevStep.MemoryViewCiphertext},
+		{name: "virtual addresses", args: []string{"-cr3", "0x1000", "-cbit", "51", "-host-decrypted"}, wantWalker: true, wantCBit: 1 << 51, wantView: sevStep.MemoryViewHostDecrypted},
+		{name: "invalid cr3", args: []string{"-cr3", "cr3"}, wantErr: true},
+		{name: "invalid paging mode", args: []string{"-cr3", "0x1000", "-paging", "3"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseArgs(tt.args)
+			if err != nil {
+				t.Fatalf("parseArgs() error = %v", err)
+			}
+			server, err := cfg.newServer(sevStep.NewSimulatedVM(1, nil, true))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (server.Walker != nil) != tt.wantWalker || server.View != tt.wantView {
+				t.Errorf("unexpected server %+v", server)
+			}
+			if tt.wantWalker && (server.CR3 != 0x1000 || server.Walker.CBitMask != tt.wantCBit) {
+				t.Errorf("unexpected translation CR3 0x%x, C-bit mask 0x%x", server.CR3, server.Walker.CBitMask)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/internal/cmdHelpers"
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+const (
+	viewCiphertext    = "ciphertext"
+	viewHostDecrypted = "host-decrypted"
+)
+
+//recordConfig describes an experiment. It is read from the config file and overwritten by flags
+type recordConfig struct {
+	//KVMPath is the device file of the patched kernel
+	KVMPath string `json:"kvm_path"`
+	//Pages are GPAs or ranges "start-end", with exclusive end, of the pages to track
+	Pages []string `json:"pages"`
+	//TrackAll tracks all pages of the VM instead of Pages
+	TrackAll bool `json:"track_all"`
+	//TrackMode is parsed with sevStep.ParsePageTrackMode
+	TrackMode string `json:"track_mode"`
+	//Retrack re-tracks faulted pages. In interactive mode, this is done once the next event arrives
+	Retrack bool `json:"retrack"`
+	//Batch uses batch tracking instead of interactive events
+	Batch     bool   `json:"batch"`
+	BatchSize uint64 `json:"batch_size"`
+	//PerfCPU is the CPU the vCPU is pinned to, used for the retired instructions counter. -1 disables it
+	PerfCPU int  `json:"perf_cpu"`
+	GetRIP  bool `json:"get_rip"`
+	//Capture lists the memory ranges read for each interactive event, as "gpa:size". A "+"
+	//prefix makes gpa relative to the faulted page
+	Capture     []string `json:"capture"`
+	CaptureView string   `json:"capture_view"`
+	//Output is the output file, "-" for stdout
+	Output string `json:"output"`
+	//Format is "json" for JSON lines or "trace" for the binary trace format
+	Format string `json:"format"`
+	//MaxEvents stops the interactive recording after this many events. Zero means no limit
+	MaxEvents uint64 `json:"max_events"`
+	//Duration stops the recording after the given time, e.g. "10s". Empty means no limit
+	Duration string `json:"duration"`
+	//Metadata is stored in the header of binary traces
+	Metadata map[string]string `json:"metadata"`
+	//DryRun records from a simulated VM instead of KVMPath
+	DryRun bool `json:"dry_run"`
+	//DryRunAccesses is the number of accesses the simulated guest performs
+	DryRunAccesses int `json:"dry_run_accesses"`
+}
+
+func defaultConfig() *recordConfig {
+	return &recordConfig{
+		KVMPath:        "/dev/kvm",
+		Pages:          []string{},
+		TrackMode:      sevStep.PageTrackExec.String(),
+		BatchSize:      100000,
+		PerfCPU:        -1,
+		Capture:        []string{},
+		CaptureView:    viewCiphertext,
+		Output:         "-",
+		Format:         sevStep.EventFormatJSON,
+		Metadata:       map[string]string{},
+		DryRunAccesses: 100,
+	}
+}
+
+//loadConfig reads the JSON config at path on top of the defaults
+func loadConfig(path string) (*recordConfig, error) {
+	cfg := defaultConfig()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config : %w", err)
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %v : %w", path, err)
+	}
+	return cfg, nil
+}
+
+//experiment is the parsed and validated form of recordConfig
+type experiment struct {
+	cfg       *recordConfig
+	trackMode sevStep.PageTrackMode
+	//pages are the GPAs of all pages to track
+	pages    []uint64
+	capture  *sevStep.CapturePolicy
+	duration time.Duration
+}
+
+//parsePages expands the page and range specifications to page aligned GPAs
+func parsePages(specs []string) ([]uint64, error) {
+	pages := make([]uint64, 0)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "-", 2)
+		start, err := cmdHelpers.ParseUint(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid page %q : %w", spec, err)
+		}
+		if len(parts) == 1 {
+			pages = append(pages, start&^0xfff)
+			continue
+		}
+		end, err := cmdHelpers.ParseUint(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid page range %q : %w", spec, err)
+		}
+		if end <= start {
+			return nil, fmt.Errorf("invalid page range %q : end must be larger than start", spec)
+		}
+		for gpa := start &^ 0xfff; gpa < end; gpa += 0x1000 {
+			pages = append(pages, gpa)
+		}
+	}
+	return pages, nil
+}
+
+//parseCapture parses the capture specifications "[+]gpa:size"
+func parseCapture(specs []string, view string) (*sevStep.CapturePolicy, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	var memoryView sevStep.MemoryView
+	switch view {
+	case viewCiphertext:
+		memoryView = sevStep.MemoryViewCiphertext
+	case viewHostDecrypted:
+		memoryView = sevStep.MemoryViewHostDecrypted
+	default:
+		return nil, fmt.Errorf("invalid capture view %q, expected %q or %q", view, viewCiphertext, viewHostDecrypted)
+	}
+	policy := sevStep.NewCapturePolicy(memoryView)
+	for _, spec := range specs {
+		r := sevStep.CaptureRange{}
+		rest := spec
+		if strings.HasPrefix(rest, "+") {
+			r.RelativeToFault = true
+			rest = rest[1:]
+		}
+		parts := strings.Split(rest, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid capture range %q, expected \"[+]gpa:size\"", spec)
+		}
+		var err error
+		if r.GPA, err = cmdHelpers.ParseUint(parts[0]); err != nil {
+			return nil, fmt.Errorf("invalid capture range %q : %w", spec, err)
+		}
+		if r.Size, err = cmdHelpers.ParseUint(parts[1]); err != nil || r.Size == 0 {
+			return nil, fmt.Errorf("invalid capture size in %q", spec)
+		}
+		policy.Ranges = append(policy.Ranges, r)
+	}
+	return policy, nil
+}
+
+//parse validates cfg and converts it to an experiment
+func (cfg *recordConfig) parse() (*experiment, error) {
+	e := &experiment{cfg: cfg}
+	var err error
+	if e.trackMode, err = sevStep.ParsePageTrackMode(cfg.TrackMode); err != nil {
+		return nil, err
+	}
+	if e.pages, err = parsePages(cfg.Pages); err != nil {
+		return nil, err
+	}
+	if len(e.pages) == 0 && !cfg.TrackAll {
+		return nil, fmt.Errorf("no pages to track, specify pages or track all")
+	}
+	if e.capture, err = parseCapture(cfg.Capture, cfg.CaptureView); err != nil {
+		return nil, err
+	}
+	if cfg.Batch && e.capture != nil {
+		return nil, fmt.Errorf("memory capture requires interactive events and cannot be used in batch mode")
+	}
+	if cfg.Batch && cfg.BatchSize < 2 {
+		return nil, fmt.Errorf("batch size must be at least 2")
+	}
+	if cfg.Format != sevStep.EventFormatJSON && cfg.Format != sevStep.EventFormatTrace {
+		return nil, fmt.Errorf("invalid format %q, expected %q or %q", cfg.Format, sevStep.EventFormatJSON, sevStep.EventFormatTrace)
+	}
+	if cfg.Duration != "" {
+		if e.duration, err = time.ParseDuration(cfg.Duration); err != nil {
+			return nil, fmt.Errorf("invalid duration : %w", err)
+		}
+	}
+	if cfg.DryRun && cfg.DryRunAccesses <= 0 {
+		return nil, fmt.Errorf("dry run requires a positive number of accesses")
+	}
+	return e, nil
+}
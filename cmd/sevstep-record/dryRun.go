@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//dryRunBackend is a simulated VM that cancels the recording once its guest finished, as no
+//further events can arrive
+type dryRunBackend struct {
+	*sevStep.SimulatedVM
+	cancel context.CancelFunc
+}
+
+//newDryRunBackend creates a simulated guest that accesses the tracked pages round robin, with
+//the access kind matching the track mode. The returned context is cancelled once the guest finished
+func (e *experiment) newDryRunBackend(ctx context.Context) (*dryRunBackend, context.Context) {
+	pages := e.pages
+	if len(pages) == 0 {
+		pages = []uint64{0x0, 0x1000, 0x2000, 0x3000}
+	}
+	kind := sevStep.AccessRead
+	switch e.trackMode {
+	case sevStep.PageTrackWrite:
+		kind = sevStep.AccessWrite
+	case sevStep.PageTrackExec, sevStep.PageTraceResetExec:
+		kind = sevStep.AccessExec
+	}
+
+	maxPage := uint64(0)
+	script := make([]sevStep.GuestAccess, 0, e.cfg.DryRunAccesses)
+	for i := 0; i < e.cfg.DryRunAccesses; i++ {
+		gpa := pages[i%len(pages)] + uint64(i%64)*0x40
+		if gpa > maxPage {
+			maxPage = gpa
+		}
+		script = append(script, sevStep.GuestAccess{
+			GPA:  gpa,
+			Kind: kind,
+			RIP:  0x400000 + gpa,
+			//at least 2, as the kernel's batch retrack logic considers smaller deltas as no progress
+			RetiredInstructions: uint64(2 + i%3),
+		})
+	}
+	//the guest memory must cover the accessed pages and all capture ranges
+	memoryPages := maxPage>>12 + 1
+	if e.capture != nil {
+		for _, v := range e.capture.Ranges {
+			end := v.GPA + v.Size
+			if v.RelativeToFault {
+				end += maxPage &^ 0xfff
+			}
+			if pages := (end + 0xfff) >> 12; pages > memoryPages {
+				memoryPages = pages
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return &dryRunBackend{
+		SimulatedVM: sevStep.NewSimulatedVM(memoryPages, script, e.cfg.GetRIP),
+		cancel:      cancel,
+	}, ctx
+}
+
+func (b *dryRunBackend) CmdPollEvent() (*sevStep.Event, bool, error) {
+	ev, ok, err := b.SimulatedVM.CmdPollEvent()
+	if err == nil && !ok && b.GuestDone() {
+		b.cancel()
+	}
+	return ev, ok, err
+}
+
+func (b *dryRunBackend) CmdBatchTrackingEventCount() (uint64, error) {
+	count, err := b.SimulatedVM.CmdBatchTrackingEventCount()
+	if err == nil && b.GuestDone() {
+		b.cancel()
+	}
+	return count, err
+}
+
+var _ sevStep.Tracker = (*dryRunBackend)(nil)
@@ -0,0 +1,179 @@
+//Command sevstep-record tracks pages of a VM with the sev-step kernel patch and records the page
+//fault events to a file. The experiment is described by flags or a JSON config file, see recordConfig.
+//Flags take precedence over the config file. Use -dry-run to test a setup against a simulated VM.
+//On SIGINT, the recording stops, the kernel side is reset with CmdReset and all recorded events are written
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/UzL-ITS/sev-step/internal/cmdHelpers"
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//parseArgs builds the config from the optional config file and the flags in args
+func parseArgs(args []string) (*recordConfig, error) {
+	fs := flag.NewFlagSet("sevstep-record", flag.ContinueOnError)
+	defaults := defaultConfig()
+	configPath := fs.String("config", "", "JSON config file. Flags take precedence")
+	kvmPath := fs.String("kvm", defaults.KVMPath, "device file of the patched kernel")
+	var pages, capture, metadata cmdHelpers.StringList
+	fs.Var(&pages, "page", "GPA or range \"start-end\" (exclusive end) of pages to track. May be repeated")
+	trackAll := fs.Bool("track-all", false, "track all pages of the VM")
+	trackMode := fs.String("mode", defaults.TrackMode, "track mode: Write, Access, ResetAccess, Exec or ResetExec")
+	retrack := fs.Bool("retrack", false, "retrack pages after they faulted")
+	batch := fs.Bool("batch", false, "use batch tracking instead of interactive events")
+	batchSize := fs.Uint64("batch-size", defaults.BatchSize, "number of events per batch")
+	perfCPU := fs.Int("perf-cpu", defaults.PerfCPU, "CPU the vCPU is pinned to, for counting retired instructions. -1 disables counting")
+	getRIP := fs.Bool("rip", false, "request the RIP for each event")
+	fs.Var(&capture, "capture", "memory range \"[+]gpa:size\" to read for each event, + means relative to the faulted page. May be repeated")
+	captureView := fs.String("capture-view", defaults.CaptureView, "view for captured memory: ciphertext or host-decrypted")
+	output := fs.String("out", defaults.Output, "output file, - for stdout")
+	format := fs.String("format", defaults.Format, "output format: json (JSON lines) or trace (binary trace)")
+	maxEvents := fs.Uint64("max-events", 0, "stop after this many interactive events. 0 means no limit")
+	duration := fs.String("duration", "", "stop after this duration, e.g. 10s")
+	fs.Var(&metadata, "meta", "key=value metadata for the trace header. May be repeated")
+	dryRun := fs.Bool("dry-run", false, "record from a simulated VM instead of the kernel")
+	dryRunAccesses := fs.Int("dry-run-accesses", defaults.DryRunAccesses, "number of guest accesses in dry run mode")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	cfg := defaults
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "kvm":
+			cfg.KVMPath = *kvmPath
+		case "page":
+			cfg.Pages = pages
+		case "track-all":
+			cfg.TrackAll = *trackAll
+		case "mode":
+			cfg.TrackMode = *trackMode
+		case "retrack":
+			cfg.Retrack = *retrack
+		case "batch":
+			cfg.Batch = *batch
+		case "batch-size":
+			cfg.BatchSize = *batchSize
+		case "perf-cpu":
+			cfg.PerfCPU = *perfCPU
+		case "rip":
+			cfg.GetRIP = *getRIP
+		case "capture":
+			cfg.Capture = capture
+		case "capture-view":
+			cfg.CaptureView = *captureView
+		case "out":
+			cfg.Output = *output
+		case "format":
+			cfg.Format = *format
+		case "max-events":
+			cfg.MaxEvents = *maxEvents
+		case "duration":
+			cfg.Duration = *duration
+		case "meta":
+			if cfg.Metadata == nil {
+				cfg.Metadata = make(map[string]string)
+			}
+			for _, v := range metadata {
+				kv := strings.SplitN(v, "=", 2)
+				if len(kv) != 2 {
+					err = fmt.Errorf("invalid metadata %q, expected key=value", v)
+					return
+				}
+				cfg.Metadata[kv[0]] = kv[1]
+			}
+		case "dry-run":
+			cfg.DryRun = *dryRun
+		case "dry-run-accesses":
+			cfg.DryRunAccesses = *dryRunAccesses
+		}
+	})
+	return cfg, err
+}
+
+//run records the experiment described by args. Events are written to stdout if no output file is given
+func run(ctx context.Context, args []string, stdout io.Writer) error {
+	cfg, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	e, err := cfg.parse()
+	if err != nil {
+		return err
+	}
+
+	var tracker sevStep.Tracker
+	if cfg.DryRun {
+		tracker, ctx = e.newDryRunBackend(ctx)
+	} else {
+		api, err := sevStep.NewIoctlAPI(cfg.KVMPath, cfg.GetRIP)
+		if err != nil {
+			return fmt.Errorf("failed to open %v : %w", cfg.KVMPath, err)
+		}
+		tracker = api
+	}
+	defer func() {
+		if err := tracker.Close(); err != nil {
+			log.Printf("Close failed : %v", err)
+		}
+	}()
+
+	out := stdout
+	if cfg.Output != "-" {
+		f, err := os.Create(cfg.Output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file : %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	sink, err := e.newSink(out)
+	if err != nil {
+		return err
+	}
+
+	count, recordErr := e.record(ctx, tracker, sink)
+	//stop tracking before writing the remaining events, to not stall the VM
+	if err := tracker.CmdReset(); err != nil {
+		log.Printf("CmdReset failed : %v", err)
+	}
+	if err := sink.Flush(); err != nil {
+		return fmt.Errorf("failed to write output : %w", err)
+	}
+	log.Printf("Recorded %v events", count)
+	return recordErr
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Printf("sevstep-record failed : %v", err)
+		stop()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+func TestParsePages(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		want    []uint64
+		wantErr bool
+	}{
+		{name: "single pages", specs: []string{"0x1000", "0x2fff"}, want: []uint64{0x1000, 0x2000}},
+		{name: "range", specs: []string{"0x1000-0x3001"}, want: []uint64{0x1000, 0x2000, 0x3000}},
+		{name: "empty range", specs: []string{"0x3000-0x1000"}, wantErr: true},
+		{name: "invalid", specs: []string{"page"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePages(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePages() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArgs_ConfigAndFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"pages": ["0x1000"], "track_mode": "write", "capture": ["+0x0:16"], "metadata": {"victim": "openssl"}}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config : %v", err)
+	}
+	cfg, err := parseArgs([]string{"-config", path, "-mode", "exec", "-meta", "run=1"})
+	if err != nil {
+		t.Fatalf("parseArgs() error = %v", err)
+	}
+	e, err := cfg.parse()
+	if err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	if e.trackMode != sevStep.PageTrackExec {
+		t.Errorf("track mode = %v, flag should take precedence", e.trackMode)
+	}
+	if !reflect.DeepEqual(e.pages, []uint64{0x1000}) || e.capture == nil || len(e.capture.Ranges) != 1 {
+		t.Errorf("config file was not applied : %+v", e)
+	}
+	if want := map[string]string{"victim": "openssl", "run": "1"}; !reflect.DeepEqual(cfg.Metadata, want) {
+		t.Errorf("Metadata = %v, want %v", cfg.Metadata, want)
+	}
+
+	if _, err := parseArgs([]string{"-config", filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Errorf("parseArgs() should fail for a missing config file")
+	}
+}
+
+func TestRun_DryRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		wantEvents  int
+		wantRetInst bool
+		wantRegions int
+	}{
+		{
+			name:       "one-shot",
+			args:       []string{"-page", "0x1000-0x4000", "-dry-run-accesses", "12"},
+			wantEvents: 3,
+		},
+		{
+			name:        "retrack with perf and capture",
+			args:        []string{"-page", "0x1000,0x2000,0x3000", "-retrack", "-perf-cpu", "1", "-capture", "+0x0:32", "-rip", "-dry-run-accesses", "12"},
+			wantEvents:  12,
+			wantRetInst: true,
+			wantRegions: 1,
+		},
+		{
+			name:       "max events",
+			args:       []string{"-track-all", "-retrack", "-max-events", "5", "-dry-run-accesses", "12"},
+			wantEvents: 5,
+		},
+		{
+			name:        "batch",
+			args:        []string{"-page", "0x1000-0x3000", "-batch", "-batch-size", "100", "-retrack", "-perf-cpu", "0", "-dry-run-accesses", "10"},
+			wantEvents:  10,
+			wantRetInst: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout := bytes.Buffer{}
+			if err := run(context.Background(), append([]string{"-dry-run"}, tt.args...), &stdout); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			events, err := sevStep.ParseInputFile(&stdout)
+			if err != nil {
+				t.Fatalf("ParseInputFile failed : %v", err)
+			}
+			if len(events) != tt.wantEvents {
+				t.Fatalf("recorded %v events, want %v", len(events), tt.wantEvents)
+			}
+			for _, v := range events {
+				if v.HaveRetiredInstructions != tt.wantRetInst || len(v.Regions) != tt.wantRegions {
+					t.Errorf("unexpected event %v with %v regions", v, len(v.Regions))
+				}
+			}
+		})
+	}
+}
+
+func TestRun_DryRunTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.trace")
+	args := []string{"-dry-run", "-page", "0x1000", "-mode", "write", "-format", "trace", "-out", path, "-meta", "victim=test"}
+	if err := run(context.Background(), args, io.Discard); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open trace : %v", err)
+	}
+	defer f.Close()
+	er, err := sevStep.NewEventReader(f)
+	if err != nil {
+		t.Fatalf("NewEventReader failed : %v", err)
+	}
+	if er.Header().TrackMode != sevStep.PageTrackWrite || er.Header().Metadata["victim"] != "test" {
+		t.Errorf("unexpected header %+v", er.Header())
+	}
+	ev, err := er.Read()
+	if err != nil {
+		t.Fatalf("Read failed : %v", err)
+	}
+	if !ev.ErrorCode.Write() || ev.FaultedGPA>>12 != 1 {
+		t.Errorf("unexpected event %v", ev)
+	}
+}
+
+func TestRun_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "no pages", args: []string{"-dry-run"}},
+		{name: "capture in batch mode", args: []string{"-dry-run", "-page", "0x1000", "-batch", "-capture", "0x0:16"}},
+		{name: "invalid mode", args: []string{"-dry-run", "-page", "0x1000", "-mode", "read"}},
+		{name: "invalid format", args: []string{"-dry-run", "-page", "0x1000", "-format", "csv"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := run(context.Background(), tt.args, io.Discard); err == nil {
+				t.Errorf("run() should fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//newSink creates the sink for the configured format
+func (e *experiment) newSink(w io.Writer) (sevStep.EventSink, error) {
+	if e.cfg.Format == sevStep.EventFormatJSON {
+		return sevStep.NewJSONEventWriter(w), nil
+	}
+	metadata := map[string]string{
+		"tool":    "sevstep-record",
+		"batch":   fmt.Sprintf("%t", e.cfg.Batch),
+		"pages":   fmt.Sprintf("%v", e.cfg.Pages),
+		"retrack": fmt.Sprintf("%t", e.cfg.Retrack),
+	}
+	for k, v := range e.cfg.Metadata {
+		metadata[k] = v
+	}
+	return sevStep.NewEventWriter(w, sevStep.TraceHeader{
+		Created:   time.Now(),
+		TrackMode: e.trackMode,
+		Metadata:  metadata,
+	})
+}
+
+//setupTracking tracks the initial pages
+func (e *experiment) setupTracking(tracker sevStep.Tracker) error {
+	if e.cfg.TrackAll {
+		if err := tracker.CmdTrackAllPages(e.trackMode); err != nil {
+			return fmt.Errorf("failed to track all pages : %w", err)
+		}
+		return nil
+	}
+	for _, gpa := range e.pages {
+		if err := tracker.CmdTrackPage(gpa, e.trackMode); err != nil {
+			return fmt.Errorf("failed to track 0x%x : %w", gpa, err)
+		}
+	}
+	return nil
+}
+
+//record runs the experiment on tracker and writes all events to sink until ctx is done, the
+//configured number of events is reached or an error occurs. Returns the number of recorded events.
+//Cancelling ctx is not considered an error
+func (e *experiment) record(ctx context.Context, tracker sevStep.Tracker, sink sevStep.EventSink) (uint64, error) {
+	if e.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.duration)
+		defer cancel()
+	}
+	if e.cfg.Batch {
+		return e.recordBatch(ctx, tracker, sink)
+	}
+	return e.recordInteractive(ctx, tracker, sink)
+}
+
+func (e *experiment) recordInteractive(ctx context.Context, tracker sevStep.Tracker, sink sevStep.EventSink) (uint64, error) {
+	loop := sevStep.NewEventLoop(tracker)
+	loop.RetrackMode = e.trackMode
+	loop.Capture = e.capture
+	if e.cfg.PerfCPU >= 0 {
+		var err error
+		if loop.RetInstr, err = sevStep.NewRetInstrCounter(tracker, e.cfg.PerfCPU); err != nil {
+			return 0, err
+		}
+	}
+	if err := e.setupTracking(tracker); err != nil {
+		return 0, err
+	}
+
+	count := uint64(0)
+	action := sevStep.EventActionAck
+	if e.cfg.Retrack {
+		action = sevStep.EventActionRetrack
+	}
+	err := loop.Run(ctx, func(ev *sevStep.Event) (sevStep.EventAction, error) {
+		if err := sink.Write(ev); err != nil {
+			return sevStep.EventActionStop, fmt.Errorf("failed to write event %v : %w", ev.ID, err)
+		}
+		count++
+		if e.cfg.MaxEvents > 0 && count >= e.cfg.MaxEvents {
+			return sevStep.EventActionStop, nil
+		}
+		return action, nil
+	})
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		return count, err
+	}
+	return count, nil
+}
+
+func (e *experiment) recordBatch(ctx context.Context, tracker sevStep.Tracker, sink sevStep.EventSink) (uint64, error) {
+	session := sevStep.NewBatchSession(tracker, e.trackMode, e.cfg.BatchSize, e.cfg.PerfCPU, e.cfg.Retrack)
+	if err := e.setupTracking(tracker); err != nil {
+		return 0, err
+	}
+	result, runErr := session.Run(ctx)
+	if result == nil {
+		return 0, runErr
+	}
+	for _, v := range result.Gaps {
+		log.Printf("Missing events : %v", v)
+	}
+	count := uint64(0)
+	for _, v := range result.Events {
+		if err := sink.Write(v); err != nil {
+			return count, fmt.Errorf("failed to write event %v : %w", v.ID, err)
+		}
+		count++
+	}
+	return count, runErr
+}
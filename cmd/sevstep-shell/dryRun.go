@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+const (
+	//dryRunCodePages are the pages executed round robin by the simulated guest
+	dryRunCodePages = 3
+	//dryRunDataGPA is the page read and written by the simulated guest
+	dryRunDataGPA = 0x8000
+	dryRunPages   = 16
+)
+
+//newDryRunVM creates a simulated guest that executes its code pages round robin. Every fourth
+//access reads or writes the data page. The memory of each page is initialized with a message
+//naming the page, which shows up XORed with 0xff in the ciphertext view
+func newDryRunVM(accesses int, getRIP bool) (*sevStep.SimulatedVM, error) {
+	script := make([]sevStep.GuestAccess, 0, accesses)
+	for i := 0; i < accesses; i++ {
+		gpa := uint64(i%dryRunCodePages)<<12 + uint64(i%64)*0x10
+		access := sevStep.GuestAccess{
+			GPA:                 gpa,
+			Kind:                sevStep.AccessExec,
+			RIP:                 0x400000 + gpa,
+			RetiredInstructions: uint64(1 + i%5),
+		}
+		if i%4 == 3 {
+			access.GPA = dryRunDataGPA + uint64(i%64)*8
+			access.Kind = sevStep.AccessRead
+			if i%8 == 7 {
+				access.Kind = sevStep.AccessWrite
+				access.Data = []byte{byte(i)}
+			}
+		}
+		script = append(script, access)
+	}
+
+	vm := sevStep.NewSimulatedVM(dryRunPages, script, getRIP)
+	vm.EncryptBlock = func(gpa uint64, block []byte) []byte {
+		for i := range block {
+			block[i] ^= 0xff
+		}
+		return block
+	}
+	for page := uint64(0); page < dryRunPages; page++ {
+		if err := vm.WriteGuestMemory(page<<12, []byte(fmt.Sprintf("sev-step dry run page 0x%x", page<<12))); err != nil {
+			return nil, err
+		}
+	}
+	return vm, nil
+}
@@ -0,0 +1,168 @@
+//Command sevstep-shell is an interactive shell with debugger-like commands for exploring a victim
+//with the sev-step kernel patch, e.g. tracking pages, stepping from page fault to page fault and
+//dumping guest memory. Run "help" inside the shell for the list of commands.
+//Commands can be read from a script file with -script. Use -dry-run to try the shell against a simulated VM
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//maxHistory is the number of lines loaded from the history file
+const maxHistory = 1000
+
+//shellConfig are the command line options
+type shellConfig struct {
+	kvmPath        string
+	getRIP         bool
+	script         string
+	interactive    bool
+	historyPath    string
+	dryRun         bool
+	dryRunAccesses int
+}
+
+func parseArgs(args []string) (*shellConfig, error) {
+	fs := flag.NewFlagSet("sevstep-shell", flag.ContinueOnError)
+	cfg := &shellConfig{}
+	fs.StringVar(&cfg.kvmPath, "kvm", "/dev/kvm", "device file of the patched kernel")
+	fs.BoolVar(&cfg.getRIP, "rip", false, "request the RIP for each event")
+	fs.StringVar(&cfg.script, "script", "", "execute the commands in this file and exit")
+	fs.BoolVar(&cfg.interactive, "i", false, "continue interactively after the script")
+	defaultHistory := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		defaultHistory = filepath.Join(home, ".sevstep_history")
+	}
+	fs.StringVar(&cfg.historyPath, "history", defaultHistory, "file for the command history. Empty disables it")
+	fs.BoolVar(&cfg.dryRun, "dry-run", false, "use a simulated VM instead of the kernel")
+	fs.IntVar(&cfg.dryRunAccesses, "dry-run-accesses", 256, "number of guest accesses in dry run mode")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	return cfg, nil
+}
+
+//backend returns the function that opens the configured Tracker
+func (cfg *shellConfig) backend() func() (sevStep.Tracker, error) {
+	if cfg.dryRun {
+		return func() (sevStep.Tracker, error) {
+			return newDryRunVM(cfg.dryRunAccesses, cfg.getRIP)
+		}
+	}
+	return func() (sevStep.Tracker, error) {
+		return sevStep.NewIoctlAPI(cfg.kvmPath, cfg.getRIP)
+	}
+}
+
+func openScript(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open script : %w", err)
+	}
+	return f, nil
+}
+
+//loadHistory reads the last maxHistory lines of path. A missing file is not an error
+func loadHistory(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make([]string, 0), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history : %w", err)
+	}
+	defer f.Close()
+	history := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			history = append(history, line)
+		}
+	}
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+	return history, scanner.Err()
+}
+
+//run executes the script and/or the interactive shell with commands from stdin. interrupts may be nil
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, interrupts <-chan os.Signal) error {
+	cfg, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	s, err := newShell(cfg.backend(), stdout)
+	if err != nil {
+		return err
+	}
+	s.interrupts = interrupts
+	defer func() {
+		if err := s.Close(); err != nil {
+			log.Printf("Close failed : %v", err)
+		}
+	}()
+
+	if cfg.script != "" {
+		f, err := openScript(cfg.script)
+		if err != nil {
+			return err
+		}
+		err = s.runScript(ctx, f, cfg.script)
+		f.Close()
+		if errors.Is(err, errQuit) {
+			return nil
+		}
+		if err != nil || !cfg.interactive {
+			return err
+		}
+	}
+
+	if cfg.historyPath != "" {
+		if s.history, err = loadHistory(cfg.historyPath); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(cfg.historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open history : %w", err)
+		}
+		defer f.Close()
+		s.historyFile = f
+	}
+	err = s.interactive(ctx, stdin)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+func main() {
+	//SIGINT only interrupts the running command, see shell.commandContext
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, interrupts); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Printf("sevstep-shell failed : %v", err)
+		stop()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/internal/cmdHelpers"
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+const (
+	prompt = "(sevstep) "
+	//pollInterval is the time between two polls while waiting for an event
+	pollInterval = time.Millisecond
+	//defaultDumpSize is the number of bytes shown by "x" without count
+	defaultDumpSize = 64
+	//maxDumpSize limits the count of "x" to four pages
+	maxDumpSize = 4 * 4096
+)
+
+//errQuit is returned by the quit command to end the shell
+var errQuit = errors.New("quit")
+
+//command is a shell command. args does not contain the command name. For x/<n>, the part
+//after the slash is passed as first argument
+type command struct {
+	usage       string
+	description string
+	run         func(s *shell, ctx context.Context, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	//initialized in init, as help refers to commands
+	commands = map[string]command{
+		"track":       {usage: "track <gpa> [mode]", description: "track the page containing gpa", run: (*shell).cmdTrack},
+		"track-all":   {usage: "track-all [mode]", description: "track all pages of the VM", run: (*shell).cmdTrackAll},
+		"untrack-all": {usage: "untrack-all [mode]", description: "remove tracking from all pages of the VM", run: (*shell).cmdUnTrackAll},
+		"step":        {usage: "step", description: "ack the current event and wait for the next one", run: (*shell).cmdStep},
+		"continue":    {usage: "continue [n]", description: "step n times, or until no event arrives within the timeout", run: (*shell).cmdContinue},
+		"x":           {usage: "x/<n>[c|h] <gpa>", description: "dump n bytes at gpa as ciphertext (c) or host-decrypted (h)", run: (*shell).cmdExamine},
+		"perf":        {usage: "perf [setup <cpu>]", description: "read the retired instructions counter or program it on cpu", run: (*shell).cmdPerf},
+		"event":       {usage: "event", description: "print the current, not yet acked event", run: (*shell).cmdEvent},
+		"reset":       {usage: "reset", description: "stop all tracking and re-register with the kernel", run: (*shell).cmdReset},
+		"set":         {usage: "set [mode|retrack|timeout|view] [value]", description: "print or change the settings", run: (*shell).cmdSet},
+		"source":      {usage: "source <file>", description: "execute the commands in file", run: (*shell).cmdSource},
+		"history":     {usage: "history", description: "print the command history. Use !<n> to repeat entry n and !! for the last one", run: (*shell).cmdHistory},
+		"help":        {usage: "help", description: "print this help", run: (*shell).cmdHelp},
+		"quit":        {usage: "quit", description: "ack the current event and exit", run: (*shell).cmdQuit},
+	}
+}
+
+//shell executes debugger-like commands against a Tracker. At most one event is pending at a time:
+//step and continue ack it before waiting for the next one, thus the guest is blocked while you
+//inspect its memory. Keep in mind that the kernel resumes the guest if the ack takes longer than a second
+type shell struct {
+	//open creates the backend. reset calls it again, as KVM_USPT_RESET also unregisters from the kernel
+	open    func() (sevStep.Tracker, error)
+	tracker sevStep.Tracker
+	loop    *sevStep.EventLoop
+	out     io.Writer
+
+	//pending is the last received event, it has not been acked yet
+	pending *sevStep.Event
+	//mode is the track mode used if a command does not specify one and for retracking
+	mode sevStep.PageTrackMode
+	//retrack re-tracks each faulted page once the next event arrives
+	retrack bool
+	//timeout bounds the wait for the next event in step and continue
+	timeout time.Duration
+	//view is used by x if no view suffix is given
+	view sevStep.MemoryView
+
+	//interrupts, if set, cancels the running interactive command, e.g. on SIGINT
+	interrupts <-chan os.Signal
+
+	history []string
+	//historyFile, if set, receives each line entered in interactive mode
+	historyFile io.Writer
+}
+
+//newShell opens the backend and creates a shell printing to out
+func newShell(open func() (sevStep.Tracker, error), out io.Writer) (*shell, error) {
+	s := &shell{
+		open:    open,
+		out:     out,
+		mode:    sevStep.PageTrackExec,
+		timeout: time.Second,
+		view:    sevStep.MemoryViewCiphertext,
+		history: make([]string, 0),
+	}
+	if err := s.openTracker(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *shell) openTracker() error {
+	tracker, err := s.open()
+	if err != nil {
+		return fmt.Errorf("failed to open backend : %w", err)
+	}
+	s.tracker = tracker
+	s.loop = sevStep.NewEventLoop(tracker)
+	s.loop.PollBackoff = pollInterval
+	s.loop.RetrackMode = s.mode
+	return nil
+}
+
+//Close acks the pending event and closes the backend, which stops all tracking
+func (s *shell) Close() error {
+	ackErr := s.ackPending()
+	if err := s.tracker.Close(); err != nil {
+		return err
+	}
+	return ackErr
+}
+
+//execute runs a single line. Empty lines and comments starting with # are ignored
+func (s *shell) execute(ctx context.Context, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return nil
+	}
+	name, args := fields[0], fields[1:]
+	if idx := strings.Index(name, "/"); idx >= 0 {
+		args = append([]string{name[idx+1:]}, args...)
+		name = name[:idx]
+		if name != "x" {
+			return fmt.Errorf("only x supports the /<n> suffix")
+		}
+	} else if name == "x" {
+		args = append([]string{""}, args...)
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q, try \"help\"", name)
+	}
+	return cmd.run(s, ctx, args)
+}
+
+//runScript executes all lines of r and stops at the first error. name is used in error messages
+func (s *shell) runScript(ctx context.Context, r io.Reader, name string) error {
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if err := s.execute(ctx, scanner.Text()); err != nil {
+			if errors.Is(err, errQuit) {
+				return err
+			}
+			return fmt.Errorf("%v:%d : %w", name, lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %v : %w", name, err)
+	}
+	return nil
+}
+
+//expandHistory replaces "!!" and "!<n>" with the corresponding history entry
+func (s *shell) expandHistory(line string) (string, error) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "!") {
+		return line, nil
+	}
+	if len(s.history) == 0 {
+		return "", fmt.Errorf("history is empty")
+	}
+	if line == "!!" {
+		return s.history[len(s.history)-1], nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 || n > len(s.history) {
+		return "", fmt.Errorf("no history entry %q", line[1:])
+	}
+	return s.history[n-1], nil
+}
+
+//addHistory appends line to the history and the history file
+func (s *shell) addHistory(line string) {
+	if line == "" || (len(s.history) > 0 && s.history[len(s.history)-1] == line) {
+		return
+	}
+	s.history = append(s.history, line)
+	if s.historyFile != nil {
+		fmt.Fprintln(s.historyFile, line)
+	}
+}
+
+//interactive reads commands from in until quit or EOF. Errors are printed and do not end the shell
+func (s *shell) interactive(ctx context.Context, in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(s.out, prompt)
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return scanner.Err()
+		}
+		line, err := s.expandHistory(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(s.out, "error : %v\n", err)
+			continue
+		}
+		if line != strings.TrimSpace(scanner.Text()) {
+			fmt.Fprintln(s.out, line)
+		}
+		s.addHistory(line)
+		cmdCtx, cancel := s.commandContext(ctx)
+		err = s.execute(cmdCtx, line)
+		cancel()
+		if errors.Is(err, errQuit) {
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintf(s.out, "error : %v\n", err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+//commandContext returns a context for a single command that is cancelled on interrupts.
+//Interrupts received while waiting for input are discarded
+func (s *shell) commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if s.interrupts == nil {
+		return ctx, cancel
+	}
+	for len(s.interrupts) > 0 {
+		<-s.interrupts
+	}
+	go func() {
+		select {
+		case <-s.interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+//parseMode returns the mode in args[idx] or the default mode
+func (s *shell) parseMode(args []string, idx int) (sevStep.PageTrackMode, error) {
+	if len(args) <= idx {
+		return s.mode, nil
+	}
+	return sevStep.ParsePageTrackMode(args[idx])
+}
+
+func (s *shell) cmdTrack(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: %v", commands["track"].usage)
+	}
+	gpa, err := cmdHelpers.ParseUint(args[0])
+	if err != nil {
+		return err
+	}
+	mode, err := s.parseMode(args, 1)
+	if err != nil {
+		return err
+	}
+	if err := s.tracker.CmdTrackPage(gpa, mode); err != nil {
+		return fmt.Errorf("failed to track 0x%x : %w", gpa, err)
+	}
+	return nil
+}
+
+func (s *shell) cmdTrackAll(ctx context.Context, args []string) error {
+	mode, err := s.parseMode(args, 0)
+	if err != nil {
+		return err
+	}
+	return s.tracker.CmdTrackAllPages(mode)
+}
+
+func (s *shell) cmdUnTrackAll(ctx context.Context, args []string) error {
+	mode, err := s.parseMode(args, 0)
+	if err != nil {
+		return err
+	}
+	return s.tracker.CmdUnTrackAllPages(mode)
+}
+
+//ackPending acks the pending event, if any, and re-tracks its page if enabled
+func (s *shell) ackPending() error {
+	if s.pending == nil {
+		return nil
+	}
+	action := sevStep.EventActionAck
+	if s.retrack {
+		action = sevStep.EventActionRetrack
+	}
+	ev := s.pending
+	s.pending = nil
+	_, err := s.loop.HandleEvent(ev, action)
+	return err
+}
+
+//errNoEvent is returned by step if no event arrived within the timeout
+var errNoEvent = errors.New("no event")
+
+//step acks the pending event and waits for the next one, which becomes the pending event
+func (s *shell) step(ctx context.Context) (*sevStep.Event, error) {
+	if err := s.ackPending(); err != nil {
+		return nil, err
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	ev, err := s.loop.NextEvent(waitCtx)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, fmt.Errorf("%w within %v", errNoEvent, s.timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.pending = ev
+	return ev, nil
+}
+
+func (s *shell) printEvent(ev *sevStep.Event) {
+	fmt.Fprintf(s.out, "%v, ErrorCode %v\n", ev, ev.ErrorCode)
+}
+
+func (s *shell) cmdStep(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: %v", commands["step"].usage)
+	}
+	ev, err := s.step(ctx)
+	if err != nil {
+		return err
+	}
+	s.printEvent(ev)
+	return nil
+}
+
+func (s *shell) cmdContinue(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: %v", commands["continue"].usage)
+	}
+	//without count, continue until the guest stops producing events
+	count := uint64(0)
+	if len(args) == 1 {
+		var err error
+		if count, err = cmdHelpers.ParseUint(args[0]); err != nil {
+			return err
+		}
+	}
+	for i := uint64(0); count == 0 || i < count; i++ {
+		ev, err := s.step(ctx)
+		if errors.Is(err, errNoEvent) && count == 0 {
+			fmt.Fprintf(s.out, "Stopped after %d events : %v\n", i, err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("stopped after %d events : %w", i, err)
+		}
+		s.printEvent(ev)
+	}
+	return nil
+}
+
+//parseDumpSpec parses the "<n>[c|h]" suffix of x
+func (s *shell) parseDumpSpec(spec string) (uint64, sevStep.MemoryView, error) {
+	view := s.view
+	switch {
+	case strings.HasSuffix(spec, "c"):
+		view = sevStep.MemoryViewCiphertext
+		spec = strings.TrimSuffix(spec, "c")
+	case strings.HasSuffix(spec, "h"):
+		view = sevStep.MemoryViewHostDecrypted
+		spec = strings.TrimSuffix(spec, "h")
+	}
+	if spec == "" {
+		return defaultDumpSize, view, nil
+	}
+	size, err := cmdHelpers.ParseUint(spec)
+	if err != nil {
+		return 0, 0, err
+	}
+	if size == 0 || size > maxDumpSize {
+		return 0, 0, fmt.Errorf("size must be between 1 and %d bytes", maxDumpSize)
+	}
+	return size, view, nil
+}
+
+func (s *shell) cmdExamine(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %v", commands["x"].usage)
+	}
+	size, view, err := s.parseDumpSpec(args[0])
+	if err != nil {
+		return err
+	}
+	gpa, err := cmdHelpers.ParseUint(args[1])
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := sevStep.NewGuestMemory(s.tracker, view, false).ReadAt(buf, int64(gpa)); err != nil {
+		return err
+	}
+	hexdump(s.out, gpa, buf)
+	return nil
+}
+
+//hexdump prints data with 16 bytes per line, prefixed by their gpa
+func hexdump(w io.Writer, gpa uint64, data []byte) {
+	for offset := 0; offset < len(data); offset += 16 {
+		end := offset + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		line := data[offset:end]
+		printable := make([]byte, len(line))
+		for i, v := range line {
+			printable[i] = '.'
+			if v >= 0x20 && v < 0x7f {
+				printable[i] = v
+			}
+		}
+		fmt.Fprintf(w, "0x%012x: % x%s  |%s|\n", gpa+uint64(offset), line, strings.Repeat("   ", 16-len(line)), printable)
+	}
+}
+
+func (s *shell) cmdPerf(ctx context.Context, args []string) error {
+	if len(args) == 2 && args[0] == "setup" {
+		cpu, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid cpu %q", args[1])
+		}
+		counter, err := sevStep.NewRetInstrCounter(s.tracker, cpu)
+		if err != nil {
+			return err
+		}
+		s.loop.RetInstr = counter
+		fmt.Fprintf(s.out, "Counting retired instructions on cpu %d\n", cpu)
+		return nil
+	}
+	if len(args) != 0 {
+		return fmt.Errorf("usage: %v", commands["perf"].usage)
+	}
+	if s.loop.RetInstr == nil {
+		return fmt.Errorf("counter is not set up, use \"perf setup <cpu>\"")
+	}
+	value, err := s.tracker.CmdReadRetInstrPerf(s.loop.RetInstr.CPU)
+	if err != nil {
+		return fmt.Errorf("CmdReadRetInstrPerf failed : %w", err)
+	}
+	delta, err := s.loop.RetInstr.Delta()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "Counter on cpu %d : %d, %d since the guest was resumed\n", s.loop.RetInstr.CPU, value, delta)
+	return nil
+}
+
+func (s *shell) cmdEvent(ctx context.Context, args []string) error {
+	if s.pending == nil {
+		fmt.Fprintln(s.out, "No pending event")
+		return nil
+	}
+	s.printEvent(s.pending)
+	return nil
+}
+
+func (s *shell) cmdReset(ctx context.Context, args []string) error {
+	//CmdReset drops the pending event on the kernel side, thus it is not acked
+	s.pending = nil
+	if err := s.tracker.Close(); err != nil {
+		return fmt.Errorf("failed to reset : %w", err)
+	}
+	return s.openTracker()
+}
+
+func (s *shell) printSettings() {
+	fmt.Fprintf(s.out, "mode    %v\nretrack %t\ntimeout %v\nview    %v\n", s.mode, s.retrack, s.timeout, s.view)
+}
+
+func (s *shell) cmdSet(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		s.printSettings()
+		return nil
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %v", commands["set"].usage)
+	}
+	switch args[0] {
+	case "mode":
+		mode, err := sevStep.ParsePageTrackMode(args[1])
+		if err != nil {
+			return err
+		}
+		s.mode = mode
+		s.loop.RetrackMode = mode
+	case "retrack":
+		switch strings.ToLower(args[1]) {
+		case "on", "true", "1":
+			s.retrack = true
+		case "off", "false", "0":
+			s.retrack = false
+		default:
+			return fmt.Errorf("invalid value %q for retrack, expected on or off", args[1])
+		}
+	case "timeout":
+		value, err := time.ParseDuration(args[1])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("invalid timeout %q", args[1])
+		}
+		s.timeout = value
+	case "view":
+		switch strings.ToLower(args[1]) {
+		case "ciphertext":
+			s.view = sevStep.MemoryViewCiphertext
+		case "host-decrypted", "hostdecrypted":
+			s.view = sevStep.MemoryViewHostDecrypted
+		default:
+			return fmt.Errorf("invalid view %q, expected ciphertext or host-decrypted", args[1])
+		}
+	default:
+		return fmt.Errorf("unknown setting %q", args[0])
+	}
+	return nil
+}
+
+func (s *shell) cmdSource(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %v", commands["source"].usage)
+	}
+	f, err := openScript(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.runScript(ctx, f, args[0])
+}
+
+func (s *shell) cmdHistory(ctx context.Context, args []string) error {
+	for i, v := range s.history {
+		fmt.Fprintf(s.out, "%5d  %s\n", i+1, v)
+	}
+	return nil
+}
+
+func (s *shell) cmdHelp(ctx context.Context, args []string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, v := range names {
+		fmt.Fprintf(s.out, "  %-40s %s\n", commands[v].usage, commands[v].description)
+	}
+	fmt.Fprintf(s.out, "\nModes are Write, Access, ResetAccess, Exec and ResetExec. Lines starting with # are ignored\n")
+	return nil
+}
+
+func (s *shell) cmdQuit(ctx context.Context, args []string) error {
+	return errQuit
+}
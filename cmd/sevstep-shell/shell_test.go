@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//testShell creates a shell on simulated VMs executing script. vms contains all VMs opened by the shell
+func testShell(t *testing.T, script []sevStep.GuestAccess) (*shell, *bytes.Buffer, *[]*sevStep.SimulatedVM) {
+	t.Helper()
+	vms := make([]*sevStep.SimulatedVM, 0)
+	out := &bytes.Buffer{}
+	s, err := newShell(func() (sevStep.Tracker, error) {
+		vm := sevStep.NewSimulatedVM(4, script, true)
+		vm.EncryptBlock = func(gpa uint64, block []byte) []byte {
+			for i := range block {
+				block[i] ^= 0xff
+			}
+			return block
+		}
+		vms = append(vms, vm)
+		return vm, nil
+	}, out)
+	if err != nil {
+		t.Fatalf("newShell failed : %v", err)
+	}
+	s.timeout = 20 * time.Millisecond
+	return s, out, &vms
+}
+
+var faultedGPARegexp = regexp.MustCompile(`FaultedGPA ([0-9a-f]+)`)
+
+//printedFaults returns the faulted GPAs of all events printed to out
+func printedFaults(out string) []string {
+	res := make([]string, 0)
+	for _, v := range faultedGPARegexp.FindAllStringSubmatch(out, -1) {
+		res = append(res, v[1])
+	}
+	return res
+}
+
+func TestShell_Commands(t *testing.T) {
+	script := []sevStep.GuestAccess{
+		{GPA: 0x1000, Kind: sevStep.AccessExec, RIP: 0x401000, RetiredInstructions: 3},
+		{GPA: 0x2010, Kind: sevStep.AccessWrite, RIP: 0x401004, RetiredInstructions: 5, Data: []byte{0xaa}},
+		{GPA: 0x1008, Kind: sevStep.AccessExec, RIP: 0x401008, RetiredInstructions: 7},
+		{GPA: 0x3000, Kind: sevStep.AccessExec, RIP: 0x40100c, RetiredInstructions: 11},
+	}
+	tests := []struct {
+		name        string
+		commands    string
+		wantFaults  []string
+		wantOutput  []string
+		wantErrLine int
+	}{
+		{
+			name:       "step one-shot",
+			commands:   "track 0x1000\ntrack 0x2000 write\nstep\ncontinue",
+			wantFaults: []string{"1000", "2000"},
+			wantOutput: []string{"Stopped after 1 events", "Present|Write"},
+		},
+		{
+			name:       "retrack",
+			commands:   "set retrack on\ntrack 0x1000 exec\ntrack-all write\ncontinue 3\nevent",
+			wantFaults: []string{"1000", "2000", "1000", "1000"},
+		},
+		{
+			name:       "untrack all",
+			commands:   "track-all access\nuntrack-all access\ncontinue",
+			wantFaults: []string{},
+			wantOutput: []string{"Stopped after 0 events"},
+		},
+		{
+			name:       "perf",
+			commands:   "perf setup 2\ntrack 0x3000\nstep\nperf",
+			wantFaults: []string{"3000"},
+			wantOutput: []string{"Retired Instructions 26", "Counter on cpu 2 : 26, 26 since"},
+		},
+		{
+			name:       "settings",
+			commands:   "set mode access\ntrack 0x2000\nstep\nset view host-decrypted\nset",
+			wantFaults: []string{"2000"},
+			wantOutput: []string{"mode    Access", "view    HostDecrypted"},
+		},
+		{name: "continue fails without enough events", commands: "track 0x1000\ncontinue 2", wantFaults: []string{"1000"}, wantErrLine: 2},
+		{name: "unknown command", commands: "# comment\n\nbreak 0x1000", wantFaults: []string{}, wantErrLine: 3},
+		{name: "invalid mode", commands: "track 0x1000 read", wantFaults: []string{}, wantErrLine: 1},
+		{name: "perf without setup", commands: "perf", wantFaults: []string{}, wantErrLine: 1},
+		{name: "quit ends script", commands: "quit\nbreak", wantFaults: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, out, _ := testShell(t, script)
+			defer s.Close()
+			err := s.runScript(context.Background(), strings.NewReader(tt.commands), "test")
+			if tt.wantErrLine > 0 {
+				if err == nil || !strings.HasPrefix(err.Error(), fmt.Sprintf("test:%d ", tt.wantErrLine)) {
+					t.Errorf("runScript() error = %v, want error in line %v", err, tt.wantErrLine)
+				}
+			} else if err != nil && !errors.Is(err, errQuit) {
+				t.Fatalf("runScript() error = %v", err)
+			}
+			if got := printedFaults(out.String()); strings.Join(got, ",") != strings.Join(tt.wantFaults, ",") {
+				t.Errorf("faults = %v, want %v\n%v", got, tt.wantFaults, out)
+			}
+			for _, v := range tt.wantOutput {
+				if !strings.Contains(out.String(), v) {
+					t.Errorf("output does not contain %q\n%v", v, out)
+				}
+			}
+		})
+	}
+}
+
+func TestShell_Examine(t *testing.T) {
+	s, out, vms := testShell(t, nil)
+	defer s.Close()
+	if err := (*vms)[0].WriteGuestMemory(0x1ffc, []byte("sev-step")); err != nil {
+		t.Fatalf("WriteGuestMemory failed : %v", err)
+	}
+
+	//reads across the page boundary are split
+	if err := s.execute(context.Background(), "x/8h 0x1ffc"); err != nil {
+		t.Fatalf("x failed : %v", err)
+	}
+	want := "0x000000001ffc: 73 65 76 2d 73 74 65 70" + strings.Repeat("   ", 8) + "  |sev-step|\n"
+	if out.String() != want {
+		t.Errorf("x/8h printed\n%q, want\n%q", out.String(), want)
+	}
+
+	out.Reset()
+	if err := s.execute(context.Background(), "x/2 0x1ffc"); err != nil {
+		t.Fatalf("x failed : %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "0x000000001ffc: 8c 9a ") {
+		t.Errorf("x/2 did not print the ciphertext : %q", out.String())
+	}
+
+	out.Reset()
+	if err := s.execute(context.Background(), "x 0x0"); err != nil {
+		t.Fatalf("x failed : %v", err)
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != defaultDumpSize/16 {
+		t.Errorf("x without size printed %v lines", lines)
+	}
+
+	for _, v := range []string{"x/0 0x0", "x/0xffffffffffffffff 0", "x/0x4001h 0x0", "x/8q 0x0", "x/8 0x4000", "step/2"} {
+		if err := s.execute(context.Background(), v); err == nil {
+			t.Errorf("%q should fail", v)
+		}
+	}
+}
+
+func TestShell_Reset(t *testing.T) {
+	script := []sevStep.GuestAccess{{GPA: 0x1000, Kind: sevStep.AccessExec}, {GPA: 0x1000, Kind: sevStep.AccessExec}}
+	s, out, vms := testShell(t, script)
+	defer s.Close()
+	if err := s.runScript(context.Background(), strings.NewReader("track 0x1000\nstep\nreset\ncontinue"), "test"); err != nil {
+		t.Fatalf("runScript() error = %v", err)
+	}
+	if len(*vms) != 2 {
+		t.Errorf("reset opened %v backends, want 2", len(*vms))
+	}
+	if got := printedFaults(out.String()); len(got) != 1 {
+		t.Errorf("tracking should not survive reset, got faults %v", got)
+	}
+}
+
+func TestShell_InteractiveHistory(t *testing.T) {
+	s, out, _ := testShell(t, nil)
+	defer s.Close()
+	historyFile := &bytes.Buffer{}
+	s.historyFile = historyFile
+	s.history = []string{"set timeout 5s"}
+
+	input := "!1\ntrack 0x1000\n!!\nbreak\n!7\nhistory\nquit\nset retrack on\n"
+	if err := s.interactive(context.Background(), strings.NewReader(input)); err != nil {
+		t.Fatalf("interactive() error = %v", err)
+	}
+	if s.timeout != 5*time.Second || s.retrack {
+		t.Errorf("unexpected settings timeout %v retrack %v", s.timeout, s.retrack)
+	}
+	//repeating the last entry does not add it again
+	wantHistory := "track 0x1000\nbreak\nhistory\nquit\n"
+	if got := historyFile.String(); got != wantHistory {
+		t.Errorf("history file = %q, want %q", got, wantHistory)
+	}
+	for _, v := range []string{"unknown command \"break\"", "no history entry \"7\"", "    2  track 0x1000"} {
+		if !strings.Contains(out.String(), v) {
+			t.Errorf("output does not contain %q\n%v", v, out)
+		}
+	}
+}
+
+func TestRun_DryRunScript(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "explore.txt")
+	script := "track-all exec\nset retrack on\ncontinue 5\nx/32h 0x8000\n"
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatalf("failed to write script : %v", err)
+	}
+	out := &bytes.Buffer{}
+	if err := run(context.Background(), []string{"-dry-run", "-rip", "-script", path, "-history", ""}, strings.NewReader(""), out, nil); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if got := printedFaults(out.String()); len(got) != 5 {
+		t.Errorf("printed %v events, want 5\n%v", len(got), out)
+	}
+	if !strings.Contains(out.String(), "|sev-step dry run|") {
+		t.Errorf("memory dump is missing\n%v", out)
+	}
+
+	if err := os.WriteFile(path, []byte("track 0x1000\nx/16 0x100000\n"), 0644); err != nil {
+		t.Fatalf("failed to write script : %v", err)
+	}
+	err := run(context.Background(), []string{"-dry-run", "-script", path, "-history", ""}, strings.NewReader(""), out, nil)
+	if err == nil || !strings.Contains(err.Error(), "explore.txt:2") {
+		t.Errorf("run() error = %v, want error in line 2", err)
+	}
+}
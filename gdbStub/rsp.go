@@ -0,0 +1,155 @@
+package gdbStub
+
+//This file implements the packet layer of the GDB remote serial protocol, see
+//https://sourceware.org/gdb/onlinedocs/gdb/Overview.html
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+const (
+	//interruptByte is sent by GDB outside of packets to stop the target (Ctrl-C)
+	interruptByte = 0x03
+	//interruptPacket is returned by readPacket for interruptByte. It cannot collide with a
+	//real packet, as those never contain raw 0x03
+	interruptPacket = "\x03"
+	//escapeByte escapes '#', '$', '}' and '*' in packet payloads, which are then XORed with 0x20
+	escapeByte = '}'
+)
+
+//rspConn reads and writes RSP packets. Acks sent by GDB are discarded, i.e. packets are not
+//retransmitted on a '-', as the stub is meant to be used over reliable local sockets.
+//readPacket must only be called from one goroutine, writePacket is safe for concurrent use
+type rspConn struct {
+	r *bufio.Reader
+	w io.Writer
+	//mu serializes writes, as the reader acks packets while the server may send a reply.
+	//It also guards noAck
+	mu sync.Mutex
+	//noAck is set once GDB enabled QStartNoAckMode
+	noAck bool
+}
+
+func newRSPConn(rw io.ReadWriter) *rspConn {
+	return &rspConn{
+		r: bufio.NewReader(rw),
+		w: rw,
+	}
+}
+
+func checksum(payload []byte) byte {
+	sum := byte(0)
+	for _, v := range payload {
+		sum += v
+	}
+	return sum
+}
+
+func (c *rspConn) writeRaw(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.w.Write(b)
+	return err
+}
+
+//writeAck sends ack, unless no-ack mode is enabled
+func (c *rspConn) writeAck(ack byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.noAck {
+		return nil
+	}
+	_, err := c.w.Write([]byte{ack})
+	return err
+}
+
+//disableAcks enables no-ack mode. Call this before replying to QStartNoAckMode
+func (c *rspConn) disableAcks() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.noAck = true
+}
+
+//readPacket returns the unescaped payload of the next packet and acks it. Packets with an invalid
+//checksum are nacked and skipped. An interrupt request is returned as interruptPacket
+func (c *rspConn) readPacket() (string, error) {
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case interruptByte:
+			return interruptPacket, nil
+		case '$':
+		default:
+			//acks and garbage between packets
+			continue
+		}
+
+		raw, err := c.r.ReadBytes('#')
+		if err != nil {
+			return "", err
+		}
+		raw = raw[:len(raw)-1]
+		sumHex := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, sumHex); err != nil {
+			return "", err
+		}
+		sum, err := strconv.ParseUint(string(sumHex), 16, 8)
+		if err != nil || byte(sum) != checksum(raw) {
+			if err := c.writeAck('-'); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err := c.writeAck('+'); err != nil {
+			return "", err
+		}
+		return string(unescape(raw)), nil
+	}
+}
+
+func unescape(raw []byte) []byte {
+	if bytes.IndexByte(raw, escapeByte) < 0 {
+		return raw
+	}
+	res := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == escapeByte && i+1 < len(raw) {
+			i++
+			res = append(res, raw[i]^0x20)
+			continue
+		}
+		res = append(res, raw[i])
+	}
+	return res
+}
+
+func escape(payload string) []byte {
+	res := make([]byte, 0, len(payload))
+	for i := 0; i < len(payload); i++ {
+		switch b := payload[i]; b {
+		case '#', '$', escapeByte, '*':
+			res = append(res, escapeByte, b^0x20)
+		default:
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+//writePacket sends payload as packet
+func (c *rspConn) writePacket(payload string) error {
+	escaped := escape(payload)
+	packet := make([]byte, 0, len(escaped)+4)
+	packet = append(packet, '$')
+	packet = append(packet, escaped...)
+	packet = append(packet, []byte(fmt.Sprintf("#%02x", checksum(escaped)))...)
+	return c.writeRaw(packet)
+}
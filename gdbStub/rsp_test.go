@@ -0,0 +1,72 @@
+package gdbStub
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRSPConn_ReadPacket(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		noAck       bool
+		wantPackets []string
+		wantAcks    string
+	}{
+		{name: "single", input: "$m0,8#01", wantPackets: []string{"m0,8"}, wantAcks: "+"},
+		{name: "acks and interrupt", input: "+$?#3f+\x03-$c#63", wantPackets: []string{"?", interruptPacket, "c"}, wantAcks: "++"},
+		{name: "invalid checksum is skipped", input: "$m0,8#00$g#67", wantPackets: []string{"g"}, wantAcks: "-+"},
+		{name: "escaped", input: "$X0,1:}]#f9", wantPackets: []string{"X0,1:}"}, wantAcks: "+"},
+		{name: "no ack mode", input: "$g#67$?#3f", noAck: true, wantPackets: []string{"g", "?"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acks := &bytes.Buffer{}
+			c := newRSPConn(struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader(tt.input), acks})
+			if tt.noAck {
+				c.disableAcks()
+			}
+			packets := make([]string, 0)
+			for {
+				packet, err := c.readPacket()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("readPacket() error = %v", err)
+				}
+				packets = append(packets, packet)
+			}
+			if !reflect.DeepEqual(packets, tt.wantPackets) {
+				t.Errorf("readPacket() returned %q, want %q", packets, tt.wantPackets)
+			}
+			if acks.String() != tt.wantAcks {
+				t.Errorf("sent acks %q, want %q", acks.String(), tt.wantAcks)
+			}
+		})
+	}
+}
+
+func TestRSPConn_WritePacket(t *testing.T) {
+	out := &bytes.Buffer{}
+	c := newRSPConn(struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(""), out})
+	if err := c.writePacket("a#b$c}d*e"); err != nil {
+		t.Fatalf("writePacket() error = %v", err)
+	}
+	want := "$a}\x03b}\x04c}]d}\x0ae#51"
+	if out.String() != want {
+		t.Errorf("writePacket() sent %q, want %q", out.String(), want)
+	}
+	if got := string(unescape(escape("a#b$c}d*e"))); got != "a#b$c}d*e" {
+		t.Errorf("unescape(escape()) = %q", got)
+	}
+}
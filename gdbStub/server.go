@@ -0,0 +1,574 @@
+//Package gdbStub implements a GDB remote serial protocol server on top of a sevStep.Tracker, to
+//inspect a guest with GDB or other reverse engineering tools that speak the protocol.
+//Execution control is page granular, as the guest only stops on page faults of tracked pages.
+//Breakpoints track the page containing their address for execution, continue runs the guest until
+//it executes a breakpoint page and step runs it until it executes another page.
+//Only RIP is known, from the latest page fault event, all other registers are reported as unavailable.
+//The guest is blocked while GDB shows a stop, but the kernel resumes it if the event is not acked
+//within a second. Afterwards, the guest keeps running and its page faults are dropped until the
+//next continue or step, thus memory reads may return memory that is still changing
+package gdbStub
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+const (
+	//maxPacketSize is announced in qSupported. Memory reads are limited accordingly
+	maxPacketSize = 0x4000
+	//ripRegister is the number of RIP in GDB's amd64 register layout
+	ripRegister = 16
+	//amd64 layout without target description: 16 general purpose registers and rip (8 bytes
+	//each), followed by eflags and 6 segment registers (4 bytes each)
+	numRegisters64 = 17
+	numRegisters32 = 7
+	//stop signals used in stop replies
+	sigInt  = 2
+	sigTrap = 5
+	//threadID is the only thread reported to GDB. The kernel patch only supports one vCPU
+	threadID = 1
+	//kernelAckTimeout is the time after which the kernel resumes the guest without ack, see
+	//uspt_send_and_block
+	kernelAckTimeout = time.Second
+)
+
+//Errors returned in E packets
+const (
+	errnoFault   = 14
+	errnoInvalid = 22
+)
+
+//Server serves a single VM to GDB clients. Clients are served one at a time. Pending events are
+//acked and breakpoints are removed when a client disconnects. Keep in mind that the kernel resumes
+//the guest if a stop lasts longer than a second, see the package doc.
+//The exported fields must not be changed while a client is connected
+type Server struct {
+	//Walker, if set, translates the addresses used by GDB as guest virtual addresses with CR3.
+	//Otherwise, addresses are guest physical addresses
+	Walker *sevStep.PageTableWalker
+	//CR3 is the guest's page table root used with Walker
+	CR3 uint64
+	//View is used for memory reads. Defaults to MemoryViewCiphertext
+	View sevStep.MemoryView
+	//PollInterval is the time between two polls while the guest is running. Defaults to 1ms
+	PollInterval time.Duration
+
+	tracker sevStep.Tracker
+	//loop waits for events, see waitForEvent
+	loop *sevStep.EventLoop
+	//mu makes sure that only one client is served
+	mu sync.Mutex
+
+	//pending is the last event, not acked yet. The guest is blocked while an event is pending,
+	//until the kernel's ack timeout expires
+	pending *sevStep.Event
+	//warnedAckTimeout is set once the client was told about the ack timeout
+	warnedAckTimeout bool
+	//breakpoints maps page GPAs to the number of breakpoints on them
+	breakpoints map[uint64]int
+}
+
+//NewServer creates a Server controlling the guest through tracker
+func NewServer(tracker sevStep.Tracker) *Server {
+	return &Server{
+		View:         sevStep.MemoryViewCiphertext,
+		PollInterval: time.Millisecond,
+		tracker:      tracker,
+		loop:         sevStep.NewEventLoop(tracker),
+		breakpoints:  make(map[uint64]int),
+	}
+}
+
+//Listen listens on addr. Addresses with "unix:" prefix are unix socket paths, all other addresses
+//are TCP addresses, e.g. "localhost:1234"
+func Listen(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+//Serve accepts clients on l and serves them one after another, until ctx is done or accepting
+//fails. l is closed once Serve returns
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("accept failed : %w", err)
+		}
+		if err := s.ServeConn(ctx, conn); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("Client %v failed : %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+//errDetach ends a connection without error
+var errDetach = errors.New("client detached")
+
+//ServeConn serves a single client until it detaches, the connection fails or ctx is done.
+//conn is closed once ServeConn returns
+func (s *Server) ServeConn(ctx context.Context, conn io.ReadWriteCloser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loop.PollBackoff = s.PollInterval
+	s.warnedAckTimeout = false
+	c := newRSPConn(conn)
+	packets := make(chan string)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		conn.Close()
+	}()
+	go func() {
+		defer close(packets)
+		for {
+			packet, err := c.readPacket()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case packets <- packet:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := s.serve(ctx, c, packets, readErr)
+	if cleanupErr := s.cleanup(); cleanupErr != nil && err == nil {
+		err = cleanupErr
+	}
+	if errors.Is(err, errDetach) || errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) serve(ctx context.Context, c *rspConn, packets <-chan string, readErr <-chan error) error {
+	for {
+		var packet string
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case p, ok := <-packets:
+			if !ok {
+				return <-readErr
+			}
+			packet = p
+		}
+		if packet == interruptPacket {
+			//the guest is already stopped
+			continue
+		}
+		reply, err := s.handlePacket(ctx, c, packet, packets)
+		//an empty reply is only sent for unsupported packets, not on errors
+		if reply != "" || err == nil {
+			if writeErr := c.writePacket(reply); writeErr != nil {
+				return fmt.Errorf("failed to send reply : %w", writeErr)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//cleanup removes all breakpoints and acks the pending event. All pages are untracked, even without
+//breakpoints, as the client may disconnect while step or interrupt tracked all pages
+func (s *Server) cleanup() error {
+	err := s.tracker.CmdUnTrackAllPages(sevStep.PageTrackExec)
+	if err != nil {
+		err = fmt.Errorf("failed to untrack pages : %w", err)
+	}
+	s.breakpoints = make(map[uint64]int)
+	if ackErr := s.ack(); ackErr != nil && err == nil {
+		err = ackErr
+	}
+	return err
+}
+
+func errorReply(errno int) string {
+	return fmt.Sprintf("E%02x", errno)
+}
+
+//handlePacket returns the reply to packet. An empty reply tells GDB that the packet is not supported
+func (s *Server) handlePacket(ctx context.Context, c *rspConn, packet string, packets <-chan string) (string, error) {
+	switch {
+	case packet == "?":
+		return s.stopReply(sigTrap), nil
+	case strings.HasPrefix(packet, "qSupported"):
+		return fmt.Sprintf("PacketSize=%x;QStartNoAckMode+", maxPacketSize), nil
+	case packet == "QStartNoAckMode":
+		c.disableAcks()
+		return "OK", nil
+	case packet == "qAttached":
+		return "1", nil
+	case packet == "qC":
+		return fmt.Sprintf("QC%x", threadID), nil
+	case packet == "qfThreadInfo":
+		return fmt.Sprintf("m%x", threadID), nil
+	case packet == "qsThreadInfo":
+		return "l", nil
+	case packet == "qSymbol::":
+		return "OK", nil
+	case strings.HasPrefix(packet, "H"), strings.HasPrefix(packet, "T"):
+		return "OK", nil
+	case packet == "g":
+		return s.readRegisters(), nil
+	case strings.HasPrefix(packet, "p"):
+		return s.readRegister(packet[1:]), nil
+	case strings.HasPrefix(packet, "G"), strings.HasPrefix(packet, "P"),
+		strings.HasPrefix(packet, "M"), strings.HasPrefix(packet, "X"):
+		//sev-step cannot modify the guest
+		return errorReply(errnoInvalid), nil
+	case strings.HasPrefix(packet, "m"):
+		return s.readMemory(packet[1:]), nil
+	case strings.HasPrefix(packet, "c"), strings.HasPrefix(packet, "s"):
+		return s.resume(ctx, packets, packet[0] == 's')
+	case strings.HasPrefix(packet, "Z0,"), strings.HasPrefix(packet, "Z1,"):
+		return s.insertBreakpoint(packet[3:]), nil
+	case strings.HasPrefix(packet, "z0,"), strings.HasPrefix(packet, "z1,"):
+		return s.removeBreakpoint(packet[3:]), nil
+	case packet == "D" || strings.HasPrefix(packet, "D;"):
+		return "OK", errDetach
+	case packet == "k":
+		//keep the VM running, only end the session
+		return "", errDetach
+	default:
+		return "", nil
+	}
+}
+
+//stopReply reports the pending event as signal sig with RIP, if available
+func (s *Server) stopReply(sig int) string {
+	if s.pending != nil && !s.warnedAckTimeout {
+		log.Printf("Guest stopped at event %v. The kernel resumes it if it is not continued within %v, "+
+			"its page faults are dropped afterwards", s.pending.ID, kernelAckTimeout)
+		s.warnedAckTimeout = true
+	}
+	reply := fmt.Sprintf("T%02xthread:%x;", sig, threadID)
+	if s.pending != nil && s.pending.HaveRipInfo {
+		reply += fmt.Sprintf("%02x:%s;", ripRegister, encodeRegister(s.pending.RIP))
+	}
+	return reply
+}
+
+func encodeRegister(value uint64) string {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, value)
+	return hex.EncodeToString(buf)
+}
+
+//rip returns the encoded RIP of the pending event or "x"s if it is unknown
+func (s *Server) rip() string {
+	if s.pending == nil || !s.pending.HaveRipInfo {
+		return strings.Repeat("xx", 8)
+	}
+	return encodeRegister(s.pending.RIP)
+}
+
+func (s *Server) readRegisters() string {
+	return strings.Repeat("xx", 8*ripRegister) + s.rip() + strings.Repeat("xx", 4*numRegisters32)
+}
+
+func (s *Server) readRegister(arg string) string {
+	n, err := strconv.ParseUint(arg, 16, 32)
+	switch {
+	case err != nil:
+		return errorReply(errnoInvalid)
+	case n == ripRegister:
+		return s.rip()
+	case n < numRegisters64:
+		return strings.Repeat("xx", 8)
+	case n < numRegisters64+numRegisters32:
+		return strings.Repeat("xx", 4)
+	default:
+		return errorReply(errnoInvalid)
+	}
+}
+
+//parseAddrLength parses "addr,length" as used by m, Z and z packets
+func parseAddrLength(arg string) (uint64, uint64, error) {
+	parts := strings.SplitN(arg, ",", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected addr,length but got %q", arg)
+	}
+	addr, err := strconv.ParseUint(parts[0], 16, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid address %q", parts[0])
+	}
+	//Z packets may append conditions after the kind
+	length, err := strconv.ParseUint(strings.SplitN(parts[1], ";", 2)[0], 16, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid length %q", parts[1])
+	}
+	return addr, length, nil
+}
+
+//translate returns the GPA of addr
+func (s *Server) translate(addr uint64) (uint64, error) {
+	if s.Walker == nil {
+		return addr, nil
+	}
+	t, err := s.Walker.Translate(s.CR3, addr)
+	if err != nil {
+		return 0, err
+	}
+	return t.GPA, nil
+}
+
+//readMemory handles "m addr,length". The reply is shorter than length if only the start of the
+//range could be read
+func (s *Server) readMemory(arg string) string {
+	addr, length, err := parseAddrLength(arg)
+	if err != nil {
+		return errorReply(errnoInvalid)
+	}
+	if length > maxPacketSize/2 {
+		length = maxPacketSize / 2
+	}
+	mem := sevStep.NewGuestMemory(s.tracker, s.View, false)
+	buf := make([]byte, length)
+	n := uint64(0)
+	for n < length {
+		//translation is done per page, as contiguous virtual pages may be scattered physically
+		chunk := length - n
+		if pageRemaining := 0x1000 - (addr+n)&0xfff; chunk > pageRemaining {
+			chunk = pageRemaining
+		}
+		gpa, err := s.translate(addr + n)
+		if err != nil {
+			break
+		}
+		if _, err := mem.ReadAt(buf[n:n+chunk], int64(gpa)); err != nil {
+			break
+		}
+		n += chunk
+	}
+	if n == 0 && length > 0 {
+		return errorReply(errnoFault)
+	}
+	return hex.EncodeToString(buf[:n])
+}
+
+//breakpointPage returns the page GPA for a breakpoint at addr
+func (s *Server) breakpointPage(arg string) (uint64, error) {
+	addr, _, err := parseAddrLength(arg)
+	if err != nil {
+		return 0, err
+	}
+	gpa, err := s.translate(addr)
+	if err != nil {
+		return 0, err
+	}
+	return gpa &^ 0xfff, nil
+}
+
+//pendingPage returns the page of the pending event, if any
+func (s *Server) pendingPage() (uint64, bool) {
+	if s.pending == nil {
+		return 0, false
+	}
+	return s.pending.FaultedGPA &^ 0xfff, true
+}
+
+//trackBreakpoints untracks all pages and tracks the breakpoint pages except the page of the
+//pending event, as tracking it would fault again before the guest left the page
+func (s *Server) trackBreakpoints() error {
+	if err := s.tracker.CmdUnTrackAllPages(sevStep.PageTrackExec); err != nil {
+		return fmt.Errorf("failed to untrack pages : %w", err)
+	}
+	skip, haveSkip := s.pendingPage()
+	for page := range s.breakpoints {
+		if haveSkip && page == skip {
+			continue
+		}
+		if err := s.tracker.CmdTrackPage(page, sevStep.PageTrackExec); err != nil {
+			return fmt.Errorf("failed to track breakpoint page 0x%x : %w", page, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) insertBreakpoint(arg string) string {
+	gpa, err := s.breakpointPage(arg)
+	if err != nil {
+		return errorReply(errnoInvalid)
+	}
+	pendingPage, havePending := s.pendingPage()
+	if s.breakpoints[gpa] == 0 && !(havePending && pendingPage == gpa) {
+		if err := s.tracker.CmdTrackPage(gpa, sevStep.PageTrackExec); err != nil {
+			return errorReply(errnoFault)
+		}
+	}
+	s.breakpoints[gpa]++
+	return "OK"
+}
+
+//removeBreakpoint removes a breakpoint. As there is no command to untrack a single page,
+//all pages are untracked and the remaining breakpoints are tracked again
+func (s *Server) removeBreakpoint(arg string) string {
+	gpa, err := s.breakpointPage(arg)
+	if err != nil {
+		return errorReply(errnoInvalid)
+	}
+	if s.breakpoints[gpa] == 0 {
+		return errorReply(errnoInvalid)
+	}
+	s.breakpoints[gpa]--
+	if s.breakpoints[gpa] > 0 {
+		return "OK"
+	}
+	delete(s.breakpoints, gpa)
+	if err := s.trackBreakpoints(); err != nil {
+		return errorReply(errnoFault)
+	}
+	return "OK"
+}
+
+//ack acks the pending event, letting the guest continue
+func (s *Server) ack() error {
+	if s.pending == nil {
+		return nil
+	}
+	ev := s.pending
+	s.pending = nil
+	if err := s.tracker.CmdAckEvent(ev.ID); err != nil {
+		return fmt.Errorf("CmdAckEvent for %v failed : %w", ev.ID, err)
+	}
+	return nil
+}
+
+//errInterrupted stops waitForEvent if GDB sent an interrupt
+var errInterrupted = errors.New("interrupted")
+
+//waitForEvent waits for the next event. Returns nil if GDB sent an interrupt. Other packets are
+//ignored while the guest is running
+func (s *Server) waitForEvent(ctx context.Context, packets <-chan string) (*sevStep.Event, error) {
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	//stopReason is set before the watcher cancels waitCtx and read after it returned
+	var stopReason error
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		for {
+			select {
+			case <-waitCtx.Done():
+				return
+			case packet, ok := <-packets:
+				if !ok {
+					stopReason = io.EOF
+				} else if packet == interruptPacket {
+					stopReason = errInterrupted
+				} else {
+					continue
+				}
+				cancel()
+				return
+			}
+		}
+	}()
+	ev, err := s.loop.NextEvent(waitCtx)
+	cancel()
+	<-watcherDone
+	if err != nil && stopReason != nil && ctx.Err() == nil {
+		if stopReason == errInterrupted {
+			return nil, nil
+		}
+		return nil, stopReason
+	}
+	return ev, err
+}
+
+//interrupt stops the running guest. All pages are tracked and the next event becomes the pending
+//event, thus the guest is blocked when GDB gets the stop reply, until the kernel's ack timeout. If the guest does not fault, e.g.
+//because it finished, a second interrupt gives up and the guest keeps running
+func (s *Server) interrupt(ctx context.Context, packets <-chan string) (string, error) {
+	if err := s.tracker.CmdTrackAllPages(sevStep.PageTrackExec); err != nil {
+		return "", fmt.Errorf("failed to track all pages : %w", err)
+	}
+	ev, err := s.waitForEvent(ctx, packets)
+	if err != nil {
+		return "", err
+	}
+	s.pending = ev
+	if err := s.trackBreakpoints(); err != nil {
+		return "", err
+	}
+	return s.stopReply(sigInt), nil
+}
+
+//resume handles c and s and returns the stop reply. Both run the guest until a tracked page
+//faults or GDB sends an interrupt, see interrupt.
+//Tracking is one-shot, thus a breakpoint page cannot be tracked again while the guest executes it.
+//To leave the page of the pending event, all pages are tracked until the guest faults on another
+//page. For s, that fault is reported. For c, it is only reported if it hits a breakpoint, otherwise
+//only the breakpoint pages are tracked again and the guest continues
+func (s *Server) resume(ctx context.Context, packets <-chan string, step bool) (string, error) {
+	from, haveFrom := s.pendingPage()
+	leaving := step || (haveFrom && s.breakpoints[from] > 0)
+	if leaving {
+		if err := s.tracker.CmdTrackAllPages(sevStep.PageTrackExec); err != nil {
+			return errorReply(errnoFault), nil
+		}
+	}
+	if err := s.ack(); err != nil {
+		return errorReply(errnoFault), nil
+	}
+	for {
+		ev, err := s.waitForEvent(ctx, packets)
+		if err != nil {
+			return "", err
+		}
+		if ev == nil {
+			return s.interrupt(ctx, packets)
+		}
+		s.pending = ev
+		if !leaving {
+			return s.stopReply(sigTrap), nil
+		}
+		page, _ := s.pendingPage()
+		if haveFrom && page == from {
+			//the guest is still on the page it should leave
+			if err := s.ack(); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err := s.trackBreakpoints(); err != nil {
+			return "", err
+		}
+		if step || s.breakpoints[page] > 0 {
+			return s.stopReply(sigTrap), nil
+		}
+		leaving = false
+		if err := s.ack(); err != nil {
+			return "", err
+		}
+	}
+}
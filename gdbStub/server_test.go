@@ -0,0 +1,346 @@
+package gdbStub
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//testClient is a scripted GDB client
+type testClient struct {
+	t     *testing.T
+	conn  net.Conn
+	r     *bufio.Reader
+	noAck bool
+}
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(payload string) {
+	c.t.Helper()
+	if _, err := fmt.Fprintf(c.conn, "$%s#%02x", payload, checksum([]byte(payload))); err != nil {
+		c.t.Fatalf("failed to send %q : %v", payload, err)
+	}
+	if c.noAck {
+		return
+	}
+	if ack, err := c.r.ReadByte(); err != nil || ack != '+' {
+		c.t.Fatalf("expected ack for %q, got %q, %v", payload, ack, err)
+	}
+}
+
+func (c *testClient) receive() string {
+	c.t.Helper()
+	if b, err := c.r.ReadByte(); err != nil || b != '$' {
+		c.t.Fatalf("expected packet start, got %q, %v", b, err)
+	}
+	raw, err := c.r.ReadBytes('#')
+	if err != nil {
+		c.t.Fatalf("failed to read packet : %v", err)
+	}
+	raw = raw[:len(raw)-1]
+	sum := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, sum); err != nil || string(sum) != fmt.Sprintf("%02x", checksum(raw)) {
+		c.t.Fatalf("invalid checksum %q for %q, %v", sum, raw, err)
+	}
+	if !c.noAck {
+		if _, err := c.conn.Write([]byte{'+'}); err != nil {
+			c.t.Fatalf("failed to ack : %v", err)
+		}
+	}
+	return string(unescape(raw))
+}
+
+func (c *testClient) request(payload string) string {
+	c.t.Helper()
+	c.send(payload)
+	return c.receive()
+}
+
+//startServer serves one connection of server over a pipe. The returned channel receives the
+//result of ServeConn
+func startServer(t *testing.T, server *Server) (*testClient, <-chan error) {
+	serverConn, clientConn := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	res := make(chan error, 1)
+	go func() {
+		res <- server.ServeConn(ctx, serverConn)
+	}()
+	client := newTestClient(t, clientConn)
+	t.Cleanup(func() { clientConn.Close() })
+	return client, res
+}
+
+func stopWithRIP(rip uint64) string {
+	return fmt.Sprintf("T05thread:1;10:%s;", encodeRegister(rip))
+}
+
+func TestServer_Session(t *testing.T) {
+	script := []sevStep.GuestAccess{
+		{GPA: 0x1000, Kind: sevStep.AccessExec, RIP: 0x401000},
+		{GPA: 0x1010, Kind: sevStep.AccessExec, RIP: 0x401010},
+		{GPA: 0x2000, Kind: sevStep.AccessExec, RIP: 0x402000},
+		{GPA: 0x2100, Kind: sevStep.AccessRead, RIP: 0x402004},
+		{GPA: 0x1020, Kind: sevStep.AccessExec, RIP: 0x401020},
+		{GPA: 0x3000, Kind: sevStep.AccessExec, RIP: 0x403000},
+		{GPA: 0x1030, Kind: sevStep.AccessExec, RIP: 0x401030},
+	}
+	//keeps the guest running until the interrupt, with one access per poll
+	for i := 0; i < 1000; i++ {
+		script = append(script, sevStep.GuestAccess{GPA: 0x3100, Kind: sevStep.AccessExec, RIP: 0x403100})
+	}
+	vm := sevStep.NewSimulatedVM(4, script, true)
+	vm.AccessesPerCall = 1
+	if err := vm.WriteGuestMemory(0x2100, []byte("sev-step")); err != nil {
+		t.Fatalf("WriteGuestMemory failed : %v", err)
+	}
+	client, res := startServer(t, NewServer(vm))
+
+	steps := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{name: "supported", request: "qSupported:multiprocess+;swbreak+", want: "PacketSize=4000;QStartNoAckMode+"},
+		{name: "unsupported", request: "vMustReplyEmpty", want: ""},
+		{name: "initial stop", request: "?", want: "T05thread:1;"},
+		{name: "unknown rip", request: "p10", want: strings.Repeat("x", 16)},
+		{name: "read memory", request: "m2100,8", want: hex.EncodeToString([]byte("sev-step"))},
+		{name: "memory outside guest", request: "m4000,8", want: "E0e"},
+		{name: "write memory", request: "M2100,1:00", want: "E16"},
+		{name: "breakpoint", request: "Z0,1004,1", want: "OK"},
+		{name: "second breakpoint on page", request: "Z1,1ff0,1", want: "OK"},
+		{name: "continue to breakpoint", request: "c", want: stopWithRIP(0x401000)},
+		{name: "rip register", request: "p10", want: encodeRegister(0x401000)},
+		//leaves the breakpoint page, skips the fault on page 0x2000 and hits the breakpoint again
+		{name: "continue to same breakpoint", request: "c", want: stopWithRIP(0x401020)},
+		{name: "step to next page", request: "s", want: stopWithRIP(0x403000)},
+		{name: "continue from other page", request: "c", want: stopWithRIP(0x401030)},
+		{name: "remove breakpoint", request: "z0,1004,1", want: "OK"},
+		{name: "remove unknown breakpoint", request: "z0,2000,1", want: "E16"},
+		{name: "no ack mode", request: "QStartNoAckMode", want: "OK"},
+	}
+	for _, tt := range steps {
+		if got := client.request(tt.request); got != tt.want {
+			t.Fatalf("%v : %q returned %q, want %q", tt.name, tt.request, got, tt.want)
+		}
+	}
+	client.noAck = true
+
+	//no breakpoint is left, continue only returns on interrupt and stops the guest at its next fault
+	client.send("c")
+	time.Sleep(10 * time.Millisecond)
+	if _, err := client.conn.Write([]byte{interruptByte}); err != nil {
+		t.Fatalf("failed to send interrupt : %v", err)
+	}
+	if got, want := client.receive(), fmt.Sprintf("T02thread:1;10:%s;", encodeRegister(0x403100)); got != want {
+		t.Errorf("interrupt returned %q, want %q", got, want)
+	}
+	if vm.GuestDone() {
+		t.Errorf("guest finished before the interrupt")
+	}
+	if got := client.request("p10"); got != encodeRegister(0x403100) {
+		t.Errorf("rip register after interrupt returned %q", got)
+	}
+	if got := client.request("D"); got != "OK" {
+		t.Errorf("detach returned %q", got)
+	}
+	if err := <-res; err != nil {
+		t.Errorf("ServeConn() error = %v", err)
+	}
+	//detaching acked the pending event and removed the tracking of the interrupt
+	vm.RunGuest(0)
+	if !vm.GuestDone() {
+		t.Errorf("guest did not finish")
+	}
+}
+
+func TestServer_InterruptFinishedGuest(t *testing.T) {
+	vm := sevStep.NewSimulatedVM(2, nil, true)
+	client, _ := startServer(t, NewServer(vm))
+	client.send("c")
+	//the finished guest does not fault after the first interrupt, the second one gives up
+	for i := 0; i < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if _, err := client.conn.Write([]byte{interruptByte}); err != nil {
+			t.Fatalf("failed to send interrupt : %v", err)
+		}
+	}
+	if got := client.receive(); got != "T02thread:1;" {
+		t.Errorf("interrupt returned %q", got)
+	}
+	if got := client.request("?"); got != "T05thread:1;" {
+		t.Errorf("stop reason returned %q, want no pending event", got)
+	}
+}
+
+func TestServer_DisconnectWhileRunning(t *testing.T) {
+	tests := []struct {
+		name      string
+		request   string
+		interrupt bool
+	}{
+		{name: "step", request: "s"},
+		{name: "continue and interrupt", request: "c", interrupt: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//reads do not fault on exec tracked pages, the guest only faults near the end
+			script := make([]sevStep.GuestAccess, 0)
+			for i := 0; i < 1000; i++ {
+				script = append(script, sevStep.GuestAccess{GPA: 0x2000, Kind: sevStep.AccessRead})
+			}
+			script = append(script, sevStep.GuestAccess{GPA: 0x1000, Kind: sevStep.AccessExec}, sevStep.GuestAccess{GPA: 0x2000, Kind: sevStep.AccessRead})
+			vm := sevStep.NewSimulatedVM(4, script, true)
+			vm.AccessesPerCall = 1
+			client, res := startServer(t, NewServer(vm))
+			client.send(tt.request)
+			if tt.interrupt {
+				time.Sleep(10 * time.Millisecond)
+				if _, err := client.conn.Write([]byte{interruptByte}); err != nil {
+					t.Fatalf("failed to send interrupt : %v", err)
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			client.conn.Close()
+			if err := <-res; err != nil {
+				t.Errorf("ServeConn() error = %v", err)
+			}
+			//the exec access would block the guest if the pages were still tracked
+			vm.RunGuest(0)
+			if !vm.GuestDone() {
+				t.Errorf("pages are still tracked after the disconnect")
+			}
+		})
+	}
+}
+
+func TestServer_Registers(t *testing.T) {
+	vm := sevStep.NewSimulatedVM(2, []sevStep.GuestAccess{{GPA: 0x1000, Kind: sevStep.AccessExec, RIP: 0xffffffff81000010}}, true)
+	client, _ := startServer(t, NewServer(vm))
+	wantUnknown := strings.Repeat("x", 17*16+7*8)
+	if got := client.request("g"); got != wantUnknown {
+		t.Errorf("g returned %q, want %q", got, wantUnknown)
+	}
+	client.request("Z0,1000,1")
+	client.request("c")
+	want := strings.Repeat("x", 16*16) + "10000081ffffffff" + strings.Repeat("x", 7*8)
+	if got := client.request("g"); got != want {
+		t.Errorf("g returned %q, want %q", got, want)
+	}
+	tests := map[string]string{"p0": strings.Repeat("x", 16), "p11": strings.Repeat("x", 8), "p18": "E16", "pzz": "E16"}
+	for request, want := range tests {
+		if got := client.request(request); got != want {
+			t.Errorf("%q returned %q, want %q", request, got, want)
+		}
+	}
+}
+
+//writePageTables maps the virtual page 0x400000 to 0x4000 with 4-level paging and cr3 0
+func writePageTables(t *testing.T, vm *sevStep.SimulatedVM) {
+	entries := map[uint64]uint64{
+		0x0000:         0x1000 | 1,
+		0x1000:         0x2000 | 1,
+		0x2000 + 2*8:   0x3000 | 1,
+		0x3000:         0x4000 | 1,
+		0x3000 + 0xff8: 0x5000 | 1,
+	}
+	for gpa, entry := range entries {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, entry)
+		if err := vm.WriteGuestMemory(gpa, buf); err != nil {
+			t.Fatalf("WriteGuestMemory failed : %v", err)
+		}
+	}
+}
+
+func TestServer_VirtualAddresses(t *testing.T) {
+	vm := sevStep.NewSimulatedVM(8, []sevStep.GuestAccess{{GPA: 0x4010, Kind: sevStep.AccessExec, RIP: 0x400010}}, true)
+	writePageTables(t, vm)
+	if err := vm.WriteGuestMemory(0x4ffe, []byte("sev-step")); err != nil {
+		t.Fatalf("WriteGuestMemory failed : %v", err)
+	}
+	server := NewServer(vm)
+	server.Walker = sevStep.NewTrackerPageTableWalker(vm, sevStep.PagingMode4Level, true, -1)
+	client, _ := startServer(t, server)
+
+	tests := []struct {
+		request string
+		want    string
+	}{
+		{request: "m400ffe,2", want: hex.EncodeToString([]byte("se"))},
+		//0x401000 is not mapped, thus only the first two bytes are returned
+		{request: "m400ffe,8", want: hex.EncodeToString([]byte("se"))},
+		{request: "m401000,8", want: "E0e"},
+		//the last entry of the page table maps 0x5ff000 to 0x5000, which contains the rest of the string
+		{request: "m5ff000,2", want: hex.EncodeToString([]byte("v-"))},
+		{request: "Z0,500000,1", want: "E16"},
+		{request: "Z0,400123,1", want: "OK"},
+		{request: "c", want: stopWithRIP(0x400010)},
+	}
+	for _, tt := range tests {
+		if got := client.request(tt.request); got != tt.want {
+			t.Errorf("%q returned %q, want %q", tt.request, got, tt.want)
+		}
+	}
+}
+
+func TestServer_Listen(t *testing.T) {
+	tests := []struct {
+		name string
+		addr func(t *testing.T) string
+	}{
+		{name: "tcp", addr: func(t *testing.T) string { return "127.0.0.1:0" }},
+		{name: "unix", addr: func(t *testing.T) string { return "unix:" + filepath.Join(t.TempDir(), "gdb.sock") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := Listen(tt.addr(t))
+			if err != nil {
+				t.Fatalf("Listen() error = %v", err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			res := make(chan error, 1)
+			go func() {
+				res <- NewServer(sevStep.NewSimulatedVM(1, nil, false)).Serve(ctx, l)
+			}()
+
+			//clients are served one after another
+			for i := 0; i < 2; i++ {
+				conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+				if err != nil {
+					t.Fatalf("Dial failed : %v", err)
+				}
+				client := newTestClient(t, conn)
+				if got := client.request("qAttached"); got != "1" {
+					t.Errorf("qAttached returned %q", got)
+				}
+				client.send("k")
+				if _, err := client.r.ReadByte(); err != io.EOF {
+					t.Errorf("connection should be closed after kill, got %v", err)
+				}
+				conn.Close()
+			}
+			cancel()
+			if err := <-res; !errors.Is(err, context.Canceled) {
+				t.Errorf("Serve() error = %v", err)
+			}
+		})
+	}
+}
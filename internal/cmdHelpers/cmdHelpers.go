@@ -0,0 +1,33 @@
+//Package cmdHelpers contains the flag and argument parsing shared by the commands in cmd
+package cmdHelpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//StringList is a flag that may be passed multiple times and also accepts comma separated values
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *StringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+//ParseUint accepts decimal and 0x prefixed numbers, ignoring surrounding whitespace
+func ParseUint(s string) (uint64, error) {
+	value, err := strconv.ParseUint(strings.TrimSpace(s), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return value, nil
+}
@@ -0,0 +1,42 @@
+package cmdHelpers
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestStringList(t *testing.T) {
+	var l StringList
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&l, "page", "")
+	if err := fs.Parse([]string{"-page", "0x1000, 0x2000", "-page", "0x3000-0x5000,"}); err != nil {
+		t.Fatalf("Parse failed : %v", err)
+	}
+	if want := (StringList{"0x1000", "0x2000", "0x3000-0x5000"}); !reflect.DeepEqual(l, want) {
+		t.Errorf("StringList = %q, want %q", l, want)
+	}
+}
+
+func TestParseUint(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    uint64
+		wantErr bool
+	}{
+		{input: "42", want: 42},
+		{input: "0x1000", want: 0x1000},
+		{input: " 0x10 ", want: 0x10},
+		{input: "0xffffffffffffffff", want: 0xffffffffffffffff},
+		{input: "-1", wantErr: true},
+		{input: "page", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseUint(tt.input)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ParseUint() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package sevStep
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//BatchGapReason describes why events are missing in a BatchResult
+type BatchGapReason int
+
+const (
+	//BatchGapOverflow means the kernel's event buffer was full and further events were dropped
+	BatchGapOverflow = BatchGapReason(iota)
+	//BatchGapRotation means events were recorded between querying the event count and stopping
+	//the batch. The kernel only returns the requested number of events
+	BatchGapRotation
+	//BatchGapError means the kernel reported an error during the batch without an overflow.
+	//The number of lost events is unknown. See dmesg for details
+	BatchGapError
+)
+
+func (r BatchGapReason) String() string {
+	switch r {
+	case BatchGapOverflow:
+		return "Overflow"
+	case BatchGapRotation:
+		return "Rotation"
+	case BatchGapError:
+		return "Error"
+	default:
+		return "Unknown"
+	}
+}
+
+//BatchGap describes missing events in a BatchResult
+type BatchGap struct {
+	//Position is the index in BatchResult.Events before which the events are missing,
+	//i.e. they occurred between the events with IDs Position-1 and Position
+	Position uint64
+	//Batch is the index of the batch in which the events were lost
+	Batch int
+	//Lost is the number of missing events. Zero for BatchGapError
+	Lost   uint64
+	Reason BatchGapReason
+}
+
+func (g BatchGap) String() string {
+	return fmt.Sprintf("Batch %d, Position %d, Lost %d, Reason %v", g.Batch, g.Position, g.Lost, g.Reason)
+}
+
+//BatchResult contains the concatenated events of all batches of a BatchSession
+type BatchResult struct {
+	//Events of all batches with continuous IDs, starting at zero. Events that were delivered
+	//interactively while the batches were rotated have HaveRetiredInstructions unset
+	Events []*Event
+	//Gaps lists all places at which events are missing
+	Gaps []BatchGap
+	//Batches is the number of batches
+	Batches int
+}
+
+//BatchSession runs batch tracking in multiple batches of limited size. It monitors the event count
+//and stops the batch before the kernel's buffer overflows, starting a new one right away.
+//Faults that happen while no batch is active are delivered as interactive events. The session
+//acks them and includes them in the result.
+//Note that the kernel's retrack backlog is lost on rotation. If Retrack is set, only pages with
+//interactive faults during the rotation are re-tracked.
+//The exported fields must not be changed while Run is executing
+type BatchSession struct {
+	//BatchSize is the number of events the kernel allocates room for in each batch
+	BatchSize uint64
+	//Headroom is the number of free entries at which the batch is rotated. It must cover the number
+	//of events that occur between two PollInterval. Defaults to 10% of BatchSize
+	Headroom uint64
+	//PollInterval is the time between two event count queries. Defaults to 1ms
+	PollInterval time.Duration
+	//TrackMode, PerfCPU and Retrack are passed to CmdBatchTrackingStart
+	TrackMode PageTrackMode
+	PerfCPU   int
+	Retrack   bool
+
+	tracker Tracker
+	result  *BatchResult
+	//retrackOnStart are pages that faulted interactively during rotation
+	retrackOnStart []uint64
+}
+
+//NewBatchSession creates a BatchSession with the default Headroom and PollInterval. See
+//CmdBatchTrackingStart for trackMode, perfCPU and retrack. You still need to track the initial pages
+func NewBatchSession(tracker Tracker, trackMode PageTrackMode, batchSize uint64, perfCPU int, retrack bool) *BatchSession {
+	return &BatchSession{
+		BatchSize:    batchSize,
+		Headroom:     batchSize / 10,
+		PollInterval: time.Millisecond,
+		TrackMode:    trackMode,
+		PerfCPU:      perfCPU,
+		Retrack:      retrack,
+		tracker:      tracker,
+	}
+}
+
+func (s *BatchSession) appendEvent(ev *Event) {
+	ev.ID = uint64(len(s.result.Events))
+	s.result.Events = append(s.result.Events, ev)
+}
+
+func (s *BatchSession) start() error {
+	if err := s.tracker.CmdBatchTrackingStart(s.TrackMode, s.BatchSize, s.PerfCPU, s.Retrack); err != nil {
+		return fmt.Errorf("CmdBatchTrackingStart failed : %w", err)
+	}
+	for _, gpa := range s.retrackOnStart {
+		if err := s.tracker.CmdTrackPage(gpa, s.TrackMode); err != nil {
+			return fmt.Errorf("failed to retrack 0x%x : %w", gpa, err)
+		}
+	}
+	s.retrackOnStart = s.retrackOnStart[:0]
+	return nil
+}
+
+//stop ends the current batch, adds its events to the result and records gaps
+func (s *BatchSession) stop(batch int) error {
+	count, err := s.tracker.CmdBatchTrackingEventCount()
+	if err != nil {
+		return fmt.Errorf("CmdBatchTrackingEventCount failed : %w", err)
+	}
+	if count > s.BatchSize {
+		count = s.BatchSize
+	}
+	events, batchErr, err := s.tracker.CmdBatchTrackingStopAndGet(count)
+	if err != nil {
+		return fmt.Errorf("CmdBatchTrackingStopAndGet failed : %w", err)
+	}
+	for _, v := range events {
+		s.appendEvent(v)
+	}
+
+	//the kernel keeps counting events after the buffer is full and does not reset
+	//the count on stop. Thus, we know exactly how many events were not returned
+	finalCount, err := s.tracker.CmdBatchTrackingEventCount()
+	if err != nil {
+		return fmt.Errorf("CmdBatchTrackingEventCount failed : %w", err)
+	}
+	position := uint64(len(s.result.Events))
+	switch {
+	case finalCount > s.BatchSize:
+		s.result.Gaps = append(s.result.Gaps, BatchGap{Position: position, Batch: batch, Lost: finalCount - count, Reason: BatchGapOverflow})
+	case finalCount > count:
+		s.result.Gaps = append(s.result.Gaps, BatchGap{Position: position, Batch: batch, Lost: finalCount - count, Reason: BatchGapRotation})
+	case batchErr:
+		s.result.Gaps = append(s.result.Gaps, BatchGap{Position: position, Batch: batch, Reason: BatchGapError})
+	}
+	s.result.Batches++
+	return nil
+}
+
+//ackInteractive acks the interactive event that is pending if a fault occurred while no batch
+//was active. The kernel delivers at most one interactive event at a time
+func (s *BatchSession) ackInteractive() error {
+	ev, ok, err := s.tracker.CmdPollEvent()
+	if err != nil {
+		return fmt.Errorf("CmdPollEvent failed : %w", err)
+	}
+	if !ok {
+		return nil
+	}
+	if err := s.tracker.CmdAckEvent(ev.ID); err != nil {
+		return fmt.Errorf("CmdAckEvent for %v failed : %w", ev.ID, err)
+	}
+	if s.Retrack {
+		s.retrackOnStart = append(s.retrackOnStart, ev.FaultedGPA)
+	}
+	ev.HaveRetiredInstructions = false
+	s.appendEvent(ev)
+	return nil
+}
+
+//Run starts batch tracking and rotates batches until ctx is done. Then, the last batch is stopped
+//and the concatenated events are returned. Cancelling ctx is not considered an error
+func (s *BatchSession) Run(ctx context.Context) (*BatchResult, error) {
+	s.result = &BatchResult{
+		Events: make([]*Event, 0),
+		Gaps:   make([]BatchGap, 0),
+	}
+	s.retrackOnStart = make([]uint64, 0)
+	if s.Headroom >= s.BatchSize {
+		return nil, fmt.Errorf("headroom %d must be smaller than batch size %d", s.Headroom, s.BatchSize)
+	}
+
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+	batch := 0
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.stop(batch); err != nil {
+				return s.result, err
+			}
+			return s.result, s.ackInteractive()
+		case <-ticker.C:
+		}
+
+		count, err := s.tracker.CmdBatchTrackingEventCount()
+		if err != nil {
+			return s.result, fmt.Errorf("CmdBatchTrackingEventCount failed : %w", err)
+		}
+		if count+s.Headroom < s.BatchSize {
+			continue
+		}
+
+		if err := s.stop(batch); err != nil {
+			return s.result, err
+		}
+		//ack events that occurred while no batch was active, before and after restarting
+		if err := s.ackInteractive(); err != nil {
+			return s.result, err
+		}
+		batch++
+		if err := s.start(); err != nil {
+			return s.result, err
+		}
+		if err := s.ackInteractive(); err != nil {
+			return s.result, err
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package sevStep
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBatchSession_Run(t *testing.T) {
+	//each access goes to a different page, thus every access faults exactly once
+	script := make([]GuestAccess, 0)
+	wantGPAs := make([]uint64, 0)
+	for i := uint64(0); i < 12; i++ {
+		script = append(script, GuestAccess{GPA: i << pageShift, Kind: AccessExec, RetiredInstructions: 3})
+		wantGPAs = append(wantGPAs, i<<pageShift)
+	}
+
+	tests := []struct {
+		name            string
+		accessesPerCall int
+		wantGPAs        []uint64
+		wantGaps        []BatchGap
+		wantBatches     int
+	}{
+		{
+			name:            "Rotation before overflow",
+			accessesPerCall: 1,
+			wantGPAs:        wantGPAs,
+			wantGaps:        []BatchGap{},
+			wantBatches:     3,
+		},
+		{
+			name:            "Overflow",
+			accessesPerCall: 0,
+			wantGPAs:        wantGPAs[:4],
+			wantGaps:        []BatchGap{{Position: 4, Batch: 0, Lost: 8, Reason: BatchGapOverflow}},
+			wantBatches:     2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewSimulatedVM(16, script, false)
+			vm.AccessesPerCall = tt.accessesPerCall
+			if err := vm.CmdTrackAllPages(PageTrackExec); err != nil {
+				t.Fatalf("CmdTrackAllPages failed : %v", err)
+			}
+
+			session := NewBatchSession(vm, PageTrackExec, 4, 0, false)
+			session.Headroom = 1
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				for !vm.GuestDone() {
+					time.Sleep(time.Millisecond)
+				}
+				cancel()
+			}()
+
+			got, err := session.Run(ctx)
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if gotGPAs := faultedGPAs(got.Events); !reflect.DeepEqual(gotGPAs, tt.wantGPAs) {
+				t.Errorf("Run() events = %x, want %x", gotGPAs, tt.wantGPAs)
+			}
+			for i, v := range got.Events {
+				if v.ID != uint64(i) {
+					t.Errorf("event %d has ID %d", i, v.ID)
+				}
+			}
+			if !reflect.DeepEqual(got.Gaps, tt.wantGaps) {
+				t.Errorf("Run() gaps = %v, want %v", got.Gaps, tt.wantGaps)
+			}
+			if got.Batches != tt.wantBatches {
+				t.Errorf("Run() batches = %v, want %v", got.Batches, tt.wantBatches)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package sevStep
+
+import (
+	"fmt"
+)
+
+//MemoryRegion is a range of guest memory captured for an event
+type MemoryRegion struct {
+	GPA     uint64    `json:"gpa"`
+	Content jsonBytes `json:"content"`
+}
+
+//CaptureRange describes a range of guest memory that is read for each event
+type CaptureRange struct {
+	//GPA of the first byte. If RelativeToFault is set, this is an offset to the start of the faulted page
+	GPA  uint64
+	Size uint64
+	//RelativeToFault selects whether GPA is absolute or relative to the faulted page
+	RelativeToFault bool
+}
+
+//resolve returns the absolute GPA of the range for ev
+func (r CaptureRange) resolve(ev *Event) uint64 {
+	if r.RelativeToFault {
+		return (ev.FaultedGPA &^ (pageSize - 1)) + r.GPA
+	}
+	return r.GPA
+}
+
+//CapturePolicy configures which guest memory is read for each event, while the VM is still
+//blocked on the event. The first captured region is also stored in Event.MonitorGPA and Event.Content
+type CapturePolicy struct {
+	//Ranges are read for every event
+	Ranges []CaptureRange
+	//Derive, if set, returns additional ranges for ev, e.g. based on ev.FaultedGPA. They are read after Ranges
+	Derive func(ev *Event) []CaptureRange
+	//View selects whether the memory is read as ciphertext or decrypted with the host key
+	View MemoryView
+	//WbinvdCPU is passed to CmdReadGuestMemory. Defaults to -1, i.e. no cache flush
+	WbinvdCPU int
+}
+
+//NewCapturePolicy creates a CapturePolicy reading ranges with the given view
+func NewCapturePolicy(view MemoryView, ranges ...CaptureRange) *CapturePolicy {
+	return &CapturePolicy{
+		Ranges:    ranges,
+		View:      view,
+		WbinvdCPU: -1,
+	}
+}
+
+//Capture reads all ranges for ev and appends them to ev.Regions. Reads may span multiple pages
+func (p *CapturePolicy) Capture(tracker Tracker, ev *Event) error {
+	ranges := p.Ranges
+	if p.Derive != nil {
+		ranges = append(append([]CaptureRange{}, p.Ranges...), p.Derive(ev)...)
+	}
+	mem := NewGuestMemory(tracker, p.View, false)
+	mem.WbinvdCPU = p.WbinvdCPU
+	for _, r := range ranges {
+		gpa := r.resolve(ev)
+		content := make([]byte, r.Size)
+		if _, err := mem.ReadAt(content, int64(gpa)); err != nil {
+			return fmt.Errorf("failed to capture 0x%x bytes at 0x%x for event %v : %w", r.Size, gpa, ev.ID, err)
+		}
+		ev.Regions = append(ev.Regions, MemoryRegion{GPA: gpa, Content: content})
+	}
+	if len(ev.Regions) > 0 && ev.MonitorGPA == 0 && ev.Content == nil {
+		ev.MonitorGPA = ev.Regions[0].GPA
+		ev.Content = ev.Regions[0].Content
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package sevStep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestCapturePolicy_EventLoop(t *testing.T) {
+	vm := NewSimulatedVM(4, []GuestAccess{
+		{GPA: 0x1008, Kind: AccessWrite, Data: []byte{0xaa}},
+		{GPA: 0x2000, Kind: AccessRead},
+	}, false)
+	if err := vm.WriteGuestMemory(0x1008, []byte{0x11}); err != nil {
+		t.Fatalf("WriteGuestMemory failed : %v", err)
+	}
+	if err := vm.WriteGuestMemory(0x2ffe, []byte{0x22, 0x23, 0x24, 0x25}); err != nil {
+		t.Fatalf("WriteGuestMemory failed : %v", err)
+	}
+	if err := vm.CmdTrackAllPages(PageTrackAccess); err != nil {
+		t.Fatalf("CmdTrackAllPages failed : %v", err)
+	}
+
+	loop := NewEventLoop(vm)
+	loop.Capture = NewCapturePolicy(MemoryViewHostDecrypted, CaptureRange{GPA: 0x8, Size: 1, RelativeToFault: true})
+	loop.Capture.Derive = func(ev *Event) []CaptureRange {
+		if ev.FaultedGPA != 0x2000 {
+			return nil
+		}
+		//crosses into the next page
+		return []CaptureRange{{GPA: 0x2ffe, Size: 4}}
+	}
+
+	got := make([]*Event, 0)
+	err := loop.Run(context.Background(), func(ev *Event) (EventAction, error) {
+		got = append(got, ev)
+		if len(got) == 2 {
+			return EventActionStop, nil
+		}
+		return EventActionAck, nil
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	want := [][]MemoryRegion{
+		//captured before the write completes
+		{{GPA: 0x1008, Content: []byte{0x11}}},
+		{{GPA: 0x2008, Content: []byte{0x0}}, {GPA: 0x2ffe, Content: []byte{0x22, 0x23, 0x24, 0x25}}},
+	}
+	for i, ev := range got {
+		if !reflect.DeepEqual(ev.Regions, want[i]) {
+			t.Errorf("event %d has regions %v, want %v", i, ev.Regions, want[i])
+		}
+		if !ev.HasAccessData() || ev.MonitorGPA != want[i][0].GPA || !bytes.Equal(ev.Content, want[i][0].Content) {
+			t.Errorf("event %d has MonitorGPA 0x%x and Content %x, want first region", i, ev.MonitorGPA, ev.Content)
+		}
+
+		buf, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatalf("failed to marshal event : %v", err)
+		}
+		decoded, err := ParseEventFromJSON(string(buf))
+		if err != nil {
+			t.Fatalf("ParseEventFromJSON failed : %v", err)
+		}
+		if !reflect.DeepEqual(decoded.Regions, want[i]) {
+			t.Errorf("decoded event %d has regions %v, want %v", i, decoded.Regions, want[i])
+		}
+	}
+}
+
+func TestCapturePolicy_Capture_Error(t *testing.T) {
+	vm := NewSimulatedVM(1, nil, false)
+	policy := NewCapturePolicy(MemoryViewCiphertext, CaptureRange{GPA: 0x1000, Size: 8})
+	err := policy.Capture(vm, &Event{FaultedGPA: 0})
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Capture() outside of guest memory got err = %v, want EINVAL", err)
+	}
+}
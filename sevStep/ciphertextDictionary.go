@@ -0,0 +1,320 @@
+package sevStep
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+//ciphertextDictionaryVersion is the version of the persisted dictionary format
+const ciphertextDictionaryVersion = 1
+
+//DictionaryEntry maps the ciphertext of a 16 byte block at GPA to the plaintexts it was trained with
+type DictionaryEntry struct {
+	GPA        uint64    `json:"gpa"`
+	Ciphertext jsonBytes `json:"ciphertext"`
+	//Plaintexts learned for Ciphertext. More than one plaintext means that the training data
+	//contains a collision, e.g. due to wrong labels or a changed encryption key
+	Plaintexts []jsonBytes `json:"plaintexts"`
+	//Samples is the number of training samples for this entry
+	Samples uint64 `json:"samples"`
+}
+
+//Collision returns true if the entry maps to multiple plaintexts
+func (e *DictionaryEntry) Collision() bool {
+	return len(e.Plaintexts) > 1
+}
+
+//DictionaryMatch is the result of looking up a single ciphertext block
+type DictionaryMatch struct {
+	GPA        uint64
+	Ciphertext []byte
+	//Plaintexts is empty if the ciphertext is unknown and contains multiple entries on a collision
+	Plaintexts []jsonBytes
+}
+
+//Known returns true if the ciphertext maps to exactly one plaintext
+func (m DictionaryMatch) Known() bool {
+	return len(m.Plaintexts) == 1
+}
+
+//Plaintext returns the plaintext if the match is Known
+func (m DictionaryMatch) Plaintext() ([]byte, bool) {
+	if !m.Known() {
+		return nil, false
+	}
+	return m.Plaintexts[0], true
+}
+
+//DictionaryStats summarizes the content and the lookups of a CiphertextDictionary
+type DictionaryStats struct {
+	Entries    int
+	Collisions int
+	Lookups    uint64
+	//Unknown is the number of lookups for ciphertexts that are not in the dictionary
+	Unknown uint64
+}
+
+//CiphertextDictionary maps observed ciphertext blocks to known plaintexts. As the SEV memory
+//encryption is deterministic for a fixed physical address, a ciphertext observed at a GPA
+//reveals the plaintext once the pair has been seen during a training phase.
+//CiphertextDictionary is safe for concurrent use
+type CiphertextDictionary struct {
+	mu sync.Mutex
+	//entries by block GPA and ciphertext
+	entries map[uint64]map[string]*DictionaryEntry
+	lookups uint64
+	unknown uint64
+}
+
+//NewCiphertextDictionary creates an empty dictionary
+func NewCiphertextDictionary() *CiphertextDictionary {
+	return &CiphertextDictionary{
+		entries: make(map[uint64]map[string]*DictionaryEntry),
+	}
+}
+
+//checkBlock validates that gpa and data describe a single, aligned block
+func checkBlock(gpa uint64, data []byte) error {
+	if gpa%ciphertextBlockSize != 0 {
+		return fmt.Errorf("gpa 0x%x is not aligned to %d bytes", gpa, ciphertextBlockSize)
+	}
+	if len(data) != ciphertextBlockSize {
+		return fmt.Errorf("block at 0x%x has %d bytes, want %d", gpa, len(data), ciphertextBlockSize)
+	}
+	return nil
+}
+
+//Train adds the observation that the block at gpa with the given ciphertext contains plaintext
+func (d *CiphertextDictionary) Train(gpa uint64, ciphertext, plaintext []byte) error {
+	if err := checkBlock(gpa, ciphertext); err != nil {
+		return err
+	}
+	if err := checkBlock(gpa, plaintext); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.train(gpa, ciphertext, plaintext)
+	return nil
+}
+
+//train requires d.mu to be held
+func (d *CiphertextDictionary) train(gpa uint64, ciphertext, plaintext []byte) {
+	if d.entries[gpa] == nil {
+		d.entries[gpa] = make(map[string]*DictionaryEntry)
+	}
+	entry, ok := d.entries[gpa][string(ciphertext)]
+	if !ok {
+		entry = &DictionaryEntry{
+			GPA:        gpa,
+			Ciphertext: append([]byte{}, ciphertext...),
+			Plaintexts: make([]jsonBytes, 0, 1),
+		}
+		d.entries[gpa][string(ciphertext)] = entry
+	}
+	entry.Samples++
+	for _, v := range entry.Plaintexts {
+		if bytes.Equal(v, plaintext) {
+			return
+		}
+	}
+	entry.Plaintexts = append(entry.Plaintexts, append([]byte{}, plaintext...))
+}
+
+//TrainRegion trains all blocks of content, captured at gpa, with the corresponding blocks of
+//plaintext. Only blocks that are fully contained in content are used
+func (d *CiphertextDictionary) TrainRegion(gpa uint64, content, plaintext []byte) error {
+	if len(content) != len(plaintext) {
+		return fmt.Errorf("content has %d bytes but plaintext has %d", len(content), len(plaintext))
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	firstBlock := (gpa + ciphertextBlockSize - 1) &^ (ciphertextBlockSize - 1)
+	for blockGPA := firstBlock; blockGPA+ciphertextBlockSize <= gpa+uint64(len(content)); blockGPA += ciphertextBlockSize {
+		offset := blockGPA - gpa
+		d.train(blockGPA, content[offset:offset+ciphertextBlockSize], plaintext[offset:offset+ciphertextBlockSize])
+	}
+	return nil
+}
+
+//TrainEvent trains all captured regions of ev, like DecodeEvent decodes them. plaintexts holds
+//the known plaintext of each region, in the order of ev.Regions. If ev has no regions, MonitorGPA
+//and Content are trained with a single plaintext
+func (d *CiphertextDictionary) TrainEvent(ev *Event, plaintexts ...[]byte) error {
+	regions := ev.Regions
+	if len(regions) == 0 {
+		if !ev.HasAccessData() {
+			return fmt.Errorf("event %v has no captured memory", ev.ID)
+		}
+		regions = []MemoryRegion{{GPA: ev.MonitorGPA, Content: ev.Content}}
+	}
+	if len(plaintexts) != len(regions) {
+		return fmt.Errorf("event %v has %d captured regions but got %d plaintexts", ev.ID, len(regions), len(plaintexts))
+	}
+	for i, v := range regions {
+		if err := d.TrainRegion(v.GPA, v.Content, plaintexts[i]); err != nil {
+			return fmt.Errorf("event %v, region 0x%x : %w", ev.ID, v.GPA, err)
+		}
+	}
+	return nil
+}
+
+//Lookup returns the plaintexts for ciphertext at gpa
+func (d *CiphertextDictionary) Lookup(gpa uint64, ciphertext []byte) (DictionaryMatch, error) {
+	if err := checkBlock(gpa, ciphertext); err != nil {
+		return DictionaryMatch{}, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lookup(gpa, ciphertext), nil
+}
+
+//lookup requires d.mu to be held
+func (d *CiphertextDictionary) lookup(gpa uint64, ciphertext []byte) DictionaryMatch {
+	d.lookups++
+	match := DictionaryMatch{
+		GPA:        gpa,
+		Ciphertext: append([]byte{}, ciphertext...),
+		Plaintexts: []jsonBytes{},
+	}
+	entry, ok := d.entries[gpa][string(ciphertext)]
+	if !ok {
+		d.unknown++
+		return match
+	}
+	match.Plaintexts = append(match.Plaintexts, entry.Plaintexts...)
+	return match
+}
+
+//Decode looks up all blocks of content, captured at gpa. Only blocks that are fully contained
+//in content are considered
+func (d *CiphertextDictionary) Decode(gpa uint64, content []byte) []DictionaryMatch {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := make([]DictionaryMatch, 0)
+	firstBlock := (gpa + ciphertextBlockSize - 1) &^ (ciphertextBlockSize - 1)
+	for blockGPA := firstBlock; blockGPA+ciphertextBlockSize <= gpa+uint64(len(content)); blockGPA += ciphertextBlockSize {
+		offset := blockGPA - gpa
+		res = append(res, d.lookup(blockGPA, content[offset:offset+ciphertextBlockSize]))
+	}
+	return res
+}
+
+//DecodeEvent looks up all captured regions of ev. If ev has no regions, MonitorGPA and Content are used
+func (d *CiphertextDictionary) DecodeEvent(ev *Event) []DictionaryMatch {
+	if len(ev.Regions) == 0 {
+		if !ev.HasAccessData() {
+			return []DictionaryMatch{}
+		}
+		return d.Decode(ev.MonitorGPA, ev.Content)
+	}
+	res := make([]DictionaryMatch, 0)
+	for _, v := range ev.Regions {
+		res = append(res, d.Decode(v.GPA, v.Content)...)
+	}
+	return res
+}
+
+//Entries returns all entries, sorted by GPA and ciphertext
+func (d *CiphertextDictionary) Entries() []*DictionaryEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sortedEntries(false)
+}
+
+//Collisions returns all entries that map to multiple plaintexts, sorted by GPA and ciphertext
+func (d *CiphertextDictionary) Collisions() []*DictionaryEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sortedEntries(true)
+}
+
+//sortedEntries returns copies of the entries. Requires d.mu to be held
+func (d *CiphertextDictionary) sortedEntries(onlyCollisions bool) []*DictionaryEntry {
+	res := make([]*DictionaryEntry, 0)
+	for _, byCiphertext := range d.entries {
+		for _, v := range byCiphertext {
+			if onlyCollisions && !v.Collision() {
+				continue
+			}
+			entry := *v
+			entry.Plaintexts = append([]jsonBytes{}, v.Plaintexts...)
+			res = append(res, &entry)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].GPA != res[j].GPA {
+			return res[i].GPA < res[j].GPA
+		}
+		return bytes.Compare(res[i].Ciphertext, res[j].Ciphertext) < 0
+	})
+	return res
+}
+
+//Stats returns the number of entries and collisions as well as the lookup statistics
+func (d *CiphertextDictionary) Stats() DictionaryStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := DictionaryStats{
+		Lookups: d.lookups,
+		Unknown: d.unknown,
+	}
+	for _, byCiphertext := range d.entries {
+		for _, v := range byCiphertext {
+			stats.Entries++
+			if v.Collision() {
+				stats.Collisions++
+			}
+		}
+	}
+	return stats
+}
+
+//persistedDictionary is the on disk format of CiphertextDictionary
+type persistedDictionary struct {
+	Version int                `json:"version"`
+	Entries []*DictionaryEntry `json:"entries"`
+}
+
+//Save writes the dictionary as JSON to w. Lookup statistics are not saved
+func (d *CiphertextDictionary) Save(w io.Writer) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(persistedDictionary{Version: ciphertextDictionaryVersion, Entries: d.sortedEntries(false)}); err != nil {
+		return fmt.Errorf("failed to encode dictionary : %w", err)
+	}
+	return nil
+}
+
+//LoadCiphertextDictionary reads a dictionary written by CiphertextDictionary.Save
+func LoadCiphertextDictionary(r io.Reader) (*CiphertextDictionary, error) {
+	persisted := persistedDictionary{}
+	if err := json.NewDecoder(r).Decode(&persisted); err != nil {
+		return nil, fmt.Errorf("failed to decode dictionary : %w", err)
+	}
+	if persisted.Version != ciphertextDictionaryVersion {
+		return nil, fmt.Errorf("unsupported dictionary version %d", persisted.Version)
+	}
+	d := NewCiphertextDictionary()
+	for _, v := range persisted.Entries {
+		if err := checkBlock(v.GPA, v.Ciphertext); err != nil {
+			return nil, fmt.Errorf("invalid entry : %w", err)
+		}
+		for _, plaintext := range v.Plaintexts {
+			if err := checkBlock(v.GPA, plaintext); err != nil {
+				return nil, fmt.Errorf("invalid plaintext : %w", err)
+			}
+		}
+		if d.entries[v.GPA] == nil {
+			d.entries[v.GPA] = make(map[string]*DictionaryEntry)
+		}
+		d.entries[v.GPA][string(v.Ciphertext)] = v
+	}
+	return d, nil
+}
@@ -0,0 +1,135 @@
+package sevStep
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//testEncryptBlock is a deterministic, address dependent stand-in for the SEV memory encryption
+func testEncryptBlock(gpa uint64, block []byte) []byte {
+	res := make([]byte, len(block))
+	for i := range block {
+		res[i] = block[i] ^ byte(gpa>>4) ^ byte(i*7)
+	}
+	return res
+}
+
+func TestCiphertextDictionary(t *testing.T) {
+	plaintext := func(v byte) []byte {
+		return append(make([]byte, ciphertextBlockSize-1), v)
+	}
+	d := NewCiphertextDictionary()
+	for v := byte(0); v < 4; v++ {
+		ev := &Event{
+			ID:         uint64(v),
+			MonitorGPA: 0x1000,
+			Content:    append(testEncryptBlock(0x1000, plaintext(v)), testEncryptBlock(0x1010, plaintext(0))...),
+		}
+		if err := d.TrainEvent(ev, append(plaintext(v), plaintext(0)...)); err != nil {
+			t.Fatalf("TrainEvent failed : %v", err)
+		}
+	}
+	//a wrong label causes a collision
+	if err := d.Train(0x1010, testEncryptBlock(0x1010, plaintext(0)), plaintext(1)); err != nil {
+		t.Fatalf("Train failed : %v", err)
+	}
+	if err := d.Train(0x1008, make([]byte, 16), make([]byte, 16)); err == nil {
+		t.Errorf("Train with unaligned gpa did not fail")
+	}
+
+	//the same plaintext at a different address is unknown
+	matches := d.DecodeEvent(&Event{
+		Regions: []MemoryRegion{
+			{GPA: 0x1000, Content: testEncryptBlock(0x1000, plaintext(2))},
+			{GPA: 0x1010, Content: testEncryptBlock(0x1010, plaintext(0))},
+			{GPA: 0x1020, Content: testEncryptBlock(0x1020, plaintext(2))},
+		},
+	})
+	if len(matches) != 3 {
+		t.Fatalf("DecodeEvent() got %d matches, want 3", len(matches))
+	}
+	if got, ok := matches[0].Plaintext(); !ok || !bytes.Equal(got, plaintext(2)) {
+		t.Errorf("match 0 got = %x, %v, want %x", got, ok, plaintext(2))
+	}
+	if matches[1].Known() || len(matches[1].Plaintexts) != 2 {
+		t.Errorf("match 1 got plaintexts %x, want collision", matches[1].Plaintexts)
+	}
+	if matches[2].Known() || len(matches[2].Plaintexts) != 0 {
+		t.Errorf("match 2 got plaintexts %x, want unknown", matches[2].Plaintexts)
+	}
+
+	wantStats := DictionaryStats{Entries: 5, Collisions: 1, Lookups: 3, Unknown: 1}
+	if got := d.Stats(); got != wantStats {
+		t.Errorf("Stats() = %+v, want %+v", got, wantStats)
+	}
+	if got := d.Collisions(); len(got) != 1 || got[0].GPA != 0x1010 || got[0].Samples != 5 {
+		t.Errorf("Collisions() = %v", got)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := d.Save(buf); err != nil {
+		t.Fatalf("Save failed : %v", err)
+	}
+	loaded, err := LoadCiphertextDictionary(buf)
+	if err != nil {
+		t.Fatalf("LoadCiphertextDictionary failed : %v", err)
+	}
+	if !reflect.DeepEqual(loaded.Entries(), d.Entries()) {
+		t.Errorf("loaded entries = %v, want %v", loaded.Entries(), d.Entries())
+	}
+	match, err := loaded.Lookup(0x1000, testEncryptBlock(0x1000, plaintext(3)))
+	if got, ok := match.Plaintext(); err != nil || !ok || !bytes.Equal(got, plaintext(3)) {
+		t.Errorf("Lookup() on loaded dictionary got = %x, %v, %v", got, ok, err)
+	}
+}
+
+func TestCiphertextDictionary_TrainEvent(t *testing.T) {
+	block := func(v byte) []byte {
+		return bytes.Repeat([]byte{v}, ciphertextBlockSize)
+	}
+	ev := &Event{
+		MonitorGPA: 0x1000,
+		Content:    testEncryptBlock(0x1000, block(1)),
+		Regions: []MemoryRegion{
+			{GPA: 0x1000, Content: testEncryptBlock(0x1000, block(1))},
+			{GPA: 0x2010, Content: testEncryptBlock(0x2010, block(2))},
+		},
+	}
+	d := NewCiphertextDictionary()
+	if err := d.TrainEvent(ev, block(1)); err == nil {
+		t.Errorf("TrainEvent with too few plaintexts did not fail")
+	}
+	if err := d.TrainEvent(ev, block(1), block(2)); err != nil {
+		t.Fatalf("TrainEvent failed : %v", err)
+	}
+	for i, match := range d.DecodeEvent(ev) {
+		if got, ok := match.Plaintext(); !ok || !bytes.Equal(got, block(byte(i+1))) {
+			t.Errorf("match %d got = %x, %v, want %x", i, got, ok, block(byte(i+1)))
+		}
+	}
+	if err := d.TrainEvent(&Event{ID: 1}, block(1)); err == nil {
+		t.Errorf("TrainEvent without captured memory did not fail")
+	}
+}
+
+func TestLoadCiphertextDictionary_Invalid(t *testing.T) {
+	block := strings.Repeat("00", ciphertextBlockSize)
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "version", input: `{"version": 2, "entries": []}`},
+		{name: "unaligned gpa", input: `{"version": 1, "entries": [{"gpa": 8, "ciphertext": "` + block + `", "plaintexts": []}]}`},
+		{name: "short ciphertext", input: `{"version": 1, "entries": [{"gpa": 16, "ciphertext": "00", "plaintexts": []}]}`},
+		{name: "short plaintext", input: `{"version": 1, "entries": [{"gpa": 16, "ciphertext": "` + block + `", "plaintexts": ["` + block + `", "0000"]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadCiphertextDictionary(strings.NewReader(tt.input)); err == nil {
+				t.Errorf("LoadCiphertextDictionary() did not fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package sevStep
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//ciphertextBlockSize is the granularity of the SEV memory encryption. The ciphertext of a block
+//changes iff its plaintext is written
+const ciphertextBlockSize = 16
+
+//BlockChange describes a 16 byte ciphertext block that changed between two observations
+type BlockChange struct {
+	//EventID is the id of the event at which the change was observed
+	EventID uint64 `json:"event_id"`
+	//GPA of the first byte of the block
+	GPA uint64 `json:"gpa"`
+	//Offset of the block inside its page
+	Offset uint64    `json:"offset"`
+	Old    jsonBytes `json:"old"`
+	New    jsonBytes `json:"new"`
+}
+
+func (c BlockChange) String() string {
+	return fmt.Sprintf("Event %d, GPA 0x%x (offset 0x%x), %x -> %x", c.EventID, c.GPA, c.Offset, []byte(c.Old), []byte(c.New))
+}
+
+//CiphertextMonitor tracks the ciphertext of 16 byte blocks across a sequence of captures, e.g.
+//Event.Content or repeated CmdReadGuestMemory calls, and reports which blocks changed.
+//The first observation of a block is its baseline and never reported as a change.
+//CiphertextMonitor is safe for concurrent use
+type CiphertextMonitor struct {
+	mu sync.Mutex
+	//last is the most recently observed ciphertext of each block, by block GPA
+	last map[uint64][]byte
+	//timeline are all changes of each block, by block GPA
+	timeline map[uint64][]BlockChange
+}
+
+//NewCiphertextMonitor creates a CiphertextMonitor without any baseline
+func NewCiphertextMonitor() *CiphertextMonitor {
+	return &CiphertextMonitor{
+		last:     make(map[uint64][]byte),
+		timeline: make(map[uint64][]BlockChange),
+	}
+}
+
+//Observe compares content, captured at gpa while handling event eventID, to the previous
+//observation and returns the changed blocks in ascending order. Only blocks that are fully
+//contained in content are considered
+func (m *CiphertextMonitor) Observe(eventID, gpa uint64, content []byte) []BlockChange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changes := make([]BlockChange, 0)
+	firstBlock := (gpa + ciphertextBlockSize - 1) &^ (ciphertextBlockSize - 1)
+	for blockGPA := firstBlock; blockGPA+ciphertextBlockSize <= gpa+uint64(len(content)); blockGPA += ciphertextBlockSize {
+		block := content[blockGPA-gpa : blockGPA-gpa+ciphertextBlockSize]
+		old, ok := m.last[blockGPA]
+		if ok && bytes.Equal(old, block) {
+			continue
+		}
+		current := append([]byte{}, block...)
+		m.last[blockGPA] = current
+		if !ok {
+			continue
+		}
+		change := BlockChange{
+			EventID: eventID,
+			GPA:     blockGPA,
+			Offset:  blockGPA & (pageSize - 1),
+			Old:     old,
+			New:     current,
+		}
+		changes = append(changes, change)
+		m.timeline[blockGPA] = append(m.timeline[blockGPA], change)
+	}
+	return changes
+}
+
+//ObserveEvent observes all captured regions of ev. If ev has no regions, MonitorGPA and Content are used
+func (m *CiphertextMonitor) ObserveEvent(ev *Event) []BlockChange {
+	if len(ev.Regions) == 0 {
+		if !ev.HasAccessData() {
+			return []BlockChange{}
+		}
+		return m.Observe(ev.ID, ev.MonitorGPA, ev.Content)
+	}
+	changes := make([]BlockChange, 0)
+	for _, v := range ev.Regions {
+		changes = append(changes, m.Observe(ev.ID, v.GPA, v.Content)...)
+	}
+	return changes
+}
+
+//Watch observes all events from events, e.g. from EventLoop.Events, and streams the changes on
+//the returned channel. The channel is closed once events is closed or ctx is done. Cancel ctx
+//to stop the goroutine if you stop reading the changes
+func (m *CiphertextMonitor) Watch(ctx context.Context, events <-chan *Event) <-chan BlockChange {
+	changes := make(chan BlockChange)
+	go func() {
+		defer close(changes)
+		for {
+			var ev *Event
+			select {
+			case <-ctx.Done():
+				return
+			case v, ok := <-events:
+				if !ok {
+					return
+				}
+				ev = v
+			}
+			for _, v := range m.ObserveEvent(ev) {
+				select {
+				case changes <- v:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes
+}
+
+//Blocks returns the GPAs of all blocks that changed at least once, in ascending order
+func (m *CiphertextMonitor) Blocks() []uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]uint64, 0, len(m.timeline))
+	for gpa := range m.timeline {
+		res = append(res, gpa)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
+
+//Timeline returns all changes of the block at blockGPA in the order they were observed
+func (m *CiphertextMonitor) Timeline(blockGPA uint64) []BlockChange {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]BlockChange{}, m.timeline[blockGPA&^(ciphertextBlockSize-1)]...)
+}
+
+//Reset drops all baselines and timelines
+func (m *CiphertextMonitor) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last = make(map[uint64][]byte)
+	m.timeline = make(map[uint64][]BlockChange)
+}
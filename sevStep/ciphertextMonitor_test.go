@@ -0,0 +1,100 @@
+package sevStep
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCiphertextMonitor_Observe(t *testing.T) {
+	content := func(values map[int]byte) []byte {
+		buf := make([]byte, 0x40)
+		for offset, v := range values {
+			buf[offset] = v
+		}
+		return buf
+	}
+	captures := [][]byte{
+		content(nil),
+		content(map[int]byte{0x12: 1}),
+		content(map[int]byte{0x12: 1, 0x30: 2, 0x3f: 3}),
+		content(map[int]byte{0x12: 4, 0x30: 2, 0x3f: 3}),
+	}
+	wantGPAs := [][]uint64{
+		{},
+		{0x1010},
+		{0x1030},
+		{0x1010},
+	}
+
+	m := NewCiphertextMonitor()
+	for i, v := range captures {
+		changes := m.Observe(uint64(i), 0x1000, v)
+		gotGPAs := make([]uint64, 0)
+		for _, c := range changes {
+			gotGPAs = append(gotGPAs, c.GPA)
+			if c.EventID != uint64(i) || c.Offset != c.GPA&0xfff || len(c.Old) != ciphertextBlockSize || bytes.Equal(c.Old, c.New) {
+				t.Errorf("capture %d got invalid change %v", i, c)
+			}
+		}
+		if !reflect.DeepEqual(gotGPAs, wantGPAs[i]) {
+			t.Errorf("capture %d got changed blocks %x, want %x", i, gotGPAs, wantGPAs[i])
+		}
+	}
+
+	if got := m.Blocks(); !reflect.DeepEqual(got, []uint64{0x1010, 0x1030}) {
+		t.Errorf("Blocks() = %x", got)
+	}
+	timeline := m.Timeline(0x1012)
+	if len(timeline) != 2 || timeline[0].EventID != 1 || timeline[1].EventID != 3 ||
+		timeline[1].Old[2] != 1 || timeline[1].New[2] != 4 {
+		t.Errorf("Timeline() = %v", timeline)
+	}
+
+	//partial blocks are ignored
+	if changes := m.Observe(4, 0x1008, make([]byte, 0x10)); len(changes) != 0 {
+		t.Errorf("Observe() on partial blocks got changes %v", changes)
+	}
+}
+
+func TestCiphertextMonitor_Watch(t *testing.T) {
+	events := make(chan *Event, 3)
+	events <- &Event{ID: 2, Regions: []MemoryRegion{{GPA: 0x2000, Content: make([]byte, 16)}}}
+	events <- &Event{ID: 3, MonitorGPA: 0x2000, Content: append(make([]byte, 15), 1)}
+	events <- &Event{ID: 4}
+	close(events)
+
+	got := make([]BlockChange, 0)
+	for v := range NewCiphertextMonitor().Watch(context.Background(), events) {
+		got = append(got, v)
+	}
+	if len(got) != 1 || got[0].EventID != 3 || got[0].GPA != 0x2000 {
+		t.Errorf("Watch() got = %v, want one change in event 3", got)
+	}
+}
+
+func TestCiphertextMonitor_Watch_Cancel(t *testing.T) {
+	events := make(chan *Event, 2)
+	events <- &Event{ID: 1, MonitorGPA: 0x1000, Content: make([]byte, 32)}
+	events <- &Event{ID: 2, MonitorGPA: 0x1000, Content: bytes.Repeat([]byte{1}, 32)}
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := NewCiphertextMonitor().Watch(ctx, events)
+	//stop reading while the second event has unsent changes
+	if _, ok := <-changes; !ok {
+		t.Fatalf("Watch() closed the channel before the first change")
+	}
+	cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Watch() did not close the channel after cancel")
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package sevStep
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+//Names of the ioctls, as used in IoctlError.Name
+const (
+	ioctlNameTrackPage            = "KVM_TRACK_PAGE"
+	ioctlNameRegisterPID          = "KVM_USPT_REGISTER_PID"
+	ioctlNamePollEvent            = "KVM_USPT_POLL_EVENT"
+	ioctlNameAckEvent             = "KVM_USPT_ACK_EVENT"
+	ioctlNameReadGuestMemory      = "KVM_READ_GUEST_MEMORY"
+	ioctlNameReset                = "KVM_USPT_RESET"
+	ioctlNameTrackAll             = "KVM_USPT_TRACK_ALL"
+	ioctlNameUntrackAll           = "KVM_USPT_UNTRACK_ALL"
+	ioctlNameSetupRetInstrPerf    = "KVM_USPT_SETUP_RETINSTR_PERF"
+	ioctlNameReadRetInstrPerf     = "KVM_USPT_READ_RETINSTR_PERF"
+	ioctlNameBatchTrackStart      = "KVM_USPT_BATCH_TRACK_START"
+	ioctlNameBatchTrackStop       = "KVM_USPT_BATCH_TRACK_STOP"
+	ioctlNameBatchTrackEventCount = "KVM_USPT_BATCH_TRACK_EVENT_COUNT"
+)
+
+//Non zero return values used by the kernel patch to signal errors without setting errno
+const (
+	//ackEventReturnIDMismatch is returned by KVM_USPT_ACK_EVENT if the id is not the last sent id
+	ackEventReturnIDMismatch = 1
+	//batchTrackStartReturnAllocError is returned by KVM_USPT_BATCH_TRACK_START if the buffer allocation failed
+	batchTrackStartReturnAllocError = 1
+)
+
+var (
+	//ErrVMNotStarted means that the kernel has no VM to operate on (main_vm is NULL).
+	//Start the VM before using the api
+	ErrVMNotStarted = errors.New("no VM started")
+	//ErrNotRegistered means that the api was not registered with KVM_USPT_REGISTER_PID,
+	//or that it was reset with KVM_USPT_RESET
+	ErrNotRegistered = errors.New("api not registered")
+	//ErrInvalidTrackMode means that a PageTrackMode was out of range.
+	//This is checked before issuing the ioctl
+	ErrInvalidTrackMode = errors.New("invalid track mode")
+	//ErrBatchNotActive means that batch tracking was stopped while it was not active. The kernel
+	//uses the same error if more events were requested than recorded or if the buffer allocation failed
+	ErrBatchNotActive = errors.New("batch tracking not active")
+	//ErrAckMismatch means that the acknowledged id does not belong to the last sent event
+	ErrAckMismatch = errors.New("ack does not match last sent event")
+)
+
+//IoctlError is returned by the Cmd* methods if an ioctl fails. Use errors.Is with the Err*
+//sentinels to check for common conditions or errors.As to access the details.
+//IoctlError also unwraps to its Errno
+type IoctlError struct {
+	//Name of the ioctl, e.g. KVM_TRACK_PAGE
+	Name string `json:"name"`
+	//Request is the ioctl request number. Zero for backends that do not issue ioctls
+	Request uintptr `json:"request,omitempty"`
+	//Errno is the error number set by the ioctl. Zero if the failure was only signaled by ReturnValue
+	Errno syscall.Errno `json:"errno,omitempty"`
+	//ReturnValue is the return value of the ioctl
+	ReturnValue uintptr `json:"return_value,omitempty"`
+}
+
+func (e *IoctlError) Error() string {
+	if e.Errno == 0 {
+		return fmt.Sprintf("%s ioctl failed with return value %d", e.Name, e.ReturnValue)
+	}
+	return fmt.Sprintf("%s ioctl failed with errno %v", e.Name, e.Errno)
+}
+
+func (e *IoctlError) Unwrap() error {
+	if e.Errno == 0 {
+		return nil
+	}
+	return e.Errno
+}
+
+//sentinel classifies the error, based on the error paths of the kernel patch
+func (e *IoctlError) sentinel() error {
+	switch e.Name {
+	case ioctlNameTrackPage, ioctlNameTrackAll, ioctlNameUntrackAll, ioctlNameRegisterPID:
+		if e.Errno == syscall.EFAULT {
+			return ErrVMNotStarted
+		}
+	case ioctlNamePollEvent:
+		if e.Errno == syscall.EINVAL {
+			return ErrNotRegistered
+		}
+	case ioctlNameAckEvent:
+		if e.Errno == syscall.EINVAL {
+			return ErrNotRegistered
+		}
+		if e.Errno == 0 && e.ReturnValue == ackEventReturnIDMismatch {
+			return ErrAckMismatch
+		}
+	case ioctlNameBatchTrackStop:
+		if e.Errno == syscall.EFAULT {
+			return ErrBatchNotActive
+		}
+	}
+	return nil
+}
+
+//Is reports whether e belongs to the condition described by one of the Err* sentinels
+func (e *IoctlError) Is(target error) bool {
+	sentinel := e.sentinel()
+	return sentinel != nil && sentinel == target
+}
+
+//Retryable returns true if the error is transient, i.e. the same call may succeed if retried
+func (e *IoctlError) Retryable() bool {
+	switch e.Errno {
+	case syscall.EINTR, syscall.EAGAIN, syscall.ENOMEM, syscall.EBUSY:
+		return true
+	}
+	//the kernel signals failed buffer allocation with a plain return value
+	return e.Name == ioctlNameBatchTrackStart && e.Errno == 0 && e.ReturnValue == batchTrackStartReturnAllocError
+}
+
+//IsRetryable returns true if err wraps an IoctlError that is Retryable
+func IsRetryable(err error) bool {
+	var ioctlErr *IoctlError
+	return errors.As(err, &ioctlErr) && ioctlErr.Retryable()
+}
+
+//validateTrackMode checks mode against the range accepted by the kernel
+func validateTrackMode(mode PageTrackMode) error {
+	if mode < 0 || int(mode) >= kvmPageTrackMax {
+		return fmt.Errorf("%w : %d must be in [0,%d)", ErrInvalidTrackMode, mode, kvmPageTrackMax)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package sevStep
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestIoctlError_Is(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		want          error
+		wantRetryable bool
+	}{
+		{
+			name: "Track page without VM",
+			err:  &IoctlError{Name: ioctlNameTrackPage, Errno: syscall.EFAULT},
+			want: ErrVMNotStarted,
+		},
+		{
+			name: "Poll without register",
+			err:  fmt.Errorf("wrapped : %w", &IoctlError{Name: ioctlNamePollEvent, Errno: syscall.EINVAL}),
+			want: ErrNotRegistered,
+		},
+		{
+			name: "Ack id mismatch",
+			err:  &IoctlError{Name: ioctlNameAckEvent, ReturnValue: ackEventReturnIDMismatch},
+			want: ErrAckMismatch,
+		},
+		{
+			name: "Batch stop while inactive",
+			err:  &IoctlError{Name: ioctlNameBatchTrackStop, Errno: syscall.EFAULT},
+			want: ErrBatchNotActive,
+		},
+		{
+			name:          "Batch start alloc error",
+			err:           &IoctlError{Name: ioctlNameBatchTrackStart, ReturnValue: batchTrackStartReturnAllocError},
+			wantRetryable: true,
+		},
+		{
+			name:          "Interrupted",
+			err:           &IoctlError{Name: ioctlNameReadGuestMemory, Errno: syscall.EINTR},
+			wantRetryable: true,
+		},
+		{
+			name: "Invalid track mode",
+			err:  validateTrackMode(PageTrackMode(kvmPageTrackMax)),
+			want: ErrInvalidTrackMode,
+		},
+	}
+	sentinels := []error{ErrVMNotStarted, ErrNotRegistered, ErrInvalidTrackMode, ErrBatchNotActive, ErrAckMismatch}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, sentinel := range sentinels {
+				if got := errors.Is(tt.err, sentinel); got != (sentinel == tt.want) {
+					t.Errorf("errors.Is(%v, %v) = %v", tt.err, sentinel, got)
+				}
+			}
+			if got := IsRetryable(tt.err); got != tt.wantRetryable {
+				t.Errorf("IsRetryable() = %v, want %v", got, tt.wantRetryable)
+			}
+		})
+	}
+}
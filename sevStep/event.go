@@ -1,7 +1,6 @@
 package sevStep
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
@@ -45,7 +44,7 @@ func (h *jsonBytes) UnmarshalJSON(b []byte) error {
 type Event struct {
 	ID                      uint64    `json:"id"`
 	FaultedGPA              uint64    `json:"faulted_gpa"`
-	ErrorCode               uint32    `json:"error_code"`
+	ErrorCode               ErrorCode `json:"error_code"`
 	HaveRipInfo             bool      `json:"have_rip_info"`
 	RIP                     uint64    `json:"rip"`
 	MonitorGPA              uint64    `json:"monitor_gpa,omitempty"`
@@ -55,6 +54,12 @@ type Event struct {
 	//RetiredInstructions are the instructions retired in the guest
 	//between this and the previous (by ID) page fault event
 	RetiredInstructions uint64 `json:"retired_instructions"`
+	//VCPU is the index of the vCPU that caused the page fault. The kernel patch only
+	//supports vCPU 0, thus this is always zero for IoctlAPI
+	VCPU int `json:"vcpu"`
+	//Regions contains the guest memory captured for this event, see CapturePolicy.
+	//MonitorGPA and Content mirror the first region
+	Regions []MemoryRegion `json:"regions,omitempty"`
 }
 
 func (e Event) String() string {
@@ -62,12 +67,12 @@ func (e Event) String() string {
 	if e.HaveRetiredInstructions {
 		retInstr = fmt.Sprintf("%v", e.RetiredInstructions)
 	}
-	return fmt.Sprintf("ID %d, FaultedGPA %x, HaveRip %t, RIP %x, Timestamp %v Retired Instructions %v", e.ID,
-		e.FaultedGPA, e.HaveRipInfo, e.RIP, e.Timestamp.Format(time.StampNano), retInstr)
+	return fmt.Sprintf("ID %d, VCPU %d, FaultedGPA %x, HaveRip %t, RIP %x, Timestamp %v Retired Instructions %v", e.ID,
+		e.VCPU, e.FaultedGPA, e.HaveRipInfo, e.RIP, e.Timestamp.Format(time.StampNano), retInstr)
 }
 
 func (e Event) HasAccessData() bool {
-	return e.MonitorGPA != 0
+	return e.MonitorGPA != 0 || len(e.Regions) > 0
 }
 
 func ParseEventFromJSON(s string) (*Event, error) {
@@ -78,39 +83,23 @@ func ParseEventFromJSON(s string) (*Event, error) {
 	return event, nil
 }
 
+//ParseInputFile reads all events from the JSON lines format in r, skipping non JSON lines.
+//Use EventScanner for large inputs
 func ParseInputFile(r io.Reader) ([]*Event, error) {
-	sc := bufio.NewScanner(r)
-	sc.Split(bufio.ScanLines)
-
+	sc := NewEventScanner(r)
 	events := make([]*Event, 0)
-
-	printedWarningNonJSON := false
-	printedWarningNoRIP := false
 	for sc.Scan() {
-		line := sc.Text()
-		if !strings.HasPrefix(line, "{") {
-			if !printedWarningNonJSON {
-				log.Printf("omiting non json lines")
-			}
-			printedWarningNonJSON = true
-			continue
-		}
-
-		v, err := ParseEventFromJSON(line)
-		if err != nil {
-			return nil, fmt.Errorf("ParseEventFromJSON failed on %s : %v", line, err)
-		}
-
-		if !v.HaveRipInfo && !printedWarningNoRIP {
-			log.Printf("Some entries do not have RIP info")
-			printedWarningNoRIP = true
-		}
-
-		events = append(events, v)
-
+		events = append(events, sc.Event())
 	}
 	if sc.Err() != nil {
-		return nil, fmt.Errorf("scanner error : %v", sc.Err())
+		return nil, sc.Err()
+	}
+
+	if sc.Stats().NonJSONLines > 0 {
+		log.Printf("omiting non json lines")
+	}
+	if sc.Stats().EventsWithoutRIP > 0 {
+		log.Printf("Some entries do not have RIP info")
 	}
 	return events, nil
 }
@@ -0,0 +1,235 @@
+package sevStep
+
+//This file contains the poll/ack loop that is required to consume interactive page fault events
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//EventAction tells the EventLoop how to proceed after an event was handled
+type EventAction int
+
+const (
+	//EventActionAck acknowledges the event, allowing the VM to continue
+	EventActionAck = EventAction(iota)
+	//EventActionRetrack acknowledges the event and re-tracks the faulted page with EventLoop.RetrackMode.
+	//Re-tracking a page before its access completed traps the VM in an endless loop (see KVM_TRACK_PAGE).
+	//Thus, the page is re-tracked once an event for a different page arrives
+	EventActionRetrack
+	//EventActionStop acknowledges the event and stops the EventLoop
+	EventActionStop
+)
+
+func (a EventAction) String() string {
+	switch a {
+	case EventActionAck:
+		return "Ack"
+	case EventActionRetrack:
+		return "Retrack"
+	case EventActionStop:
+		return "Stop"
+	default:
+		return "Unknown"
+	}
+}
+
+//EventHandler is called by EventLoop.Run for each event, before the event is acknowledged.
+//If an error is returned, the event is still acknowledged but the loop stops and returns the error
+type EventHandler func(ev *Event) (EventAction, error)
+
+//EventLoop polls a Tracker for events, passes them to a handler and acknowledges them afterwards.
+//Keep in mind that the kernel only waits one second for the ack before resuming the VM.
+//The exported fields must not be changed while the loop is running
+type EventLoop struct {
+	//PollBackoff is the time to wait after a poll did not return an event. Zero means busy polling
+	PollBackoff time.Duration
+	//MaxPollBackoff, if larger than PollBackoff, enables exponential backoff: the wait time doubles
+	//with each unsuccessful poll until it reaches MaxPollBackoff. It is reset once an event arrives
+	MaxPollBackoff time.Duration
+	//RetrackMode is the tracking mode used for EventActionRetrack
+	RetrackMode PageTrackMode
+	//Capture, if set, reads guest memory for each event before it is passed to the handler
+	Capture *CapturePolicy
+	//RetInstr, if set, fills the retired instructions of interactive events. See NewRetInstrCounter
+	RetInstr *RetInstrCounter
+
+	tracker Tracker
+	//pendingRetracks are the GPAs that are re-tracked once the next event arrives
+	pendingRetracks []uint64
+}
+
+//NewEventLoop creates an EventLoop that busy polls tracker
+func NewEventLoop(tracker Tracker) *EventLoop {
+	return &EventLoop{
+		tracker:         tracker,
+		pendingRetracks: make([]uint64, 0),
+	}
+}
+
+//waitForEvent polls until an event arrives or ctx is done
+func (l *EventLoop) waitForEvent(ctx context.Context) (*Event, error) {
+	backoff := l.PollBackoff
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ev, ok, err := l.tracker.CmdPollEvent()
+		if err != nil {
+			return nil, fmt.Errorf("CmdPollEvent failed : %w", err)
+		}
+		if ok {
+			return ev, nil
+		}
+		if backoff <= 0 {
+			continue
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		if backoff < l.MaxPollBackoff {
+			backoff *= 2
+			if backoff > l.MaxPollBackoff {
+				backoff = l.MaxPollBackoff
+			}
+		}
+	}
+}
+
+//applyPendingRetracks re-tracks all pending pages except the one that just faulted
+func (l *EventLoop) applyPendingRetracks(ev *Event) error {
+	keep := l.pendingRetracks[:0]
+	for _, gpa := range l.pendingRetracks {
+		if OnSamePage(gpa, ev.FaultedGPA) {
+			keep = append(keep, gpa)
+			continue
+		}
+		if err := l.tracker.CmdTrackPage(gpa, l.RetrackMode); err != nil {
+			return fmt.Errorf("failed to retrack 0x%x : %w", gpa, err)
+		}
+	}
+	l.pendingRetracks = keep
+	return nil
+}
+
+//ackAfterError still acks ev, to not stall the VM until the kernel timeout, and returns err
+func (l *EventLoop) ackAfterError(ev *Event, err error) error {
+	if ackErr := l.tracker.CmdAckEvent(ev.ID); ackErr != nil {
+		return fmt.Errorf("%v, CmdAckEvent for %v also failed : %v", err, ev.ID, ackErr)
+	}
+	return err
+}
+
+//HandleEvent applies action to ev and acknowledges it. Returns true if the loop should stop.
+//Run calls this for each event; it is exported for callers that poll on their own
+func (l *EventLoop) HandleEvent(ev *Event, action EventAction) (bool, error) {
+	if err := l.applyPendingRetracks(ev); err != nil {
+		return true, l.ackAfterError(ev, err)
+	}
+	if action == EventActionRetrack {
+		l.pendingRetracks = append(l.pendingRetracks, ev.FaultedGPA)
+	}
+	if l.RetInstr != nil {
+		if err := l.RetInstr.Rebase(); err != nil {
+			return true, l.ackAfterError(ev, err)
+		}
+	}
+	if err := l.tracker.CmdAckEvent(ev.ID); err != nil {
+		return true, fmt.Errorf("CmdAckEvent for %v failed : %w", ev.ID, err)
+	}
+	return action == EventActionStop, nil
+}
+
+//prepareEvent fills the retired instructions and captures memory for ev, as configured
+func (l *EventLoop) prepareEvent(ev *Event) error {
+	if l.RetInstr != nil {
+		if err := l.RetInstr.Fill(ev); err != nil {
+			return err
+		}
+	}
+	if l.Capture != nil {
+		return l.Capture.Capture(l.tracker, ev)
+	}
+	return nil
+}
+
+//NextEvent polls until an event arrives or ctx is done and fills its retired instructions and
+//captured memory, as configured. Use a ctx with timeout or cancel it to stop waiting. The caller
+//must pass the event to HandleEvent afterwards. If preparing fails, the event is acknowledged and
+//the error is returned. Run calls this for each event; it is exported for callers that poll on their own
+func (l *EventLoop) NextEvent(ctx context.Context) (*Event, error) {
+	ev, err := l.waitForEvent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.prepareEvent(ev); err != nil {
+		if _, ackErr := l.HandleEvent(ev, EventActionStop); ackErr != nil {
+			return nil, fmt.Errorf("%v, handling event also failed : %v", err, ackErr)
+		}
+		return nil, err
+	}
+	return ev, nil
+}
+
+//Run polls for events and calls handler for each of them, until the handler returns EventActionStop,
+//an error occurs or ctx is done. In the latter case ctx.Err() is returned
+func (l *EventLoop) Run(ctx context.Context, handler EventHandler) error {
+	for {
+		ev, err := l.NextEvent(ctx)
+		if err != nil {
+			return err
+		}
+		action, handlerErr := handler(ev)
+		stop, err := l.HandleEvent(ev, action)
+		if handlerErr != nil {
+			if err != nil {
+				return fmt.Errorf("handler failed : %v, handling event also failed : %v", handlerErr, err)
+			}
+			return handlerErr
+		}
+		if err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+}
+
+//Events runs the loop in a new goroutine and delivers all events on the returned channel.
+//Each event is acknowledged as soon as it has been received from the channel, i.e. the VM
+//continues while the receiver processes the event.
+//The event channel is closed once the loop stops. Afterwards, the result of Run is sent on the
+//error channel. Cancel ctx to stop the loop
+func (l *EventLoop) Events(ctx context.Context) (<-chan *Event, <-chan error) {
+	events := make(chan *Event)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		err := l.Run(ctx, func(ev *Event) (EventAction, error) {
+			select {
+			case events <- ev:
+				return EventActionAck, nil
+			case <-ctx.Done():
+				return EventActionStop, nil
+			}
+		})
+		close(events)
+		if err == nil {
+			err = ctx.Err()
+		}
+		errs <- err
+	}()
+	return events, errs
+}
+
+//Events subscribes to the page fault events of the VM, acknowledging them automatically.
+//See EventLoop.Events. Use NewEventLoop for more control, e.g. over the poll backoff
+func (a *IoctlAPI) Events(ctx context.Context) (<-chan *Event, <-chan error) {
+	return NewEventLoop(a).Events(ctx)
+}
@@ -0,0 +1,94 @@
+package sevStep
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func alternatingExecScript(n int) []GuestAccess {
+	script := make([]GuestAccess, 0, n)
+	for i := 0; i < n; i++ {
+		gpa := uint64(0x1000 * (1 + i%2))
+		script = append(script, GuestAccess{GPA: gpa, Kind: AccessExec, RIP: gpa, RetiredInstructions: 5})
+	}
+	return script
+}
+
+func TestEventLoop_Run(t *testing.T) {
+	tests := []struct {
+		name   string
+		action EventAction
+		want   []uint64
+	}{
+		{
+			name:   "Ack",
+			action: EventActionAck,
+			want:   []uint64{0x1000, 0x2000},
+		},
+		{
+			name:   "Retrack",
+			action: EventActionRetrack,
+			want:   []uint64{0x1000, 0x2000, 0x1000, 0x2000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewSimulatedVM(4, alternatingExecScript(4), false)
+			for _, gpa := range []uint64{0x1000, 0x2000} {
+				if err := vm.CmdTrackPage(gpa, PageTrackExec); err != nil {
+					t.Fatalf("CmdTrackPage failed : %v", err)
+				}
+			}
+			loop := NewEventLoop(vm)
+			loop.RetrackMode = PageTrackExec
+
+			got := make([]*Event, 0)
+			err := loop.Run(context.Background(), func(ev *Event) (EventAction, error) {
+				got = append(got, ev)
+				if len(got) == len(tt.want) {
+					return EventActionStop, nil
+				}
+				return tt.action, nil
+			})
+			if err != nil {
+				t.Errorf("Run() error = %v", err)
+			}
+			//the remaining accesses must not cause further events
+			if _, ok, _ := vm.CmdPollEvent(); ok || !vm.GuestDone() {
+				t.Errorf("guest should have finished without further events")
+			}
+			if gotGPAs := faultedGPAs(got); !reflect.DeepEqual(gotGPAs, tt.want) {
+				t.Errorf("Run() got = %x, want %x", gotGPAs, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventLoop_Events(t *testing.T) {
+	vm := NewSimulatedVM(4, alternatingExecScript(2), false)
+	if err := vm.CmdTrackAllPages(PageTrackExec); err != nil {
+		t.Fatalf("CmdTrackAllPages failed : %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, errs := NewEventLoop(vm).Events(ctx)
+
+	got := make([]*Event, 0)
+	for ev := range events {
+		got = append(got, ev)
+		if len(got) == 2 {
+			cancel()
+		}
+	}
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Events() error = %v, want context.Canceled", err)
+	}
+	if gotGPAs := faultedGPAs(got); !reflect.DeepEqual(gotGPAs, []uint64{0x1000, 0x2000}) {
+		t.Errorf("Events() got = %x, want [1000 2000]", gotGPAs)
+	}
+	if !vm.GuestDone() {
+		t.Errorf("guest did not finish, events were not acked")
+	}
+}
@@ -0,0 +1,181 @@
+package sevStep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//eventScannerMaxLineSize is the max length of a line. Events with a full page of content are ~8KB
+const eventScannerMaxLineSize = 1 << 24
+
+//ScanPolicy configures how EventScanner handles lines that do not contain an event
+type ScanPolicy int
+
+const (
+	//ScanPolicySkip ignores the line. It is only counted in the ScanStats
+	ScanPolicySkip = ScanPolicy(iota)
+	//ScanPolicyCollect ignores the line but keeps a copy that can be retrieved with EventScanner.Rejected
+	ScanPolicyCollect
+	//ScanPolicyFail stops the scan. EventScanner.Err returns the reason
+	ScanPolicyFail
+)
+
+func (p ScanPolicy) String() string {
+	switch p {
+	case ScanPolicySkip:
+		return "Skip"
+	case ScanPolicyCollect:
+		return "Collect"
+	case ScanPolicyFail:
+		return "Fail"
+	default:
+		return "Unknown"
+	}
+}
+
+//ScanStats summarizes the lines processed by an EventScanner
+type ScanStats struct {
+	Lines          uint64
+	Events         uint64
+	NonJSONLines   uint64
+	MalformedLines uint64
+	//EventsWithoutRIP is the number of events with HaveRipInfo unset
+	EventsWithoutRIP uint64
+}
+
+func (s ScanStats) String() string {
+	return fmt.Sprintf("%d lines, %d events (%d without RIP), %d non JSON lines, %d malformed lines",
+		s.Lines, s.Events, s.EventsWithoutRIP, s.NonJSONLines, s.MalformedLines)
+}
+
+//RejectedLine is a line that did not contain an event
+type RejectedLine struct {
+	LineNo int
+	Line   string
+	//Err is nil for non JSON lines and the parser error for malformed lines
+	Err error
+}
+
+//EventScanner reads events from the JSON lines format one at a time, without loading the
+//whole input into memory. Lines not starting with "{" are considered non JSON lines, e.g. log
+//output, and lines starting with "{" that cannot be parsed are considered malformed.
+//Use it like bufio.Scanner:
+//
+//	sc := NewEventScanner(r)
+//	for sc.Scan() {
+//		ev := sc.Event()
+//	}
+//	if err := sc.Err(); err != nil {
+//		...
+//	}
+type EventScanner struct {
+	//NonJSONPolicy configures the handling of non JSON lines. Defaults to ScanPolicySkip
+	NonJSONPolicy ScanPolicy
+	//MalformedPolicy configures the handling of malformed lines. Defaults to ScanPolicyFail
+	MalformedPolicy ScanPolicy
+
+	sc       *bufio.Scanner
+	event    *Event
+	lineNo   int
+	err      error
+	stats    ScanStats
+	rejected []RejectedLine
+}
+
+//NewEventScanner creates an EventScanner reading from r
+func NewEventScanner(r io.Reader) *EventScanner {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), eventScannerMaxLineSize)
+	sc.Split(bufio.ScanLines)
+	return &EventScanner{
+		NonJSONPolicy:   ScanPolicySkip,
+		MalformedPolicy: ScanPolicyFail,
+		sc:              sc,
+		rejected:        make([]RejectedLine, 0),
+	}
+}
+
+//reject applies policy to the current line. Returns false if the scan must be stopped
+func (s *EventScanner) reject(policy ScanPolicy, line string, err error) bool {
+	switch policy {
+	case ScanPolicyCollect:
+		s.rejected = append(s.rejected, RejectedLine{LineNo: s.lineNo, Line: line, Err: err})
+	case ScanPolicyFail:
+		if err == nil {
+			s.err = fmt.Errorf("line %d is not JSON : %q", s.lineNo, line)
+		} else {
+			s.err = fmt.Errorf("ParseEventFromJSON failed in line %d on %s : %w", s.lineNo, line, err)
+		}
+		return false
+	}
+	return true
+}
+
+//Scan advances to the next event, which is then available through Event. It returns false once the
+//input is exhausted or an error occurred
+func (s *EventScanner) Scan() bool {
+	s.event = nil
+	if s.err != nil {
+		return false
+	}
+	for s.sc.Scan() {
+		s.lineNo++
+		s.stats.Lines++
+		line := s.sc.Text()
+		if !strings.HasPrefix(line, "{") {
+			s.stats.NonJSONLines++
+			if !s.reject(s.NonJSONPolicy, line, nil) {
+				return false
+			}
+			continue
+		}
+
+		ev, err := ParseEventFromJSON(line)
+		if err != nil {
+			s.stats.MalformedLines++
+			if !s.reject(s.MalformedPolicy, line, err) {
+				return false
+			}
+			continue
+		}
+
+		s.stats.Events++
+		if !ev.HaveRipInfo {
+			s.stats.EventsWithoutRIP++
+		}
+		s.event = ev
+		return true
+	}
+	if s.sc.Err() != nil {
+		s.err = fmt.Errorf("scanner error : %w", s.sc.Err())
+	}
+	return false
+}
+
+//Event returns the event found by the last call to Scan
+func (s *EventScanner) Event() *Event {
+	return s.event
+}
+
+//LineNo returns the line number, starting at 1, of the event found by the last call to Scan.
+//After Scan returned false, this is the last processed line
+func (s *EventScanner) LineNo() int {
+	return s.lineNo
+}
+
+//Err returns the first error that stopped the scan. It is nil if the input was exhausted
+func (s *EventScanner) Err() error {
+	return s.err
+}
+
+//Stats returns the statistics of the lines processed so far
+func (s *EventScanner) Stats() ScanStats {
+	return s.stats
+}
+
+//Rejected returns the lines collected due to ScanPolicyCollect
+func (s *EventScanner) Rejected() []RejectedLine {
+	return s.rejected
+}
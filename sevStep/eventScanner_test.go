@@ -0,0 +1,104 @@
+package sevStep
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEventScanner(t *testing.T) {
+	input := `starting tracking
+{"id":2,"faulted_gpa":4096,"error_code":20,"have_rip_info":true,"rip":4198400}
+{"id":3,"faulted_gpa":
+{"id":4,"faulted_gpa":8192,"error_code":20,"have_rip_info":false,"rip":0}
+done!`
+
+	tests := []struct {
+		name            string
+		nonJSONPolicy   ScanPolicy
+		malformedPolicy ScanPolicy
+		wantIDs         []uint64
+		wantLineNos     []int
+		wantRejected    []int
+		wantErr         bool
+		wantStats       ScanStats
+	}{
+		{
+			name:            "Skip",
+			nonJSONPolicy:   ScanPolicySkip,
+			malformedPolicy: ScanPolicySkip,
+			wantIDs:         []uint64{2, 4},
+			wantLineNos:     []int{2, 4},
+			wantRejected:    []int{},
+			wantStats:       ScanStats{Lines: 5, Events: 2, NonJSONLines: 2, MalformedLines: 1, EventsWithoutRIP: 1},
+		},
+		{
+			name:            "Collect",
+			nonJSONPolicy:   ScanPolicyCollect,
+			malformedPolicy: ScanPolicyCollect,
+			wantIDs:         []uint64{2, 4},
+			wantLineNos:     []int{2, 4},
+			wantRejected:    []int{1, 3, 5},
+			wantStats:       ScanStats{Lines: 5, Events: 2, NonJSONLines: 2, MalformedLines: 1, EventsWithoutRIP: 1},
+		},
+		{
+			name:            "Fail on malformed",
+			nonJSONPolicy:   ScanPolicySkip,
+			malformedPolicy: ScanPolicyFail,
+			wantIDs:         []uint64{2},
+			wantLineNos:     []int{2},
+			wantRejected:    []int{},
+			wantErr:         true,
+			wantStats:       ScanStats{Lines: 3, Events: 1, NonJSONLines: 1, MalformedLines: 1},
+		},
+		{
+			name:            "Fail on non JSON",
+			nonJSONPolicy:   ScanPolicyFail,
+			malformedPolicy: ScanPolicySkip,
+			wantIDs:         []uint64{},
+			wantLineNos:     []int{},
+			wantRejected:    []int{},
+			wantErr:         true,
+			wantStats:       ScanStats{Lines: 1, NonJSONLines: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := NewEventScanner(strings.NewReader(input))
+			sc.NonJSONPolicy = tt.nonJSONPolicy
+			sc.MalformedPolicy = tt.malformedPolicy
+
+			gotIDs := make([]uint64, 0)
+			gotLineNos := make([]int, 0)
+			for sc.Scan() {
+				gotIDs = append(gotIDs, sc.Event().ID)
+				gotLineNos = append(gotLineNos, sc.LineNo())
+			}
+			if (sc.Err() != nil) != tt.wantErr {
+				t.Errorf("Err() = %v, wantErr %v", sc.Err(), tt.wantErr)
+			}
+			if !reflect.DeepEqual(gotIDs, tt.wantIDs) {
+				t.Errorf("event ids = %v, want %v", gotIDs, tt.wantIDs)
+			}
+			if !reflect.DeepEqual(gotLineNos, tt.wantLineNos) {
+				t.Errorf("line numbers = %v, want %v", gotLineNos, tt.wantLineNos)
+			}
+			gotRejected := sc.Rejected()
+			if len(gotRejected) != len(tt.wantRejected) {
+				t.Fatalf("rejected lines = %v, want line numbers %v", gotRejected, tt.wantRejected)
+			}
+			for i, v := range gotRejected {
+				if v.LineNo != tt.wantRejected[i] {
+					t.Errorf("rejected lines = %v, want line numbers %v", gotRejected, tt.wantRejected)
+				}
+				//only the malformed line has a parser error
+				if (v.Err != nil) != (v.LineNo == 3) {
+					t.Errorf("rejected line %d has err %v", v.LineNo, v.Err)
+				}
+			}
+			if sc.Stats() != tt.wantStats {
+				t.Errorf("Stats() = %+v, want %+v", sc.Stats(), tt.wantStats)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package sevStep
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+//MemoryView selects how GuestMemory reads the guest's memory
+type MemoryView int
+
+const (
+	//MemoryViewCiphertext returns the memory as stored in DRAM, i.e. the ciphertext for SEV guests
+	MemoryViewCiphertext = MemoryView(iota)
+	//MemoryViewHostDecrypted decrypts the memory with the host's key. This only yields the
+	//plaintext for pages shared with the host
+	MemoryViewHostDecrypted
+)
+
+func (v MemoryView) String() string {
+	switch v {
+	case MemoryViewCiphertext:
+		return "Ciphertext"
+	case MemoryViewHostDecrypted:
+		return "HostDecrypted"
+	default:
+		return "Unknown"
+	}
+}
+
+//guestMemoryCache is shared by all views of a GuestMemory
+type guestMemoryCache struct {
+	mu      sync.Mutex
+	enabled bool
+	pages   map[MemoryView]map[uint64][]byte
+	//pendingWriteGFN is the page of the last write fault. The guest performs the write
+	//once the event is acked, thus the page is invalidated again on the next event
+	pendingWriteGFN  uint64
+	havePendingWrite bool
+}
+
+//GuestMemory provides the guest physical memory as an io.ReaderAt. Reads are split at page
+//boundaries, as CmdReadGuestMemory cannot read across pages.
+//If caching is enabled, whole pages are read and kept until they are invalidated. The cache
+//assumes that the guest only modifies pages for which you observe write faults. Pass all events to
+//InvalidateOnEvent or use WrapHandler. Call InvalidateAll if untracked pages may have changed.
+//GuestMemory is safe for concurrent use
+type GuestMemory struct {
+	//WbinvdCPU is passed to CmdReadGuestMemory. Defaults to -1, i.e. no cache flush
+	WbinvdCPU int
+
+	tracker Tracker
+	view    MemoryView
+	cache   *guestMemoryCache
+}
+
+//NewGuestMemory creates a GuestMemory reading from tracker with the given view.
+//If cachePages is set, read pages are cached
+func NewGuestMemory(tracker Tracker, view MemoryView, cachePages bool) *GuestMemory {
+	return &GuestMemory{
+		WbinvdCPU: -1,
+		tracker:   tracker,
+		view:      view,
+		cache: &guestMemoryCache{
+			enabled: cachePages,
+			pages:   make(map[MemoryView]map[uint64][]byte),
+		},
+	}
+}
+
+//WithView returns a GuestMemory with a different view on the same memory. Both share their
+//cache, i.e. invalidating a page affects all views
+func (m *GuestMemory) WithView(view MemoryView) *GuestMemory {
+	return &GuestMemory{
+		WbinvdCPU: m.WbinvdCPU,
+		tracker:   m.tracker,
+		view:      view,
+		cache:     m.cache,
+	}
+}
+
+//View returns the view used by ReadAt
+func (m *GuestMemory) View() MemoryView {
+	return m.view
+}
+
+func (m *GuestMemory) readPage(gfn uint64) ([]byte, error) {
+	m.cache.mu.Lock()
+	defer m.cache.mu.Unlock()
+	if page, ok := m.cache.pages[m.view][gfn]; ok {
+		return page, nil
+	}
+	page, err := m.tracker.CmdReadGuestMemory(gfn<<pageShift, pageSize, m.view == MemoryViewHostDecrypted, m.WbinvdCPU)
+	if err != nil {
+		return nil, err
+	}
+	if m.cache.pages[m.view] == nil {
+		m.cache.pages[m.view] = make(map[uint64][]byte)
+	}
+	m.cache.pages[m.view][gfn] = page
+	return page, nil
+}
+
+//ReadAt reads len(p) bytes starting at gpa off
+func (m *GuestMemory) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	n := 0
+	for n < len(p) {
+		gpa := uint64(off) + uint64(n)
+		pageOffset := gpa & (pageSize - 1)
+		chunkSize := uint64(len(p) - n)
+		if pageOffset+chunkSize > pageSize {
+			chunkSize = pageSize - pageOffset
+		}
+
+		var chunk []byte
+		var err error
+		if m.cache.enabled {
+			var page []byte
+			page, err = m.readPage(gpa >> pageShift)
+			if err == nil {
+				chunk = page[pageOffset : pageOffset+chunkSize]
+			}
+		} else {
+			chunk, err = m.tracker.CmdReadGuestMemory(gpa, chunkSize, m.view == MemoryViewHostDecrypted, m.WbinvdCPU)
+		}
+		if err != nil {
+			return n, fmt.Errorf("failed to read 0x%x bytes at 0x%x : %w", chunkSize, gpa, err)
+		}
+		n += copy(p[n:], chunk)
+	}
+	return n, nil
+}
+
+//Invalidate removes the page containing gpa from the cache of all views
+func (m *GuestMemory) Invalidate(gpa uint64) {
+	m.cache.mu.Lock()
+	defer m.cache.mu.Unlock()
+	m.invalidateGFN(gpa >> pageShift)
+}
+
+//invalidateGFN requires cache.mu to be held
+func (m *GuestMemory) invalidateGFN(gfn uint64) {
+	for _, pages := range m.cache.pages {
+		delete(pages, gfn)
+	}
+}
+
+//InvalidateAll clears the cache of all views
+func (m *GuestMemory) InvalidateAll() {
+	m.cache.mu.Lock()
+	defer m.cache.mu.Unlock()
+	m.cache.pages = make(map[MemoryView]map[uint64][]byte)
+	m.cache.havePendingWrite = false
+}
+
+//InvalidateOnEvent updates the cache for ev. If ev is a write fault, the faulted page is
+//invalidated now and again on the next call, as the guest performs the write after the ack
+func (m *GuestMemory) InvalidateOnEvent(ev *Event) {
+	m.cache.mu.Lock()
+	defer m.cache.mu.Unlock()
+	if m.cache.havePendingWrite {
+		m.invalidateGFN(m.cache.pendingWriteGFN)
+		m.cache.havePendingWrite = false
+	}
+	if ev.ErrorCode.Write() {
+		gfn := ev.FaultedGPA >> pageShift
+		m.invalidateGFN(gfn)
+		m.cache.pendingWriteGFN = gfn
+		m.cache.havePendingWrite = true
+	}
+}
+
+//WrapHandler returns an EventHandler for EventLoop that calls InvalidateOnEvent before handler
+func (m *GuestMemory) WrapHandler(handler EventHandler) EventHandler {
+	return func(ev *Event) (EventAction, error) {
+		m.InvalidateOnEvent(ev)
+		return handler(ev)
+	}
+}
+
+var _ io.ReaderAt = (*GuestMemory)(nil)
@@ -0,0 +1,142 @@
+package sevStep
+
+import (
+	"bytes"
+	"testing"
+)
+
+//countingTracker counts the calls to CmdReadGuestMemory
+type countingTracker struct {
+	Tracker
+	reads int
+}
+
+func (c *countingTracker) CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error) {
+	c.reads++
+	return c.Tracker.CmdReadGuestMemory(gpa, size, hostDecryption, wbinvdCPU)
+}
+
+func TestGuestMemory_ReadAt(t *testing.T) {
+	vm := NewSimulatedVM(4, nil, false)
+	vm.EncryptBlock = func(gpa uint64, block []byte) []byte {
+		res := make([]byte, len(block))
+		for i := range block {
+			res[i] = block[i] ^ 0xff
+		}
+		return res
+	}
+	plaintext := make([]byte, 3*pageSize)
+	for i := range plaintext {
+		plaintext[i] = byte(i)
+	}
+	if err := vm.WriteGuestMemory(0, plaintext); err != nil {
+		t.Fatalf("WriteGuestMemory failed : %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		view       MemoryView
+		cachePages bool
+		off        int64
+		size       int
+		wantReads  int
+	}{
+		{
+			name:      "Within page",
+			view:      MemoryViewHostDecrypted,
+			off:       0x10,
+			size:      0x20,
+			wantReads: 1,
+		},
+		{
+			name:      "Across pages",
+			view:      MemoryViewHostDecrypted,
+			off:       0xff8,
+			size:      pageSize + 0x10,
+			wantReads: 3,
+		},
+		{
+			name:       "Across pages cached",
+			view:       MemoryViewHostDecrypted,
+			cachePages: true,
+			off:        0xff8,
+			size:       pageSize + 0x10,
+			wantReads:  3,
+		},
+		{
+			name:      "Ciphertext",
+			view:      MemoryViewCiphertext,
+			off:       0x1003,
+			size:      0x20,
+			wantReads: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := &countingTracker{Tracker: vm}
+			mem := NewGuestMemory(tracker, tt.view, tt.cachePages)
+			got := make([]byte, tt.size)
+			n, err := mem.ReadAt(got, tt.off)
+			if err != nil || n != tt.size {
+				t.Fatalf("ReadAt() got = %v, %v, want %v", n, err, tt.size)
+			}
+			want := append([]byte{}, plaintext[tt.off:tt.off+int64(tt.size)]...)
+			if tt.view == MemoryViewCiphertext {
+				for i := range want {
+					want[i] ^= 0xff
+				}
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("ReadAt() got = %x, want %x", got, want)
+			}
+			if tracker.reads != tt.wantReads {
+				t.Errorf("ReadAt() issued %d reads, want %d", tracker.reads, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestGuestMemory_InvalidateOnEvent(t *testing.T) {
+	vm := NewSimulatedVM(2, nil, false)
+	tracker := &countingTracker{Tracker: vm}
+	mem := NewGuestMemory(tracker, MemoryViewHostDecrypted, true)
+	ciphertext := mem.WithView(MemoryViewCiphertext)
+	buf := make([]byte, 1)
+
+	read := func(wantValue byte, wantReads int) {
+		t.Helper()
+		if _, err := mem.ReadAt(buf, 0x1000); err != nil {
+			t.Fatalf("ReadAt() failed : %v", err)
+		}
+		if buf[0] != wantValue || tracker.reads != wantReads {
+			t.Errorf("ReadAt() got value %x after %d reads, want %x after %d", buf[0], tracker.reads, wantValue, wantReads)
+		}
+	}
+
+	read(0, 1)
+	if _, err := ciphertext.ReadAt(buf, 0x1000); err != nil {
+		t.Fatalf("ReadAt() failed : %v", err)
+	}
+	//page is cached, changes are not visible
+	if err := vm.WriteGuestMemory(0x1000, []byte{1}); err != nil {
+		t.Fatalf("WriteGuestMemory failed : %v", err)
+	}
+	read(0, 2)
+
+	//read faults do not invalidate
+	mem.InvalidateOnEvent(&Event{FaultedGPA: 0x1000, ErrorCode: ErrorCode(PfErrorUser)})
+	read(0, 2)
+
+	//the write fault invalidates, but the handler still sees the old data
+	mem.InvalidateOnEvent(&Event{FaultedGPA: 0x1000, ErrorCode: ErrorCode(PfErrorWrite)})
+	read(1, 3)
+	if err := vm.WriteGuestMemory(0x1000, []byte{2}); err != nil {
+		t.Fatalf("WriteGuestMemory failed : %v", err)
+	}
+	//the page is invalidated again on the next event
+	mem.InvalidateOnEvent(&Event{FaultedGPA: 0x0})
+	read(2, 4)
+	if _, err := ciphertext.ReadAt(buf, 0x1000); err != nil || tracker.reads != 5 {
+		t.Errorf("ciphertext view was not invalidated")
+	}
+}
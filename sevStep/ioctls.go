@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 	"unsafe"
@@ -26,6 +27,36 @@ const (
 	PageTraceResetExec
 )
 
+//kvmPageTrackMax is KVM_PAGE_TRACK_MAX from enum kvm_page_track_mode in the kernel patch
+const kvmPageTrackMax = int(PageTraceResetExec) + 1
+
+func (m PageTrackMode) String() string {
+	switch m {
+	case PageTrackWrite:
+		return "Write"
+	case PageTrackAccess:
+		return "Access"
+	case PageTrackResetAccess:
+		return "ResetAccess"
+	case PageTrackExec:
+		return "Exec"
+	case PageTraceResetExec:
+		return "ResetExec"
+	default:
+		return "Unknown"
+	}
+}
+
+//ParsePageTrackMode parses the output of PageTrackMode.String, ignoring case
+func ParsePageTrackMode(s string) (PageTrackMode, error) {
+	for mode := PageTrackWrite; int(mode) < kvmPageTrackMax; mode++ {
+		if strings.EqualFold(s, mode.String()) {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q", ErrInvalidTrackMode, s)
+}
+
 type IoctlAPI struct {
 	kvmFile *os.File
 	//If tryGetRIP is set the kernel
@@ -43,7 +74,7 @@ type IoctlAPI struct {
 func NewIoctlAPI(kvmFilePath string, tryGetRIP bool) (*IoctlAPI, error) {
 	f, err := os.OpenFile(kvmFilePath, syscall.O_RDWR|syscall.O_CREAT, 0666)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open device file : %v", err)
+		return nil, fmt.Errorf("failed to open device file : %w", err)
 	}
 	res := &IoctlAPI{
 		kvmFile:   f,
@@ -51,23 +82,36 @@ func NewIoctlAPI(kvmFilePath string, tryGetRIP bool) (*IoctlAPI, error) {
 	}
 	err = res.register()
 	if err != nil {
-		return nil, fmt.Errorf("register failed : %v", err)
+		f.Close()
+		return nil, fmt.Errorf("register failed : %w", err)
 	}
 	return res, nil
 }
 
+//ioctl issues the ioctl request with arg on the kvm file. If errno is set, an IoctlError is returned.
+//The return value of the ioctl is returned in both cases, as some ioctls use it to signal errors
+func (a *IoctlAPI) ioctl(name string, request uintptr, arg unsafe.Pointer) (uintptr, error) {
+	ret, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return ret, &IoctlError{Name: name, Request: request, Errno: errno, ReturnValue: ret}
+	}
+	return ret, nil
+}
+
 //newGoEventFromCEvent is a helper converting the "page_fault_event_t" C struct
 //from c_definitions.h to the "Event" Go struct from event.go
 func newGoEventFromCEvent(cEvent *C.page_fault_event_t) *Event {
 	e := &Event{
 		ID:                      uint64(cEvent.id),
 		FaultedGPA:              uint64(cEvent.faulted_gpa),
-		ErrorCode:               uint32(cEvent.error_code),
+		ErrorCode:               ErrorCode(cEvent.error_code),
 		HaveRipInfo:             bool(cEvent.have_rip_info),
 		RIP:                     uint64(cEvent.rip),
 		Timestamp:               time.Unix(0, int64(cEvent.ns_timestamp)),
 		HaveRetiredInstructions: bool(cEvent.have_retired_instructions),
 		RetiredInstructions:     uint64(cEvent.retired_instructions),
+		//the kernel patch only handles main_vm->vcpus[0]
+		VCPU: 0,
 	}
 	return e
 }
@@ -85,15 +129,15 @@ func (a *IoctlAPI) register() error {
 		pid:     C.int(os.Getpid()),
 		get_rip: C.bool(a.tryGetRIP),
 	}
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_USPT_REGISTER_PID, uintptr(unsafe.Pointer(&registerStruct))); errno != 0 {
-		return fmt.Errorf("REGISTER_PID ioctl failed with errno %v", errno)
+	if _, err := a.ioctl(ioctlNameRegisterPID, C.KVM_USPT_REGISTER_PID, unsafe.Pointer(&registerStruct)); err != nil {
+		return err
 	}
 	return nil
 }
 
 func (a *IoctlAPI) CmdReset() error {
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_USPT_RESET, uintptr(0)); errno != 0 {
-		return fmt.Errorf("KVM_USPT_RESET ioctl failed with errno %v", errno)
+	if _, err := a.ioctl(ioctlNameReset, C.KVM_USPT_RESET, nil); err != nil {
+		return err
 	}
 	return nil
 }
@@ -113,8 +157,8 @@ func (a *IoctlAPI) CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbi
 
 	defer C.free(argStruct.output_buffer)
 
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_READ_GUEST_MEMORY, uintptr(unsafe.Pointer(&argStruct))); errno != 0 {
-		return nil, fmt.Errorf("KVM_READ_GUEST_MEMORY ioctl failed with errno %v", errno)
+	if _, err := a.ioctl(ioctlNameReadGuestMemory, C.KVM_READ_GUEST_MEMORY, unsafe.Pointer(&argStruct)); err != nil {
+		return nil, err
 	}
 
 	return C.GoBytes(argStruct.output_buffer, C.int(size)), nil
@@ -124,10 +168,14 @@ func (a *IoctlAPI) CmdAckEvent(id uint64) error {
 	argStruct := C.ack_event_t{
 		id: C.uint64_t(id),
 	}
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_USPT_ACK_EVENT, uintptr(unsafe.Pointer(&argStruct))); errno != 0 {
-		return fmt.Errorf("KVM_USPT_ACK_EVENT ioctl failed with errno %v", errno)
+	ret, err := a.ioctl(ioctlNameAckEvent, C.KVM_USPT_ACK_EVENT, unsafe.Pointer(&argStruct))
+	if err != nil {
+		return err
+	}
+	//the kernel does not set errno if id does not belong to the last sent event
+	if ret != 0 {
+		return &IoctlError{Name: ioctlNameAckEvent, Request: C.KVM_USPT_ACK_EVENT, ReturnValue: ret}
 	}
-
 	return nil
 }
 
@@ -136,9 +184,9 @@ func (a *IoctlAPI) CmdAckEvent(id uint64) error {
 func (a *IoctlAPI) CmdPollEvent() (*Event, bool, error) {
 	resultBuf := C.page_fault_event_t{}
 
-	code, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_USPT_POLL_EVENT, uintptr(unsafe.Pointer(&resultBuf)))
-	if errno != 0 {
-		return nil, false, fmt.Errorf("KVM_USPT_ACK_EVENT ioctl failed with errno %v", errno)
+	code, err := a.ioctl(ioctlNamePollEvent, C.KVM_USPT_POLL_EVENT, unsafe.Pointer(&resultBuf))
+	if err != nil {
+		return nil, false, err
 	}
 	//special return value for no event is no error
 	switch code {
@@ -149,42 +197,50 @@ func (a *IoctlAPI) CmdPollEvent() (*Event, bool, error) {
 		e := newGoEventFromCEvent(&resultBuf)
 		return e, true, nil
 	default:
-		return nil, false, fmt.Errorf("KVM_USPT_ACK_EVENT ioctl failed with errno %v", errno)
-
+		return nil, false, &IoctlError{Name: ioctlNamePollEvent, Request: C.KVM_USPT_POLL_EVENT, ReturnValue: code}
 	}
 }
 
 func (a *IoctlAPI) CmdTrackPage(gpa uint64, trackMode PageTrackMode) error {
+	if err := validateTrackMode(trackMode); err != nil {
+		return err
+	}
 	argStruct := C.track_page_param_t{
 		gpa:        C.uint64_t(gpa),
 		track_mode: C.int(trackMode),
 	}
 
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_TRACK_PAGE, uintptr(unsafe.Pointer(&argStruct))); errno != 0 {
-		return fmt.Errorf("KVM_USPT_ACK_EVENT ioctl failed with errno %v", errno)
+	if _, err := a.ioctl(ioctlNameTrackPage, C.KVM_TRACK_PAGE, unsafe.Pointer(&argStruct)); err != nil {
+		return err
 	}
 	return nil
 }
 
 func (a *IoctlAPI) CmdTrackAllPages(trackMode PageTrackMode) error {
+	if err := validateTrackMode(trackMode); err != nil {
+		return err
+	}
 	argStruct := C.track_all_pages_t{
 		track_mode: C.int(trackMode),
 	}
 
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_USPT_TRACK_ALL, uintptr(unsafe.Pointer(&argStruct))); errno != 0 {
-		return fmt.Errorf("KVM_USPT_TRACK_ALL ioctl failed with errno %v", errno)
+	if _, err := a.ioctl(ioctlNameTrackAll, C.KVM_USPT_TRACK_ALL, unsafe.Pointer(&argStruct)); err != nil {
+		return err
 	}
 
 	return nil
 }
 
 func (a *IoctlAPI) CmdUnTrackAllPages(trackMode PageTrackMode) error {
+	if err := validateTrackMode(trackMode); err != nil {
+		return err
+	}
 	argStruct := C.track_all_pages_t{
 		track_mode: C.int(trackMode),
 	}
 
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_USPT_UNTRACK_ALL, uintptr(unsafe.Pointer(&argStruct))); errno != 0 {
-		return fmt.Errorf("KVM_USPT_UNTRACK_ALL ioctl failed with errno %v", errno)
+	if _, err := a.ioctl(ioctlNameUntrackAll, C.KVM_USPT_UNTRACK_ALL, unsafe.Pointer(&argStruct)); err != nil {
+		return err
 	}
 
 	return nil
@@ -197,9 +253,8 @@ func (a *IoctlAPI) CmdSetupRetInstrPerf(cpu int) error {
 		cpu: C.int(cpu),
 	}
 
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_USPT_SETUP_RETINSTR_PERF, uintptr(unsafe.Pointer(&argStruct))); errno != 0 {
-		return fmt.Errorf("KVM_USPT_SETUP_RETINSTR_PERF ioctl failed with errno %v", errno)
-
+	if _, err := a.ioctl(ioctlNameSetupRetInstrPerf, C.KVM_USPT_SETUP_RETINSTR_PERF, unsafe.Pointer(&argStruct)); err != nil {
+		return err
 	}
 	return nil
 }
@@ -208,8 +263,8 @@ func (a *IoctlAPI) CmdReadRetInstrPerf(cpu int) (uint64, error) {
 	argStruct := C.retired_instr_perf_t{
 		cpu: C.int(cpu),
 	}
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_USPT_READ_RETINSTR_PERF, uintptr(unsafe.Pointer(&argStruct))); errno != 0 {
-		return 0, fmt.Errorf("KVM_USPT_READ_RETINSTR_PERF ioctl failed with errno %v", errno)
+	if _, err := a.ioctl(ioctlNameReadRetInstrPerf, C.KVM_USPT_READ_RETINSTR_PERF, unsafe.Pointer(&argStruct)); err != nil {
+		return 0, err
 	}
 	retiredInstructions := uint64(argStruct.retired_instruction_count)
 
@@ -222,14 +277,22 @@ func (a *IoctlAPI) CmdReadRetInstrPerf(cpu int) (uint64, error) {
 //If re-track is set For the initial trackingType will be re-applied to faulted pages. You still need to track the intial pages yourself, e.g.
 //by calling CmdUnTrackAllPages
 func (a *IoctlAPI) CmdBatchTrackingStart(trackingType PageTrackMode, expectedEvents uint64, perfCPU int, retrack bool) error {
+	if err := validateTrackMode(trackingType); err != nil {
+		return err
+	}
 	argStruct := C.batch_track_config_t{
 		tracking_type:   C.int(trackingType),
 		expected_events: C.uint64_t(expectedEvents),
 		perf_cpu:        C.int(perfCPU),
 		retrack:         C.bool(retrack),
 	}
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_USPT_BATCH_TRACK_START, uintptr(unsafe.Pointer(&argStruct))); errno != 0 {
-		return fmt.Errorf("KVM_USPT_BATCH_TRACK_START ioctl failed with errno %v", errno)
+	ret, err := a.ioctl(ioctlNameBatchTrackStart, C.KVM_USPT_BATCH_TRACK_START, unsafe.Pointer(&argStruct))
+	if err != nil {
+		return err
+	}
+	//the kernel does not set errno if allocating the event buffer failed
+	if ret != 0 {
+		return &IoctlError{Name: ioctlNameBatchTrackStart, Request: C.KVM_USPT_BATCH_TRACK_START, ReturnValue: ret}
 	}
 	return nil
 }
@@ -237,8 +300,8 @@ func (a *IoctlAPI) CmdBatchTrackingStart(trackingType PageTrackMode, expectedEve
 func (a *IoctlAPI) CmdBatchTrackingEventCount() (uint64, error) {
 	argStruct := C.batch_track_event_count_t{}
 
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_USPT_BATCH_TRACK_EVENT_COUNT, uintptr(unsafe.Pointer(&argStruct))); errno != 0 {
-		return 0, fmt.Errorf("KVM_USPT_BATCH_TRACK_EVENT_COUNT ioctl failed with errno %v", errno)
+	if _, err := a.ioctl(ioctlNameBatchTrackEventCount, C.KVM_USPT_BATCH_TRACK_EVENT_COUNT, unsafe.Pointer(&argStruct)); err != nil {
+		return 0, err
 	}
 	return uint64(argStruct.event_count), nil
 }
@@ -258,8 +321,8 @@ func (a *IoctlAPI) CmdBatchTrackingStopAndGet(eventCount uint64) ([]*Event, bool
 		length:             C.uint64_t(eventCount),
 		error_during_batch: C.bool(false),
 	}
-	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, a.kvmFile.Fd(), C.KVM_USPT_BATCH_TRACK_STOP, uintptr(unsafe.Pointer(&argStruct))); errno != 0 {
-		return nil, false, fmt.Errorf("KVM_USPT_BATCH_TRACK_STOP ioctl failed with errno %v", errno)
+	if _, err := a.ioctl(ioctlNameBatchTrackStop, C.KVM_USPT_BATCH_TRACK_STOP, unsafe.Pointer(&argStruct)); err != nil {
+		return nil, false, err
 	}
 
 	//convert from c type to go type
@@ -0,0 +1,46 @@
+package sevStep
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePageTrackMode(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    PageTrackMode
+		wantErr bool
+	}{
+		{input: "Write", want: PageTrackWrite},
+		{input: "Access", want: PageTrackAccess},
+		{input: "ResetAccess", want: PageTrackResetAccess},
+		{input: "Exec", want: PageTrackExec},
+		{input: "ResetExec", want: PageTraceResetExec},
+		{input: "exec", want: PageTrackExec},
+		{input: "RESETACCESS", want: PageTrackResetAccess},
+		{input: "read", wantErr: true},
+		{input: "Unknown", wantErr: true},
+		{input: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParsePageTrackMode(tt.input)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTrackMode) {
+					t.Errorf("ParsePageTrackMode() error = %v, want %v", err, ErrInvalidTrackMode)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ParsePageTrackMode() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	//every mode survives a round trip through its name
+	for mode := PageTrackWrite; int(mode) < kvmPageTrackMax; mode++ {
+		if got, err := ParsePageTrackMode(mode.String()); err != nil || got != mode {
+			t.Errorf("ParsePageTrackMode(%q) = %v, %v, want %v", mode.String(), got, err, mode)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package sevStep
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+//VMID identifies a VM on the host
+type VMID int
+
+//DefaultVM is the VM targeted by the kernel patch, i.e. the VM that was created last (main_vm)
+const DefaultVM = VMID(0)
+
+var (
+	//ErrUnknownVM means that the backend cannot target the requested VM. The kernel patch only
+	//supports DefaultVM
+	ErrUnknownVM = errors.New("unknown VM")
+	//ErrUnknownVCPU means that the backend cannot target the requested vCPU. The kernel patch only
+	//supports vCPU 0
+	ErrUnknownVCPU = errors.New("unknown vCPU")
+)
+
+//MultiTracker is implemented by backends that can address multiple VMs and vCPUs
+type MultiTracker interface {
+	//VMs lists all VMs that can be targeted
+	VMs() ([]VMID, error)
+	//VCPUCount returns the number of vCPUs of vm that can be targeted
+	VCPUCount(vm VMID) (int, error)
+	//Tracker returns a Tracker whose commands target vm. Events carry the index of the
+	//faulting vCPU in Event.VCPU
+	Tracker(vm VMID) (Tracker, error)
+	//VCPUTracker returns a VCPUTracker whose commands target the vCPU with the given index of vm
+	VCPUTracker(vm VMID, vcpu int) (VCPUTracker, error)
+}
+
+//VCPUTracker contains the commands that target a single vCPU
+type VCPUTracker interface {
+	//CmdPollEvent returns the pending event of the vCPU, if any. Events of other vCPUs stay pending
+	CmdPollEvent() (*Event, bool, error)
+	//CmdAckEvent acks the event with id, which must belong to the vCPU
+	CmdAckEvent(id uint64) error
+	//CmdSetupRetInstrPerf programs the retired instructions counter for the vCPU on the host cpu
+	//the vCPU is pinned to
+	CmdSetupRetInstrPerf(cpu int) error
+	//CmdReadRetInstrPerf reads the retired instructions counter of the vCPU on cpu
+	CmdReadRetInstrPerf(cpu int) (uint64, error)
+}
+
+//VM is a handle to a single VM of a MultiTracker. All Cmd* calls of the embedded
+//Tracker target this VM
+type VM struct {
+	Tracker
+	id      VMID
+	backend MultiTracker
+}
+
+//VCPU is a handle to a single vCPU of a VM. All Cmd* calls of the embedded VCPUTracker
+//target this vCPU
+type VCPU struct {
+	VCPUTracker
+	vm    *VM
+	index int
+}
+
+//OpenVM returns a handle for vm. Returns ErrUnknownVM if backend cannot target vm
+func OpenVM(backend MultiTracker, vm VMID) (*VM, error) {
+	tracker, err := backend.Tracker(vm)
+	if err != nil {
+		return nil, err
+	}
+	return &VM{
+		Tracker: tracker,
+		id:      vm,
+		backend: backend,
+	}, nil
+}
+
+//ID returns the id of the VM
+func (v *VM) ID() VMID {
+	return v.id
+}
+
+//VCPU returns a handle for the vCPU with the given index. Returns ErrUnknownVCPU if the backend
+//cannot target the vCPU, e.g. for all indices but zero if the kernel patch is used
+func (v *VM) VCPU(index int) (*VCPU, error) {
+	tracker, err := v.backend.VCPUTracker(v.id, index)
+	if err != nil {
+		return nil, err
+	}
+	return &VCPU{VCPUTracker: tracker, vm: v, index: index}, nil
+}
+
+//VCPUs returns handles for all vCPUs of the VM that can be targeted
+func (v *VM) VCPUs() ([]*VCPU, error) {
+	count, err := v.backend.VCPUCount(v.id)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*VCPU, 0, count)
+	for i := 0; i < count; i++ {
+		vcpu, err := v.VCPU(i)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, vcpu)
+	}
+	return res, nil
+}
+
+//VM returns the VM of the vCPU
+func (c *VCPU) VM() *VM {
+	return c.vm
+}
+
+//Index returns the index of the vCPU inside its VM
+func (c *VCPU) Index() int {
+	return c.index
+}
+
+//Owns returns true if ev was caused by this vCPU
+func (c *VCPU) Owns(ev *Event) bool {
+	return ev.VCPU == c.index
+}
+
+func (c *VCPU) String() string {
+	return fmt.Sprintf("VM %d vCPU %d", c.vm.id, c.index)
+}
+
+//VMs returns DefaultVM, as the kernel patch only supports the VM that was created last
+func (a *IoctlAPI) VMs() ([]VMID, error) {
+	return []VMID{DefaultVM}, nil
+}
+
+//VCPUCount returns 1 for DefaultVM, as the kernel patch only supports vCPU 0
+func (a *IoctlAPI) VCPUCount(vm VMID) (int, error) {
+	if vm != DefaultVM {
+		return 0, fmt.Errorf("%w : the kernel patch only supports VM %d, requested %d", ErrUnknownVM, DefaultVM, vm)
+	}
+	return 1, nil
+}
+
+//Tracker returns the IoctlAPI itself for DefaultVM, as the kernel patch only supports the VM that
+//was created last
+func (a *IoctlAPI) Tracker(vm VMID) (Tracker, error) {
+	if vm != DefaultVM {
+		return nil, fmt.Errorf("%w : the kernel patch only supports VM %d, requested %d", ErrUnknownVM, DefaultVM, vm)
+	}
+	return a, nil
+}
+
+//VCPUTracker returns the IoctlAPI itself for vCPU 0 of DefaultVM and ErrUnknownVCPU for all other
+//vCPUs, as the kernel patch only supports vCPU 0
+func (a *IoctlAPI) VCPUTracker(vm VMID, vcpu int) (VCPUTracker, error) {
+	if _, err := a.Tracker(vm); err != nil {
+		return nil, err
+	}
+	if vcpu != 0 {
+		return nil, fmt.Errorf("%w : the kernel patch only supports vCPU 0, requested %d", ErrUnknownVCPU, vcpu)
+	}
+	return a, nil
+}
+
+//SimulatedHost is a MultiTracker running several SimulatedVM
+type SimulatedHost struct {
+	vms map[VMID]*SimulatedVM
+}
+
+//NewSimulatedHost creates a host with the given VMs
+func NewSimulatedHost(vms map[VMID]*SimulatedVM) *SimulatedHost {
+	return &SimulatedHost{vms: vms}
+}
+
+//VMs returns the ids of all VMs in ascending order
+func (h *SimulatedHost) VMs() ([]VMID, error) {
+	res := make([]VMID, 0, len(h.vms))
+	for id := range h.vms {
+		res = append(res, id)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res, nil
+}
+
+func (h *SimulatedHost) VCPUCount(vm VMID) (int, error) {
+	s, ok := h.vms[vm]
+	if !ok {
+		return 0, fmt.Errorf("%w : %d", ErrUnknownVM, vm)
+	}
+	return s.VCPUs, nil
+}
+
+func (h *SimulatedHost) Tracker(vm VMID) (Tracker, error) {
+	s, ok := h.vms[vm]
+	if !ok {
+		return nil, fmt.Errorf("%w : %d", ErrUnknownVM, vm)
+	}
+	return s, nil
+}
+
+func (h *SimulatedHost) VCPUTracker(vm VMID, vcpu int) (VCPUTracker, error) {
+	count, err := h.VCPUCount(vm)
+	if err != nil {
+		return nil, err
+	}
+	if vcpu < 0 || vcpu >= count {
+		return nil, fmt.Errorf("%w : VM %d has %d vCPUs, requested vCPU %d", ErrUnknownVCPU, vm, count, vcpu)
+	}
+	return &simulatedVCPU{vm: h.vms[vm], index: vcpu}, nil
+}
+
+//simulatedVCPU filters the events of a SimulatedVM by vCPU. The simulated performance counter
+//counts the instructions of all vCPUs
+type simulatedVCPU struct {
+	vm    *SimulatedVM
+	index int
+}
+
+func (c *simulatedVCPU) CmdPollEvent() (*Event, bool, error) {
+	return c.vm.pollEvent(c.index)
+}
+
+func (c *simulatedVCPU) CmdAckEvent(id uint64) error {
+	return c.vm.ackEvent(id, c.index)
+}
+
+func (c *simulatedVCPU) CmdSetupRetInstrPerf(cpu int) error {
+	return c.vm.CmdSetupRetInstrPerf(cpu)
+}
+
+func (c *simulatedVCPU) CmdReadRetInstrPerf(cpu int) (uint64, error) {
+	return c.vm.CmdReadRetInstrPerf(cpu)
+}
+
+var (
+	_ MultiTracker = (*IoctlAPI)(nil)
+	_ MultiTracker = (*SimulatedHost)(nil)
+	_ VCPUTracker  = (*IoctlAPI)(nil)
+	_ VCPUTracker  = (*simulatedVCPU)(nil)
+)
@@ -0,0 +1,84 @@
+package sevStep
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSimulatedHost_OpenVM(t *testing.T) {
+	smp := NewSimulatedVM(4, []GuestAccess{
+		{GPA: 0x1000, Kind: AccessRead, VCPU: 1},
+		{GPA: 0x2000, Kind: AccessRead, VCPU: 0},
+	}, false)
+	smp.VCPUs = 2
+	host := NewSimulatedHost(map[VMID]*SimulatedVM{
+		DefaultVM: NewSimulatedVM(4, nil, false),
+		1:         smp,
+	})
+
+	gotVMs, err := host.VMs()
+	if err != nil || !reflect.DeepEqual(gotVMs, []VMID{0, 1}) {
+		t.Errorf("VMs() got = %v, %v, want [0 1]", gotVMs, err)
+	}
+	if _, err := OpenVM(host, 2); !errors.Is(err, ErrUnknownVM) {
+		t.Errorf("OpenVM() for unknown VM got err = %v, want %v", err, ErrUnknownVM)
+	}
+
+	vm, err := OpenVM(host, 1)
+	if err != nil {
+		t.Fatalf("OpenVM() failed : %v", err)
+	}
+	if _, err := vm.VCPU(2); !errors.Is(err, ErrUnknownVCPU) {
+		t.Errorf("VCPU() for unknown vCPU got err = %v, want %v", err, ErrUnknownVCPU)
+	}
+	vcpus, err := vm.VCPUs()
+	if err != nil || len(vcpus) != 2 {
+		t.Fatalf("VCPUs() got = %v, %v, want 2 vCPUs", vcpus, err)
+	}
+
+	if err := vm.CmdTrackAllPages(PageTrackAccess); err != nil {
+		t.Fatalf("CmdTrackAllPages failed : %v", err)
+	}
+	for _, wantVCPU := range []int{1, 0} {
+		other := vcpus[1-wantVCPU]
+		//the event of wantVCPU stays pending for the other vCPU
+		if _, ok, err := other.CmdPollEvent(); ok || err != nil {
+			t.Fatalf("CmdPollEvent() of %v got = %v, %v, want no event", other, ok, err)
+		}
+		ev, ok, err := vcpus[wantVCPU].CmdPollEvent()
+		if err != nil || !ok {
+			t.Fatalf("CmdPollEvent() got = %v, %v, want event", ok, err)
+		}
+		if !vcpus[wantVCPU].Owns(ev) || other.Owns(ev) {
+			t.Errorf("event %v should belong to vCPU %d", ev, wantVCPU)
+		}
+		if err := other.CmdAckEvent(ev.ID); !errors.Is(err, ErrAckMismatch) {
+			t.Errorf("CmdAckEvent() of %v got err = %v, want %v", other, err, ErrAckMismatch)
+		}
+		if err := vcpus[wantVCPU].CmdAckEvent(ev.ID); err != nil {
+			t.Fatalf("CmdAckEvent failed : %v", err)
+		}
+	}
+}
+
+func TestIoctlAPI_VCPUTracker(t *testing.T) {
+	tests := []struct {
+		name    string
+		vm      VMID
+		vcpu    int
+		wantErr error
+	}{
+		{name: "vCPU 0", vm: DefaultVM, vcpu: 0},
+		{name: "vCPU 1", vm: DefaultVM, vcpu: 1, wantErr: ErrUnknownVCPU},
+		{name: "other VM", vm: 1, vcpu: 0, wantErr: ErrUnknownVM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := (&IoctlAPI{}).VCPUTracker(tt.vm, tt.vcpu)
+			if !errors.Is(err, tt.wantErr) || (err != nil) != (tt.wantErr != nil) {
+				t.Errorf("VCPUTracker() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
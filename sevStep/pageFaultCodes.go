@@ -1,23 +1,33 @@
 package sevStep
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
-type PfErrorBit uint32
+type PfErrorBit uint64
 
 //Uses PFERR_*** defintions from Linux at arch/x86/include/asm/kvm_host.h line 205 ff
 const (
-	PfErrorPresent = PfErrorBit(uint32(0x1) << 0)
-	PfErrorWrite   = PfErrorBit(uint32(0x1) << 1)
-	PfErrorUser    = PfErrorBit(uint32(0x1) << 2)
-	PfErrorRSVD    = PfErrorBit(uint32(0x1) << 3)
-	PfErrorFetch   = PfErrorBit(uint32(0x1) << 4)
-	PfErrorPK      = PfErrorBit(uint32(0x1) << 5)
+	PfErrorPresent = PfErrorBit(uint64(0x1) << 0)
+	PfErrorWrite   = PfErrorBit(uint64(0x1) << 1)
+	PfErrorUser    = PfErrorBit(uint64(0x1) << 2)
+	PfErrorRSVD    = PfErrorBit(uint64(0x1) << 3)
+	PfErrorFetch   = PfErrorBit(uint64(0x1) << 4)
+	PfErrorPK      = PfErrorBit(uint64(0x1) << 5)
+	PfErrorSGX     = PfErrorBit(uint64(0x1) << 15)
+	//PfErrorRMP is set by SEV-SNP capable CPUs if the fault was caused by an RMP check
+	PfErrorRMP = PfErrorBit(uint64(0x1) << 31)
+	//PfErrorGuestFinal and PfErrorGuestPage are set by KVM for nested page faults on the final
+	//guest physical address and on a guest page table access, respectively
+	PfErrorGuestFinal = PfErrorBit(uint64(0x1) << 32)
+	PfErrorGuestPage  = PfErrorBit(uint64(0x1) << 33)
 )
 
-var allPfErrors = []PfErrorBit{PfErrorPresent, PfErrorWrite, PfErrorUser, PfErrorRSVD, PfErrorFetch, PfErrorPK}
+var allPfErrors = []PfErrorBit{PfErrorPresent, PfErrorWrite, PfErrorUser, PfErrorRSVD, PfErrorFetch, PfErrorPK,
+	PfErrorSGX, PfErrorRMP, PfErrorGuestFinal, PfErrorGuestPage}
 
 func (p PfErrorBit) String() string {
 	switch p {
@@ -33,30 +43,124 @@ func (p PfErrorBit) String() string {
 		return "Fetch"
 	case PfErrorPK:
 		return "PK"
+	case PfErrorSGX:
+		return "SGX"
+	case PfErrorRMP:
+		return "RMP"
+	case PfErrorGuestFinal:
+		return "GuestFinal"
+	case PfErrorGuestPage:
+		return "GuestPage"
 	default:
 		return "Unknown"
 	}
 }
 
-//ArePfErrorsSet returns true if all bits are set
-func ArePfErrorsSet(errorCode uint32, bits ...PfErrorBit) bool {
+//ErrorCode is the error code of a page fault, i.e. a set of PfErrorBit
+type ErrorCode uint64
+
+//errorCodeSeparator separates the flag names in the string representation of ErrorCode
+const errorCodeSeparator = "|"
+
+//Has returns true if all bits are set
+func (c ErrorCode) Has(bits ...PfErrorBit) bool {
 	for _, v := range bits {
-		if errorCode&uint32(v) == 0 {
+		if uint64(c)&uint64(v) == 0 {
 			return false
 		}
 	}
 	return true
 }
 
-//ErrorCodeToString returns a string with the names of the errors bits set in code
-func ErrorCodeToString(code uint32) (string, error) {
-	buf := strings.Builder{}
+func (c ErrorCode) Present() bool    { return c.Has(PfErrorPresent) }
+func (c ErrorCode) Write() bool      { return c.Has(PfErrorWrite) }
+func (c ErrorCode) User() bool       { return c.Has(PfErrorUser) }
+func (c ErrorCode) RSVD() bool       { return c.Has(PfErrorRSVD) }
+func (c ErrorCode) Fetch() bool      { return c.Has(PfErrorFetch) }
+func (c ErrorCode) PK() bool         { return c.Has(PfErrorPK) }
+func (c ErrorCode) SGX() bool        { return c.Has(PfErrorSGX) }
+func (c ErrorCode) RMP() bool        { return c.Has(PfErrorRMP) }
+func (c ErrorCode) GuestFinal() bool { return c.Has(PfErrorGuestFinal) }
+func (c ErrorCode) GuestPage() bool  { return c.Has(PfErrorGuestPage) }
+
+//String returns the names of the set bits, separated by "|", e.g. "Present|Fetch". Bits without
+//a name are appended as hex number. Zero is represented as "0"
+func (c ErrorCode) String() string {
+	if c == 0 {
+		return "0"
+	}
+	names := make([]string, 0)
+	remaining := uint64(c)
 	for _, v := range allPfErrors {
-		if ArePfErrorsSet(code, v) {
-			if _, err := buf.WriteString(v.String() + " "); err != nil {
-				return "", fmt.Errorf("allocation error : err")
+		if c.Has(v) {
+			names = append(names, v.String())
+			remaining &^= uint64(v)
+		}
+	}
+	if remaining != 0 {
+		names = append(names, fmt.Sprintf("0x%x", remaining))
+	}
+	return strings.Join(names, errorCodeSeparator)
+}
+
+//ParseErrorCode parses the output of ErrorCode.String. Numbers, in decimal or with 0x prefix,
+//are accepted for any part
+func ParseErrorCode(s string) (ErrorCode, error) {
+	var code ErrorCode
+	for _, part := range strings.Split(s, errorCodeSeparator) {
+		part = strings.TrimSpace(part)
+		found := false
+		for _, v := range allPfErrors {
+			if strings.EqualFold(part, v.String()) {
+				code |= ErrorCode(v)
+				found = true
+				break
 			}
 		}
+		if found {
+			continue
+		}
+		value, err := strconv.ParseUint(part, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unknown page fault error bit %q", part)
+		}
+		code |= ErrorCode(value)
 	}
-	return buf.String(), nil
+	return code, nil
+}
+
+//MarshalJSON encodes the error code as string of flag names, see String
+func (c ErrorCode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+//UnmarshalJSON accepts the output of MarshalJSON as well as plain numbers, as used by older traces
+func (c *ErrorCode) UnmarshalJSON(b []byte) error {
+	var value uint64
+	if err := json.Unmarshal(b, &value); err == nil {
+		*c = ErrorCode(value)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("failed to unmarshal ErrorCode : %v", err)
+	}
+	parsed, err := ParseErrorCode(s)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal ErrorCode : %v", err)
+	}
+	*c = parsed
+	return nil
+}
+
+//ArePfErrorsSet returns true if all bits are set
+func ArePfErrorsSet(errorCode uint32, bits ...PfErrorBit) bool {
+	return ErrorCode(errorCode).Has(bits...)
+}
+
+//ErrorCodeToString returns a string with the names of the errors bits set in code.
+//
+//Deprecated: use ErrorCode.String
+func ErrorCodeToString(code uint32) (string, error) {
+	return ErrorCode(code).String(), nil
 }
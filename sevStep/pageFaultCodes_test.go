@@ -0,0 +1,63 @@
+package sevStep
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestErrorCode_String_ParseErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		code ErrorCode
+		want string
+	}{
+		{
+			name: "Zero",
+			code: 0,
+			want: "0",
+		},
+		{
+			name: "Legacy bits",
+			code: ErrorCode(PfErrorPresent | PfErrorUser | PfErrorFetch),
+			want: "Present|User|Fetch",
+		},
+		{
+			name: "SNP bits",
+			code: ErrorCode(PfErrorWrite | PfErrorRMP | PfErrorGuestFinal | PfErrorGuestPage),
+			want: "Write|RMP|GuestFinal|GuestPage",
+		},
+		{
+			name: "Unnamed bits",
+			code: ErrorCode(PfErrorSGX) | 0x300,
+			want: "SGX|0x300",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.code.String(); got != tt.want {
+				t.Errorf("String() = %v, want %v", got, tt.want)
+			}
+			parsed, err := ParseErrorCode(tt.want)
+			if err != nil || parsed != tt.code {
+				t.Errorf("ParseErrorCode() got = %v, %v, want %v", parsed, err, tt.code)
+			}
+
+			buf, err := json.Marshal(tt.code)
+			if err != nil {
+				t.Fatalf("failed to marshal : %v", err)
+			}
+			var decoded ErrorCode
+			if err := json.Unmarshal(buf, &decoded); err != nil || decoded != tt.code {
+				t.Errorf("json roundtrip of %s got = %v, %v", buf, decoded, err)
+			}
+		})
+	}
+
+	var decoded ErrorCode
+	if err := json.Unmarshal([]byte("20"), &decoded); err != nil || !decoded.User() || !decoded.Fetch() || decoded.Present() {
+		t.Errorf("json.Unmarshal() of number got = %v, %v", decoded, err)
+	}
+	if _, err := ParseErrorCode("Present|Bogus"); err == nil {
+		t.Errorf("ParseErrorCode() with unknown name did not fail")
+	}
+}
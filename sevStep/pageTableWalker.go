@@ -0,0 +1,170 @@
+package sevStep
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//PagingMode is the number of page table levels used by the guest
+type PagingMode int
+
+const (
+	//PagingMode4Level uses PML4, PDPT, PD and PT with 48 bit virtual addresses
+	PagingMode4Level = PagingMode(4)
+	//PagingMode5Level uses an additional PML5 with 57 bit virtual addresses (CR4.LA57)
+	PagingMode5Level = PagingMode(5)
+)
+
+//Bits of x86-64 page table entries, see Intel SDM Vol. 3 Section 4.5
+const (
+	pteBitPresent  = uint64(1) << 0
+	pteBitWritable = uint64(1) << 1
+	pteBitUser     = uint64(1) << 2
+	pteBitLarge    = uint64(1) << 7
+	pteBitNX       = uint64(1) << 63
+	//pteAddrMask are the address bits 12 to 51 of an entry
+	pteAddrMask = uint64(0x000ffffffffff000)
+)
+
+var (
+	//ErrPageNotPresent means that the walk reached an entry with the present bit unset
+	ErrPageNotPresent = errors.New("page not present")
+	//ErrNonCanonicalAddress means that the virtual address is not canonical for the paging mode
+	ErrNonCanonicalAddress = errors.New("non canonical address")
+)
+
+//Translation is the result of a page table walk
+type Translation struct {
+	GVA uint64
+	GPA uint64
+	//PageSize is 4KB, 2MB or 1GB
+	PageSize uint64
+	//Writable, User and NoExecute are the effective permissions of all levels
+	Writable  bool
+	User      bool
+	NoExecute bool
+	//Entries contains the raw page table entry of each visited level, starting at the top level
+	Entries []uint64
+}
+
+//PageBase returns the GPA of the first byte of the (4KB) page that contains GPA. Use this
+//with CmdTrackPage, as tracking works on 4KB granularity even for large pages
+func (t *Translation) PageBase() uint64 {
+	return t.GPA &^ (pageSize - 1)
+}
+
+//PageTableWalker translates guest virtual addresses to guest physical addresses by walking the
+//guest's x86-64 page tables, starting at CR3. The page tables are read with Mem.
+//Note that the page tables of SEV guests are encrypted with the guest's key. Thus, the walker
+//only works for plain VMs or if Mem provides decrypted guest memory.
+//The guest's CR3 value is not exposed by the kernel patch, and must be obtained otherwise,
+//e.g. from inside the guest
+type PageTableWalker struct {
+	//Mem reads guest physical memory
+	Mem io.ReaderAt
+	//Mode is the guest's paging mode
+	Mode PagingMode
+	//CBitMask is cleared from CR3 and all entries before using them as addresses. For SEV guests,
+	//set this to 1 << position of the C-bit (see CPUID 0x8000001F[EBX])
+	CBitMask uint64
+}
+
+//NewPageTableWalker creates a PageTableWalker reading the page tables from mem
+func NewPageTableWalker(mem io.ReaderAt, mode PagingMode) *PageTableWalker {
+	return &PageTableWalker{
+		Mem:  mem,
+		Mode: mode,
+	}
+}
+
+//NewTrackerPageTableWalker creates a PageTableWalker that reads the page tables with a GuestMemory
+//without caching. See CmdReadGuestMemory for hostDecryption and wbinvdCPU
+func NewTrackerPageTableWalker(tracker Tracker, mode PagingMode, hostDecryption bool, wbinvdCPU int) *PageTableWalker {
+	view := MemoryViewCiphertext
+	if hostDecryption {
+		view = MemoryViewHostDecrypted
+	}
+	mem := NewGuestMemory(tracker, view, false)
+	mem.WbinvdCPU = wbinvdCPU
+	return NewPageTableWalker(mem, mode)
+}
+
+//isCanonical checks that all bits above the most significant virtual address bit are equal to it
+func (w *PageTableWalker) isCanonical(gva uint64) bool {
+	vaBits := uint(12 + 9*int(w.Mode))
+	upper := int64(gva) >> (vaBits - 1)
+	return upper == 0 || upper == -1
+}
+
+func (w *PageTableWalker) readEntry(tableGPA, index uint64) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := w.Mem.ReadAt(buf, int64(tableGPA+8*index)); err != nil {
+		return 0, fmt.Errorf("failed to read entry %d of table at 0x%x : %w", index, tableGPA, err)
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+//Translate walks the page tables at cr3 and returns the translation of gva. Returns ErrPageNotPresent
+//if gva is not mapped
+func (w *PageTableWalker) Translate(cr3, gva uint64) (*Translation, error) {
+	if w.Mode != PagingMode4Level && w.Mode != PagingMode5Level {
+		return nil, fmt.Errorf("unsupported paging mode %d", w.Mode)
+	}
+	if !w.isCanonical(gva) {
+		return nil, fmt.Errorf("%w : 0x%x", ErrNonCanonicalAddress, gva)
+	}
+
+	res := &Translation{
+		GVA:      gva,
+		Writable: true,
+		User:     true,
+		Entries:  make([]uint64, 0, int(w.Mode)),
+	}
+	tableGPA := cr3 & pteAddrMask &^ w.CBitMask
+	for level := int(w.Mode); level >= 1; level-- {
+		shift := uint(12 + 9*(level-1))
+		index := (gva >> shift) & 0x1ff
+		entry, err := w.readEntry(tableGPA, index)
+		if err != nil {
+			return nil, err
+		}
+		res.Entries = append(res.Entries, entry)
+		if entry&pteBitPresent == 0 {
+			return nil, fmt.Errorf("%w : 0x%x at level %d", ErrPageNotPresent, gva, level)
+		}
+		res.Writable = res.Writable && entry&pteBitWritable != 0
+		res.User = res.User && entry&pteBitUser != 0
+		res.NoExecute = res.NoExecute || entry&pteBitNX != 0
+		addr := entry & pteAddrMask &^ w.CBitMask
+
+		//large pages are only possible in PDPT (1GB) and PD (2MB)
+		if entry&pteBitLarge != 0 && (level == 3 || level == 2) {
+			res.PageSize = uint64(1) << shift
+			res.GPA = (addr &^ (res.PageSize - 1)) | (gva & (res.PageSize - 1))
+			return res, nil
+		}
+		if level == 1 {
+			res.PageSize = pageSize
+			res.GPA = addr | (gva & (pageSize - 1))
+			return res, nil
+		}
+		tableGPA = addr
+	}
+	//unreachable, the loop always returns at level 1
+	return nil, fmt.Errorf("page table walk for 0x%x did not terminate", gva)
+}
+
+//TrackVirtualPage translates gva and tracks the containing page with tracker.
+//Returns the GPA of the tracked page
+func (w *PageTableWalker) TrackVirtualPage(tracker Tracker, cr3, gva uint64, trackMode PageTrackMode) (uint64, error) {
+	t, err := w.Translate(cr3, gva)
+	if err != nil {
+		return 0, fmt.Errorf("failed to translate 0x%x : %w", gva, err)
+	}
+	if err := tracker.CmdTrackPage(t.PageBase(), trackMode); err != nil {
+		return 0, fmt.Errorf("failed to track 0x%x : %w", t.PageBase(), err)
+	}
+	return t.PageBase(), nil
+}
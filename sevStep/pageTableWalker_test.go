@@ -0,0 +1,140 @@
+package sevStep
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestPageTableWalker_Translate(t *testing.T) {
+	const (
+		cBit     = uint64(1) << 47
+		pml5     = uint64(0x6000)
+		pml4     = uint64(0x1000)
+		pdpt     = uint64(0x2000)
+		pd       = uint64(0x3000)
+		pt       = uint64(0x4000)
+		present  = pteBitPresent | pteBitWritable | pteBitUser
+		baseGVA  = uint64(0x00007f0000000000)
+		smallGVA = baseGVA | 1<<21 | 1<<12 | 0x123
+	)
+	vm := NewSimulatedVM(8, nil, false)
+	writeEntry := func(table, index, entry uint64) {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, entry)
+		if err := vm.WriteGuestMemory(table+8*index, buf); err != nil {
+			t.Fatalf("failed to write page table entry : %v", err)
+		}
+	}
+	writeEntry(pml5, 0, pml4|cBit|present)
+	writeEntry(pml4, 0xfe, pdpt|cBit|present)
+	writeEntry(pdpt, 0, pd|cBit|present)
+	//1GB page
+	writeEntry(pdpt, 1, 0x40000000|cBit|present|pteBitLarge)
+	writeEntry(pd, 1, pt|cBit|present)
+	//2MB page, not executable
+	writeEntry(pd, 2, 0x200000|cBit|present|pteBitLarge|pteBitNX)
+	//read only 4KB page
+	writeEntry(pt, 1, 0x5000|cBit|pteBitPresent|pteBitUser)
+
+	tests := []struct {
+		name          string
+		mode          PagingMode
+		cr3           uint64
+		gva           uint64
+		wantGPA       uint64
+		wantPageSize  uint64
+		wantWritable  bool
+		wantNoExecute bool
+		wantErr       error
+	}{
+		{
+			name:         "4KB page",
+			mode:         PagingMode4Level,
+			cr3:          pml4 | cBit,
+			gva:          smallGVA,
+			wantGPA:      0x5123,
+			wantPageSize: pageSize,
+		},
+		{
+			name:          "2MB page",
+			mode:          PagingMode4Level,
+			cr3:           pml4,
+			gva:           baseGVA | 2<<21 | 0x1234,
+			wantGPA:       0x201234,
+			wantPageSize:  1 << 21,
+			wantWritable:  true,
+			wantNoExecute: true,
+		},
+		{
+			name:         "1GB page",
+			mode:         PagingMode4Level,
+			cr3:          pml4,
+			gva:          baseGVA | 1<<30 | 0x5,
+			wantGPA:      0x40000005,
+			wantPageSize: 1 << 30,
+			wantWritable: true,
+		},
+		{
+			name:         "5-level",
+			mode:         PagingMode5Level,
+			cr3:          pml5,
+			gva:          smallGVA,
+			wantGPA:      0x5123,
+			wantPageSize: pageSize,
+		},
+		{
+			name:    "Not present",
+			mode:    PagingMode4Level,
+			cr3:     pml4,
+			gva:     baseGVA | 3<<21,
+			wantErr: ErrPageNotPresent,
+		},
+		{
+			name:    "Non canonical",
+			mode:    PagingMode4Level,
+			cr3:     pml4,
+			gva:     0x0000800000000000,
+			wantErr: ErrNonCanonicalAddress,
+		},
+		{
+			name:    "Canonical with 5-level",
+			mode:    PagingMode5Level,
+			cr3:     pml5,
+			gva:     0x0000800000000000,
+			wantErr: ErrPageNotPresent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			walker := NewTrackerPageTableWalker(vm, tt.mode, true, -1)
+			walker.CBitMask = cBit
+			got, err := walker.Translate(tt.cr3, tt.gva)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Translate() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Translate() error = %v", err)
+			}
+			if got.GPA != tt.wantGPA || got.PageSize != tt.wantPageSize {
+				t.Errorf("Translate() got GPA 0x%x with page size 0x%x, want 0x%x with 0x%x", got.GPA, got.PageSize, tt.wantGPA, tt.wantPageSize)
+			}
+			if got.Writable != tt.wantWritable || got.NoExecute != tt.wantNoExecute || !got.User {
+				t.Errorf("Translate() got permissions %+v", got)
+			}
+			if len(got.Entries) == 0 || len(got.Entries) > int(tt.mode) {
+				t.Errorf("Translate() got %d entries", len(got.Entries))
+			}
+		})
+	}
+
+	walker := NewTrackerPageTableWalker(vm, PagingMode4Level, true, -1)
+	walker.CBitMask = cBit
+	gpa, err := walker.TrackVirtualPage(vm, pml4, smallGVA, PageTrackAccess)
+	if err != nil || gpa != 0x5000 {
+		t.Errorf("TrackVirtualPage() got = 0x%x, %v, want 0x5000", gpa, err)
+	}
+}
@@ -0,0 +1,70 @@
+package sevStep
+
+import (
+	"fmt"
+)
+
+//RetInstrCounter measures the instructions the guest retires between two interactive events.
+//The kernel only reports retired instructions for batch events, as uspt_send_and_block always
+//clears have_retired_instructions. The counter only counts the guest instructions executed on CPU,
+//thus the vCPU must be pinned to it
+type RetInstrCounter struct {
+	//CPU on which the performance counter is programmed
+	CPU int
+
+	tracker Tracker
+	//baseline is the counter value when the guest was last resumed
+	baseline uint64
+}
+
+//NewRetInstrCounter programs the retired instructions performance counter on cpu and reads the
+//initial baseline
+func NewRetInstrCounter(tracker Tracker, cpu int) (*RetInstrCounter, error) {
+	if err := tracker.CmdSetupRetInstrPerf(cpu); err != nil {
+		return nil, fmt.Errorf("failed to setup retired instructions counter on cpu %v : %w", cpu, err)
+	}
+	c := &RetInstrCounter{
+		CPU:     cpu,
+		tracker: tracker,
+	}
+	if err := c.Rebase(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//Rebase sets the baseline to the current counter value. Call this right before the guest is
+//resumed, i.e. before acking an event
+func (c *RetInstrCounter) Rebase() error {
+	value, err := c.tracker.CmdReadRetInstrPerf(c.CPU)
+	if err != nil {
+		return fmt.Errorf("failed to read retired instructions counter on cpu %v : %w", c.CPU, err)
+	}
+	c.baseline = value
+	return nil
+}
+
+//Delta returns the instructions retired since the last Rebase. As read_ctr masks the counter to
+//48 bits, the difference is taken modulo 2^48 to handle overflows
+func (c *RetInstrCounter) Delta() (uint64, error) {
+	value, err := c.tracker.CmdReadRetInstrPerf(c.CPU)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read retired instructions counter on cpu %v : %w", c.CPU, err)
+	}
+	return (value - c.baseline) & perfCounterMask, nil
+}
+
+//Fill sets ev.RetiredInstructions to Delta. Events that already carry retired instructions,
+//e.g. from batch tracking, are not modified
+func (c *RetInstrCounter) Fill(ev *Event) error {
+	if ev.HaveRetiredInstructions {
+		return nil
+	}
+	delta, err := c.Delta()
+	if err != nil {
+		return fmt.Errorf("event %v : %w", ev.ID, err)
+	}
+	ev.HaveRetiredInstructions = true
+	ev.RetiredInstructions = delta
+	return nil
+}
@@ -0,0 +1,76 @@
+package sevStep
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRetInstrCounter_EventLoop(t *testing.T) {
+	tests := []struct {
+		name         string
+		initialValue uint64
+	}{
+		{name: "Start at zero", initialValue: 0},
+		{name: "48 bit wrap", initialValue: perfCounterMask - 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := []GuestAccess{
+				{GPA: 0x1000, Kind: AccessExec, RetiredInstructions: 3},
+				{GPA: 0x2000, Kind: AccessExec, RetiredInstructions: 5},
+				{GPA: 0x1000, Kind: AccessExec, RetiredInstructions: 1},
+				{GPA: 0x2000, Kind: AccessExec, RetiredInstructions: 2},
+			}
+			vm := NewSimulatedVM(4, script, false)
+			vm.perfCounter = tt.initialValue
+			for _, gpa := range []uint64{0x1000, 0x2000} {
+				if err := vm.CmdTrackPage(gpa, PageTrackExec); err != nil {
+					t.Fatalf("CmdTrackPage failed : %v", err)
+				}
+			}
+			loop := NewEventLoop(vm)
+			loop.RetrackMode = PageTrackExec
+			var err error
+			if loop.RetInstr, err = NewRetInstrCounter(vm, 2); err != nil {
+				t.Fatalf("NewRetInstrCounter failed : %v", err)
+			}
+
+			want := []uint64{3, 5, 1, 2}
+			got := make([]uint64, 0)
+			err = loop.Run(context.Background(), func(ev *Event) (EventAction, error) {
+				if !ev.HaveRetiredInstructions {
+					t.Errorf("event %v has no retired instructions", ev.ID)
+				}
+				got = append(got, ev.RetiredInstructions)
+				if len(got) == len(want) {
+					return EventActionStop, nil
+				}
+				return EventActionRetrack, nil
+			})
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			for i := range want {
+				if i >= len(got) || got[i] != want[i] {
+					t.Fatalf("retired instructions = %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetInstrCounter_Fill_KeepsBatchValues(t *testing.T) {
+	vm := NewSimulatedVM(1, nil, false)
+	c, err := NewRetInstrCounter(vm, 0)
+	if err != nil {
+		t.Fatalf("NewRetInstrCounter failed : %v", err)
+	}
+	vm.perfCounter = 100
+	ev := &Event{HaveRetiredInstructions: true, RetiredInstructions: 7}
+	if err := c.Fill(ev); err != nil {
+		t.Fatalf("Fill failed : %v", err)
+	}
+	if ev.RetiredInstructions != 7 {
+		t.Errorf("Fill changed RetiredInstructions to %v", ev.RetiredInstructions)
+	}
+}
@@ -0,0 +1,499 @@
+package sevStep
+
+//This file contains a Tracker wrapper that records all api calls to a session file as well as
+//a Tracker backend that replays such a session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Names of the Tracker commands, as used in SessionCall.Command
+const (
+	SessionCmdReset                   = "CmdReset"
+	SessionCmdReadGuestMemory         = "CmdReadGuestMemory"
+	SessionCmdAckEvent                = "CmdAckEvent"
+	SessionCmdPollEvent               = "CmdPollEvent"
+	SessionCmdTrackPage               = "CmdTrackPage"
+	SessionCmdTrackAllPages           = "CmdTrackAllPages"
+	SessionCmdUnTrackAllPages         = "CmdUnTrackAllPages"
+	SessionCmdSetupRetInstrPerf       = "CmdSetupRetInstrPerf"
+	SessionCmdReadRetInstrPerf        = "CmdReadRetInstrPerf"
+	SessionCmdBatchTrackingStart      = "CmdBatchTrackingStart"
+	SessionCmdBatchTrackingEventCount = "CmdBatchTrackingEventCount"
+	SessionCmdBatchTrackingStopAndGet = "CmdBatchTrackingStopAndGet"
+	SessionCmdClose                   = "Close"
+)
+
+var (
+	//ErrReplayDivergence is returned by Replayer if a call does not match the recorded session
+	ErrReplayDivergence = errors.New("replay diverged from recorded session")
+	//ErrReplayEndOfSession is returned by Replayer if all recorded calls have been replayed
+	ErrReplayEndOfSession = errors.New("replay reached end of recorded session")
+)
+
+//SessionArgs are the arguments of a recorded call. Only the fields used by SessionCall.Command are set
+type SessionArgs struct {
+	GPA            uint64        `json:"gpa,omitempty"`
+	Size           uint64        `json:"size,omitempty"`
+	HostDecryption bool          `json:"host_decryption,omitempty"`
+	WbinvdCPU      int           `json:"wbinvd_cpu,omitempty"`
+	ID             uint64        `json:"id,omitempty"`
+	TrackMode      PageTrackMode `json:"track_mode,omitempty"`
+	CPU            int           `json:"cpu,omitempty"`
+	ExpectedEvents uint64        `json:"expected_events,omitempty"`
+	Retrack        bool          `json:"retrack,omitempty"`
+	EventCount     uint64        `json:"event_count,omitempty"`
+}
+
+//SessionCall is a single recorded call. A session file contains one JSON encoded SessionCall per line
+type SessionCall struct {
+	Seq     uint64        `json:"seq"`
+	Command string        `json:"command"`
+	Args    SessionArgs   `json:"args"`
+	Start   time.Time     `json:"start"`
+	Elapsed time.Duration `json:"elapsed"`
+
+	//Results. Only the fields returned by Command are set
+
+	Event      *Event    `json:"event,omitempty"`
+	Events     []*Event  `json:"events,omitempty"`
+	Ok         bool      `json:"ok,omitempty"`
+	BatchError bool      `json:"batch_error,omitempty"`
+	Value      uint64    `json:"value,omitempty"`
+	Data       jsonBytes `json:"data,omitempty"`
+
+	//Error is the message of the returned error, if any
+	Error string `json:"error,omitempty"`
+	//Errno is the errno wrapped by the returned error, if any
+	Errno syscall.Errno `json:"errno,omitempty"`
+	//IoctlError is the IoctlError wrapped by the returned error, if any
+	IoctlError *IoctlError `json:"ioctl_error,omitempty"`
+}
+
+//replayedError is returned by Replayer for recorded errors. It unwraps to the recorded
+//IoctlError or, if there is none, to the recorded errno
+type replayedError struct {
+	msg      string
+	errno    syscall.Errno
+	ioctlErr *IoctlError
+}
+
+func (e *replayedError) Error() string {
+	return e.msg
+}
+
+func (e *replayedError) Unwrap() error {
+	if e.ioctlErr != nil {
+		return e.ioctlErr
+	}
+	if e.errno == 0 {
+		return nil
+	}
+	return e.errno
+}
+
+func (c *SessionCall) setError(err error) {
+	if err == nil {
+		return
+	}
+	c.Error = err.Error()
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		c.Errno = errno
+	}
+	var ioctlErr *IoctlError
+	if errors.As(err, &ioctlErr) {
+		c.IoctlError = ioctlErr
+	}
+}
+
+func (c *SessionCall) err() error {
+	if c.Error == "" {
+		return nil
+	}
+	return &replayedError{msg: c.Error, errno: c.Errno, ioctlErr: c.IoctlError}
+}
+
+//Recorder wraps a Tracker and writes every call, with arguments, results, error and
+//timing to a session file. The session can be replayed with Replayer
+type Recorder struct {
+	tracker Tracker
+	mu      sync.Mutex
+	enc     *json.Encoder
+	seq     uint64
+	//writeErr is the first error that occurred while writing the session
+	writeErr error
+}
+
+//NewRecorder returns a Tracker that forwards all calls to tracker and records them to w
+//as JSON lines. Errors while writing the session do not affect the forwarded calls but
+//are returned by Close
+func NewRecorder(tracker Tracker, w io.Writer) *Recorder {
+	return &Recorder{
+		tracker: tracker,
+		enc:     json.NewEncoder(w),
+	}
+}
+
+func (r *Recorder) record(call *SessionCall, start time.Time, err error) {
+	call.Start = start
+	call.Elapsed = time.Since(start)
+	call.setError(err)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	call.Seq = r.seq
+	r.seq++
+	if r.writeErr != nil {
+		return
+	}
+	if err := r.enc.Encode(call); err != nil {
+		r.writeErr = fmt.Errorf("failed to write session call %v : %v", call.Seq, err)
+	}
+}
+
+func (r *Recorder) CmdReset() error {
+	start := time.Now()
+	err := r.tracker.CmdReset()
+	r.record(&SessionCall{Command: SessionCmdReset}, start, err)
+	return err
+}
+
+func (r *Recorder) CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error) {
+	start := time.Now()
+	data, err := r.tracker.CmdReadGuestMemory(gpa, size, hostDecryption, wbinvdCPU)
+	r.record(&SessionCall{
+		Command: SessionCmdReadGuestMemory,
+		Args:    SessionArgs{GPA: gpa, Size: size, HostDecryption: hostDecryption, WbinvdCPU: wbinvdCPU},
+		Data:    data,
+	}, start, err)
+	return data, err
+}
+
+func (r *Recorder) CmdAckEvent(id uint64) error {
+	start := time.Now()
+	err := r.tracker.CmdAckEvent(id)
+	r.record(&SessionCall{Command: SessionCmdAckEvent, Args: SessionArgs{ID: id}}, start, err)
+	return err
+}
+
+func (r *Recorder) CmdPollEvent() (*Event, bool, error) {
+	start := time.Now()
+	ev, ok, err := r.tracker.CmdPollEvent()
+	r.record(&SessionCall{Command: SessionCmdPollEvent, Event: ev, Ok: ok}, start, err)
+	return ev, ok, err
+}
+
+func (r *Recorder) CmdTrackPage(gpa uint64, trackMode PageTrackMode) error {
+	start := time.Now()
+	err := r.tracker.CmdTrackPage(gpa, trackMode)
+	r.record(&SessionCall{Command: SessionCmdTrackPage, Args: SessionArgs{GPA: gpa, TrackMode: trackMode}}, start, err)
+	return err
+}
+
+func (r *Recorder) CmdTrackAllPages(trackMode PageTrackMode) error {
+	start := time.Now()
+	err := r.tracker.CmdTrackAllPages(trackMode)
+	r.record(&SessionCall{Command: SessionCmdTrackAllPages, Args: SessionArgs{TrackMode: trackMode}}, start, err)
+	return err
+}
+
+func (r *Recorder) CmdUnTrackAllPages(trackMode PageTrackMode) error {
+	start := time.Now()
+	err := r.tracker.CmdUnTrackAllPages(trackMode)
+	r.record(&SessionCall{Command: SessionCmdUnTrackAllPages, Args: SessionArgs{TrackMode: trackMode}}, start, err)
+	return err
+}
+
+func (r *Recorder) CmdSetupRetInstrPerf(cpu int) error {
+	start := time.Now()
+	err := r.tracker.CmdSetupRetInstrPerf(cpu)
+	r.record(&SessionCall{Command: SessionCmdSetupRetInstrPerf, Args: SessionArgs{CPU: cpu}}, start, err)
+	return err
+}
+
+func (r *Recorder) CmdReadRetInstrPerf(cpu int) (uint64, error) {
+	start := time.Now()
+	value, err := r.tracker.CmdReadRetInstrPerf(cpu)
+	r.record(&SessionCall{Command: SessionCmdReadRetInstrPerf, Args: SessionArgs{CPU: cpu}, Value: value}, start, err)
+	return value, err
+}
+
+func (r *Recorder) CmdBatchTrackingStart(trackingType PageTrackMode, expectedEvents uint64, perfCPU int, retrack bool) error {
+	start := time.Now()
+	err := r.tracker.CmdBatchTrackingStart(trackingType, expectedEvents, perfCPU, retrack)
+	r.record(&SessionCall{
+		Command: SessionCmdBatchTrackingStart,
+		Args:    SessionArgs{TrackMode: trackingType, ExpectedEvents: expectedEvents, CPU: perfCPU, Retrack: retrack},
+	}, start, err)
+	return err
+}
+
+func (r *Recorder) CmdBatchTrackingEventCount() (uint64, error) {
+	start := time.Now()
+	count, err := r.tracker.CmdBatchTrackingEventCount()
+	r.record(&SessionCall{Command: SessionCmdBatchTrackingEventCount, Value: count}, start, err)
+	return count, err
+}
+
+func (r *Recorder) CmdBatchTrackingStopAndGet(eventCount uint64) ([]*Event, bool, error) {
+	start := time.Now()
+	events, batchErr, err := r.tracker.CmdBatchTrackingStopAndGet(eventCount)
+	r.record(&SessionCall{
+		Command:    SessionCmdBatchTrackingStopAndGet,
+		Args:       SessionArgs{EventCount: eventCount},
+		Events:     events,
+		BatchError: batchErr,
+	}, start, err)
+	return events, batchErr, err
+}
+
+//Close closes the wrapped Tracker. Returns the first error that occurred while writing the session,
+//if closing the Tracker succeeded. Does not close the session writer
+func (r *Recorder) Close() error {
+	start := time.Now()
+	err := r.tracker.Close()
+	r.record(&SessionCall{Command: SessionCmdClose}, start, err)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeErr
+}
+
+var _ Tracker = (*Recorder)(nil)
+
+//ReadSession parses a session file written by Recorder
+func ReadSession(r io.Reader) ([]*SessionCall, error) {
+	sc := bufio.NewScanner(r)
+	//batch results and memory reads may result in long lines
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<30)
+
+	calls := make([]*SessionCall, 0)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		call := &SessionCall{}
+		if err := json.Unmarshal([]byte(line), call); err != nil {
+			return nil, fmt.Errorf("failed to parse session call in line %v : %v", lineNo, err)
+		}
+		calls = append(calls, call)
+	}
+	if sc.Err() != nil {
+		return nil, fmt.Errorf("scanner error : %v", sc.Err())
+	}
+	return calls, nil
+}
+
+//Replayer is a Tracker backend that serves the results of a recorded session.
+//Calls must be issued in the recorded order with the recorded arguments, otherwise
+//an error wrapping ErrReplayDivergence is returned. As the number of unsuccessful polls
+//depends on timing, CmdPollEvent calls are handled leniently: recorded polls that did not
+//return an event are skipped when a different command is issued, and CmdPollEvent reports
+//"no event" if the next recorded call is not a poll
+type Replayer struct {
+	mu    sync.Mutex
+	calls []*SessionCall
+	next  int
+}
+
+//NewReplayer creates a Replayer serving calls
+func NewReplayer(calls []*SessionCall) *Replayer {
+	return &Replayer{
+		calls: calls,
+	}
+}
+
+//Remaining returns the number of recorded calls that have not been replayed yet
+func (r *Replayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.calls) - r.next
+}
+
+func isEmptyPoll(c *SessionCall) bool {
+	return c.Command == SessionCmdPollEvent && !c.Ok && c.Error == ""
+}
+
+//nextCall returns the next recorded call, which must match command and args
+func (r *Replayer) nextCall(command string, args SessionArgs) (*SessionCall, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for r.next < len(r.calls) && command != SessionCmdPollEvent && isEmptyPoll(r.calls[r.next]) {
+		r.next++
+	}
+	if r.next >= len(r.calls) {
+		return nil, fmt.Errorf("%w : %v", ErrReplayEndOfSession, command)
+	}
+	call := r.calls[r.next]
+	if call.Command != command {
+		return nil, fmt.Errorf("%w : call %v is %v but got %v", ErrReplayDivergence, call.Seq, call.Command, command)
+	}
+	if !reflect.DeepEqual(call.Args, args) {
+		return nil, fmt.Errorf("%w : call %v to %v was recorded with args %+v but got %+v",
+			ErrReplayDivergence, call.Seq, command, call.Args, args)
+	}
+	r.next++
+	return call, nil
+}
+
+func (r *Replayer) CmdReset() error {
+	call, err := r.nextCall(SessionCmdReset, SessionArgs{})
+	if err != nil {
+		return err
+	}
+	return call.err()
+}
+
+func (r *Replayer) CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error) {
+	call, err := r.nextCall(SessionCmdReadGuestMemory,
+		SessionArgs{GPA: gpa, Size: size, HostDecryption: hostDecryption, WbinvdCPU: wbinvdCPU})
+	if err != nil {
+		return nil, err
+	}
+	if err := call.err(); err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(call.Data))
+	copy(data, call.Data)
+	return data, nil
+}
+
+func (r *Replayer) CmdAckEvent(id uint64) error {
+	call, err := r.nextCall(SessionCmdAckEvent, SessionArgs{ID: id})
+	if err != nil {
+		return err
+	}
+	return call.err()
+}
+
+func (r *Replayer) CmdPollEvent() (*Event, bool, error) {
+	r.mu.Lock()
+	nextIsPoll := r.next < len(r.calls) && r.calls[r.next].Command == SessionCmdPollEvent
+	r.mu.Unlock()
+	if !nextIsPoll {
+		return nil, false, nil
+	}
+
+	call, err := r.nextCall(SessionCmdPollEvent, SessionArgs{})
+	if err != nil {
+		return nil, false, err
+	}
+	if err := call.err(); err != nil {
+		return nil, false, err
+	}
+	if !call.Ok {
+		return nil, false, nil
+	}
+	ev := *call.Event
+	return &ev, true, nil
+}
+
+func (r *Replayer) CmdTrackPage(gpa uint64, trackMode PageTrackMode) error {
+	call, err := r.nextCall(SessionCmdTrackPage, SessionArgs{GPA: gpa, TrackMode: trackMode})
+	if err != nil {
+		return err
+	}
+	return call.err()
+}
+
+func (r *Replayer) CmdTrackAllPages(trackMode PageTrackMode) error {
+	call, err := r.nextCall(SessionCmdTrackAllPages, SessionArgs{TrackMode: trackMode})
+	if err != nil {
+		return err
+	}
+	return call.err()
+}
+
+func (r *Replayer) CmdUnTrackAllPages(trackMode PageTrackMode) error {
+	call, err := r.nextCall(SessionCmdUnTrackAllPages, SessionArgs{TrackMode: trackMode})
+	if err != nil {
+		return err
+	}
+	return call.err()
+}
+
+func (r *Replayer) CmdSetupRetInstrPerf(cpu int) error {
+	call, err := r.nextCall(SessionCmdSetupRetInstrPerf, SessionArgs{CPU: cpu})
+	if err != nil {
+		return err
+	}
+	return call.err()
+}
+
+func (r *Replayer) CmdReadRetInstrPerf(cpu int) (uint64, error) {
+	call, err := r.nextCall(SessionCmdReadRetInstrPerf, SessionArgs{CPU: cpu})
+	if err != nil {
+		return 0, err
+	}
+	if err := call.err(); err != nil {
+		return 0, err
+	}
+	return call.Value, nil
+}
+
+func (r *Replayer) CmdBatchTrackingStart(trackingType PageTrackMode, expectedEvents uint64, perfCPU int, retrack bool) error {
+	call, err := r.nextCall(SessionCmdBatchTrackingStart,
+		SessionArgs{TrackMode: trackingType, ExpectedEvents: expectedEvents, CPU: perfCPU, Retrack: retrack})
+	if err != nil {
+		return err
+	}
+	return call.err()
+}
+
+func (r *Replayer) CmdBatchTrackingEventCount() (uint64, error) {
+	call, err := r.nextCall(SessionCmdBatchTrackingEventCount, SessionArgs{})
+	if err != nil {
+		return 0, err
+	}
+	if err := call.err(); err != nil {
+		return 0, err
+	}
+	return call.Value, nil
+}
+
+func (r *Replayer) CmdBatchTrackingStopAndGet(eventCount uint64) ([]*Event, bool, error) {
+	call, err := r.nextCall(SessionCmdBatchTrackingStopAndGet, SessionArgs{EventCount: eventCount})
+	if err != nil {
+		return nil, false, err
+	}
+	if err := call.err(); err != nil {
+		return nil, false, err
+	}
+	events := make([]*Event, len(call.Events))
+	for i, v := range call.Events {
+		ev := *v
+		events[i] = &ev
+	}
+	return events, call.BatchError, nil
+}
+
+//Close replays the recorded Close call. If the session was recorded without closing the
+//Tracker, Close succeeds once all other calls were replayed
+func (r *Replayer) Close() error {
+	call, err := r.nextCall(SessionCmdClose, SessionArgs{})
+	if errors.Is(err, ErrReplayEndOfSession) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return call.err()
+}
+
+var _ Tracker = (*Replayer)(nil)
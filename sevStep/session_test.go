@@ -0,0 +1,113 @@
+package sevStep
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+//runSessionWorkload issues a fixed sequence of calls against t and returns the observed results
+func runSessionWorkload(t *testing.T, tracker Tracker) ([]*Event, []byte) {
+	if err := tracker.CmdTrackAllPages(PageTrackExec); err != nil {
+		t.Fatalf("CmdTrackAllPages failed : %v", err)
+	}
+	events := make([]*Event, 0)
+	for len(events) < 2 {
+		ev, ok, err := tracker.CmdPollEvent()
+		if err != nil {
+			t.Fatalf("CmdPollEvent failed : %v", err)
+		}
+		if !ok {
+			continue
+		}
+		events = append(events, ev)
+		if err := tracker.CmdAckEvent(ev.ID); err != nil {
+			t.Fatalf("CmdAckEvent failed : %v", err)
+		}
+	}
+	mem, err := tracker.CmdReadGuestMemory(0x1000, 4, true, -1)
+	if err != nil {
+		t.Fatalf("CmdReadGuestMemory failed : %v", err)
+	}
+	return events, mem
+}
+
+func TestRecorder_Replayer(t *testing.T) {
+	script := []GuestAccess{
+		{GPA: 0x1000, Kind: AccessExec, RIP: 0x1000},
+		{GPA: 0x2000, Kind: AccessExec, RIP: 0x2000},
+	}
+	vm := NewSimulatedVM(4, script, true)
+	if err := vm.WriteGuestMemory(0x1000, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("WriteGuestMemory failed : %v", err)
+	}
+
+	session := &bytes.Buffer{}
+	recorder := NewRecorder(vm, session)
+	wantEvents, wantMem := runSessionWorkload(t, recorder)
+	//errors must be recorded with their errno
+	if _, err := recorder.CmdReadGuestMemory(0xfff, 2, false, -1); err == nil {
+		t.Fatalf("CmdReadGuestMemory across page boundary did not fail")
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("Close failed : %v", err)
+	}
+
+	calls, err := ReadSession(session)
+	if err != nil {
+		t.Fatalf("ReadSession failed : %v", err)
+	}
+	replayer := NewReplayer(calls)
+	gotEvents, gotMem := runSessionWorkload(t, replayer)
+	for i := range wantEvents {
+		//timestamps lose their monotonic clock reading in the session file
+		if !gotEvents[i].Timestamp.Equal(wantEvents[i].Timestamp) {
+			t.Errorf("replayed event %d has timestamp %v, want %v", i, gotEvents[i].Timestamp, wantEvents[i].Timestamp)
+		}
+		gotEvents[i].Timestamp = wantEvents[i].Timestamp
+	}
+	if !reflect.DeepEqual(gotEvents, wantEvents) {
+		t.Errorf("replayed events = %v, want %v", gotEvents, wantEvents)
+	}
+	if !bytes.Equal(gotMem, wantMem) {
+		t.Errorf("replayed memory = %x, want %x", gotMem, wantMem)
+	}
+
+	_, err = replayer.CmdReadGuestMemory(0xfff, 2, false, -1)
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("replayed error = %v, want wrapped EINVAL", err)
+	}
+	var ioctlErr *IoctlError
+	if !errors.As(err, &ioctlErr) || ioctlErr.Name != ioctlNameReadGuestMemory {
+		t.Errorf("replayed error = %v, want wrapped IoctlError", err)
+	}
+	if err := replayer.Close(); err != nil {
+		t.Errorf("Close failed : %v", err)
+	}
+	if replayer.Remaining() != 0 {
+		t.Errorf("%d calls were not replayed", replayer.Remaining())
+	}
+}
+
+func TestReplayer_Divergence(t *testing.T) {
+	replayer := NewReplayer([]*SessionCall{
+		{Seq: 0, Command: SessionCmdPollEvent},
+		{Seq: 1, Command: SessionCmdTrackPage, Args: SessionArgs{GPA: 0x1000, TrackMode: PageTrackAccess}},
+	})
+	//empty polls are skipped
+	err := replayer.CmdTrackPage(0x2000, PageTrackAccess)
+	if !errors.Is(err, ErrReplayDivergence) {
+		t.Errorf("CmdTrackPage() error = %v, want ErrReplayDivergence", err)
+	}
+	if err := replayer.CmdTrackPage(0x1000, PageTrackAccess); err != nil {
+		t.Errorf("CmdTrackPage() error = %v, want nil", err)
+	}
+	if _, ok, err := replayer.CmdPollEvent(); ok || err != nil {
+		t.Errorf("CmdPollEvent() at end of session got = %v, %v, want no event", ok, err)
+	}
+	if err := replayer.CmdReset(); !errors.Is(err, ErrReplayEndOfSession) {
+		t.Errorf("CmdReset() error = %v, want ErrReplayEndOfSession", err)
+	}
+}
@@ -0,0 +1,583 @@
+package sevStep
+
+//This file contains a pure Go backend that emulates the page tracking semantics of the kernel patch.
+//It allows to test tools built on the Tracker interface without a patched host kernel
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//kernel side constants from the kernel patch, mirrored by SimulatedVM
+const (
+	pageSize = 1 << pageShift
+	//retrackBacklogSize is the size of gfn_retrack_backlog in batch_track_state_t
+	retrackBacklogSize = 10
+	//defaultAckTimeout is the timeout used by uspt_send_and_block
+	defaultAckTimeout = time.Second
+	//perfCounterMask mirrors the 48 bit masking done by read_ctr
+	perfCounterMask = (uint64(1) << 48) - 1
+)
+
+//AccessKind describes the type of a simulated guest memory access
+type AccessKind int
+
+const (
+	AccessRead = AccessKind(iota)
+	AccessWrite
+	AccessExec
+)
+
+func (k AccessKind) String() string {
+	switch k {
+	case AccessRead:
+		return "Read"
+	case AccessWrite:
+		return "Write"
+	case AccessExec:
+		return "Exec"
+	default:
+		return "Unknown"
+	}
+}
+
+//GuestAccess is a single step of the scripted guest execution in SimulatedVM
+type GuestAccess struct {
+	//GPA that is accessed
+	GPA  uint64
+	Kind AccessKind
+	//RIP of the accessing instruction. Reported if the SimulatedVM was created with tryGetRIP
+	RIP uint64
+	//User marks accesses from guest user mode
+	User bool
+	//RetiredInstructions is the number of instructions the guest retires before this access
+	RetiredInstructions uint64
+	//Data is written to GPA for AccessWrite accesses, if set. Must not cross a page boundary
+	Data []byte
+	//VCPU is the index of the vCPU performing the access. Must be smaller than SimulatedVM.VCPUs,
+	//otherwise the guest stops at this access and the commands that run it return ErrUnknownVCPU
+	VCPU int
+}
+
+//SimulatedVM is an in-memory Tracker backend that emulates the semantics of the kernel patch:
+//page tracking is one-shot per GFN, interactive events block the guest until they are acked or
+//the ack timeout expires, and batch tracking uses the same buffer and retrack backlog logic as
+//uspt_batch_tracking_save/uspt_batch_tracking_handle_retrack.
+//The guest executes the script passed to NewSimulatedVM. It only makes progress inside
+//CmdPollEvent, CmdBatchTrackingEventCount and RunGuest, which keeps simulations deterministic.
+//The exported fields must be set before the first command is issued
+type SimulatedVM struct {
+	//AccessesPerCall limits the number of guest accesses executed per CmdPollEvent or
+	//CmdBatchTrackingEventCount call. Zero means the guest runs until it blocks or the script ends
+	AccessesPerCall int
+	//AckTimeout is the time after which a blocked guest continues without an ack. Defaults to 1s
+	AckTimeout time.Duration
+	//Now is used for timestamps and the ack timeout. Defaults to time.Now
+	Now func() time.Time
+	//EncryptBlock, if set, is applied to each 16 byte block when memory is read without
+	//host decryption, emulating the ciphertext view of SEV memory
+	EncryptBlock func(gpa uint64, block []byte) []byte
+	//VCPUs is the number of vCPUs of the VM. Events are tagged with the vCPU of the faulting
+	//GuestAccess. Note that the simulated performance counter counts the instructions of all vCPUs.
+	//Defaults to 1
+	VCPUs int
+
+	mu sync.Mutex
+
+	memory    []byte
+	tracked   map[uint64]map[PageTrackMode]bool
+	script    []GuestAccess
+	scriptPos int
+
+	//uspt state, see userspace_page_track_signals.c
+	inited           bool
+	getRIP           bool
+	lastSentEventID  uint64
+	lastAckedEventID uint64
+	haveEvent        bool
+	sentEvent        Event
+	blocked          bool
+	blockedSince     time.Time
+	//blockedAccess is the access that faulted and completes once the guest is unblocked
+	blockedAccess     *GuestAccess
+	timedOutAckCount  int
+	droppedEventCount int
+	//guestErr is set once the guest stopped on an invalid access
+	guestErr error
+
+	//perf state
+	perfCPU     int
+	perfCounter uint64
+
+	batch simBatchState
+}
+
+//simBatchState mirrors batch_track_state_t and perf_state_t from the kernel patch
+type simBatchState struct {
+	isActive         bool
+	trackingType     PageTrackMode
+	retrack          bool
+	events           []Event
+	eventNextIdx     uint64
+	errorOccurred    bool
+	retrackBacklog   []uint64
+	lastPerfIdx      uint64
+	lastPerfReading  uint64
+	deltaValidIdx    uint64
+	delta            uint64
+	perfCPU          int
+	setupPerfCounter bool
+}
+
+//NewSimulatedVM creates a simulated VM with memoryPages pages of zeroed memory that
+//executes script. The returned VM behaves as if registered via KVM_USPT_REGISTER_PID.
+//If tryGetRIP is set, events carry the RIP of the faulting GuestAccess
+func NewSimulatedVM(memoryPages uint64, script []GuestAccess, tryGetRIP bool) *SimulatedVM {
+	return &SimulatedVM{
+		AckTimeout:       defaultAckTimeout,
+		VCPUs:            1,
+		Now:              time.Now,
+		memory:           make([]byte, memoryPages*pageSize),
+		tracked:          make(map[uint64]map[PageTrackMode]bool),
+		script:           script,
+		inited:           true,
+		getRIP:           tryGetRIP,
+		lastSentEventID:  1,
+		lastAckedEventID: 1,
+		perfCPU:          -1,
+	}
+}
+
+func simIoctlError(name string, errno syscall.Errno) error {
+	return &IoctlError{Name: name, Errno: errno}
+}
+
+//WriteGuestMemory initializes guest memory at gpa with data, bypassing page tracking
+func (s *SimulatedVM) WriteGuestMemory(gpa uint64, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gpa+uint64(len(data)) > uint64(len(s.memory)) {
+		return fmt.Errorf("write to 0x%x with length %d is outside of guest memory", gpa, len(data))
+	}
+	copy(s.memory[gpa:], data)
+	return nil
+}
+
+//GuestDone returns true if the guest executed its whole script
+func (s *SimulatedVM) GuestDone() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scriptPos >= len(s.script)
+}
+
+//TimedOutAcks returns how often the guest continued because an event was not acked in time
+func (s *SimulatedVM) TimedOutAcks() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.timedOutAckCount
+}
+
+//DroppedEvents returns how many interactive events were not delivered because the
+//previous event was not acked ("event id_s out of sync") or the api was not registered
+func (s *SimulatedVM) DroppedEvents() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.droppedEventCount
+}
+
+//RunGuest executes up to maxAccesses guest accesses. If maxAccesses is <= 0, the guest
+//runs until it blocks on an event or the script ends. Returns the number of executed accesses
+func (s *SimulatedVM) RunGuest(maxAccesses int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.runGuest(maxAccesses)
+}
+
+func (s *SimulatedVM) runGuest(maxAccesses int) int {
+	executed := 0
+	for {
+		if s.blocked && !s.tryUnblock() {
+			break
+		}
+		if s.guestErr != nil || s.scriptPos >= len(s.script) || (maxAccesses > 0 && executed >= maxAccesses) {
+			break
+		}
+		if access := s.script[s.scriptPos]; access.VCPU < 0 || access.VCPU >= s.VCPUs {
+			s.guestErr = fmt.Errorf("%w : access %d uses vCPU %d, the VM has %d vCPUs", ErrUnknownVCPU, s.scriptPos, access.VCPU, s.VCPUs)
+			break
+		}
+		s.execute(s.script[s.scriptPos])
+		s.scriptPos++
+		executed++
+	}
+	return executed
+}
+
+//tryUnblock resumes the guest if the event was acked or the ack timed out. Then, the faulted access completes
+func (s *SimulatedVM) tryUnblock() bool {
+	if s.lastAckedEventID >= s.sentEvent.ID {
+		s.blocked = false
+	} else if s.Now().Sub(s.blockedSince) > s.AckTimeout {
+		s.blocked = false
+		s.timedOutAckCount++
+	} else {
+		return false
+	}
+	if s.blockedAccess != nil {
+		s.completeAccess(*s.blockedAccess)
+		s.blockedAccess = nil
+	}
+	return true
+}
+
+//execute performs a single guest access, emulating page_fault_handle_page_track
+func (s *SimulatedVM) execute(access GuestAccess) {
+	s.perfCounter = (s.perfCounter + access.RetiredInstructions) & perfCounterMask
+	gfn := access.GPA >> pageShift
+
+	modes := s.tracked[gfn]
+	faults := modes[PageTrackAccess] ||
+		(modes[PageTrackWrite] && access.Kind == AccessWrite) ||
+		(modes[PageTrackExec] && access.Kind == AccessExec)
+	if faults {
+		//like the kernel, untrack all modes once the page faulted
+		delete(s.tracked, gfn)
+		s.handleFault(gfn, s.errorCode(access, modes), access.RIP, access.VCPU)
+		//like in hardware, the access completes after the fault was handled
+		if s.blocked {
+			s.blockedAccess = &access
+			return
+		}
+	}
+	s.completeAccess(access)
+}
+
+//completeAccess applies the effects of access to the guest memory
+func (s *SimulatedVM) completeAccess(access GuestAccess) {
+	if access.Kind == AccessWrite && access.Data != nil && access.GPA+uint64(len(access.Data)) <= uint64(len(s.memory)) {
+		copy(s.memory[access.GPA:], access.Data)
+	}
+}
+
+func (s *SimulatedVM) errorCode(access GuestAccess, modes map[PageTrackMode]bool) ErrorCode {
+	var code ErrorCode
+	//access tracking clears the present bit, the other modes only remove permissions
+	if !modes[PageTrackAccess] {
+		code |= ErrorCode(PfErrorPresent)
+	}
+	if access.Kind == AccessWrite {
+		code |= ErrorCode(PfErrorWrite)
+	}
+	if access.Kind == AccessExec {
+		code |= ErrorCode(PfErrorFetch)
+	}
+	if access.User {
+		code |= ErrorCode(PfErrorUser)
+	}
+	return code
+}
+
+func (s *SimulatedVM) handleFault(gfn uint64, errorCode ErrorCode, rip uint64, vcpu int) {
+	ev := Event{
+		VCPU:        vcpu,
+		FaultedGPA:  gfn << pageShift,
+		ErrorCode:   errorCode,
+		HaveRipInfo: s.getRIP,
+		Timestamp:   s.Now(),
+	}
+	if s.getRIP {
+		ev.RIP = rip
+	}
+
+	if s.batch.isActive {
+		s.batchSave(ev)
+		s.batchHandleRetrack(gfn)
+		s.batch.eventNextIdx++
+		return
+	}
+	s.sendAndBlock(ev)
+}
+
+//sendAndBlock emulates uspt_send_and_block. Blocking is emulated in runGuest
+func (s *SimulatedVM) sendAndBlock(ev Event) {
+	if !s.inited || s.lastSentEventID != s.lastAckedEventID {
+		s.droppedEventCount++
+		return
+	}
+	s.lastSentEventID++
+	ev.ID = s.lastSentEventID
+	ev.HaveRetiredInstructions = false
+	s.sentEvent = ev
+	s.haveEvent = true
+	s.blocked = true
+	s.blockedSince = s.Now()
+}
+
+//perfDelta emulates _perf_state_update_and_get_delta, including its handling of the first event
+func (s *SimulatedVM) perfDelta(idx uint64) uint64 {
+	b := &s.batch
+	if b.deltaValidIdx == idx {
+		if idx == 0 {
+			b.lastPerfIdx = idx
+			b.lastPerfReading = idx
+		}
+		return b.delta
+	}
+	current := s.perfCounter
+	b.delta = current - b.lastPerfReading
+	b.deltaValidIdx = idx
+	b.lastPerfIdx = idx
+	b.lastPerfReading = current
+	return b.delta
+}
+
+//batchSave emulates uspt_batch_tracking_save
+func (s *SimulatedVM) batchSave(ev Event) {
+	b := &s.batch
+	if b.eventNextIdx >= uint64(len(b.events)) {
+		b.errorOccurred = true
+		return
+	}
+	ev.ID = b.eventNextIdx
+	ev.HaveRetiredInstructions = true
+	ev.RetiredInstructions = s.perfDelta(b.eventNextIdx)
+	b.events[b.eventNextIdx] = ev
+}
+
+//batchHandleRetrack emulates uspt_batch_tracking_handle_retrack
+func (s *SimulatedVM) batchHandleRetrack(gfn uint64) {
+	b := &s.batch
+	if !b.retrack {
+		return
+	}
+	if s.perfDelta(b.eventNextIdx) < 2 && b.eventNextIdx != 0 {
+		if len(b.retrackBacklog) < retrackBacklogSize {
+			b.retrackBacklog = append(b.retrackBacklog, gfn)
+		}
+		return
+	}
+	for _, v := range b.retrackBacklog {
+		s.trackGFN(v, b.trackingType)
+	}
+	b.retrackBacklog = append(b.retrackBacklog[:0], gfn)
+}
+
+func (s *SimulatedVM) trackGFN(gfn uint64, mode PageTrackMode) {
+	//reset modes only modify access bits and do not install tracking
+	if mode != PageTrackWrite && mode != PageTrackAccess && mode != PageTrackExec {
+		return
+	}
+	if gfn >= uint64(len(s.memory))/pageSize {
+		return
+	}
+	if s.tracked[gfn] == nil {
+		s.tracked[gfn] = make(map[PageTrackMode]bool)
+	}
+	s.tracked[gfn][mode] = true
+}
+
+func (s *SimulatedVM) untrackGFN(gfn uint64, mode PageTrackMode) {
+	if s.tracked[gfn] == nil {
+		return
+	}
+	delete(s.tracked[gfn], mode)
+	if len(s.tracked[gfn]) == 0 {
+		delete(s.tracked, gfn)
+	}
+}
+
+func (s *SimulatedVM) CmdReset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inited = false
+	s.lastSentEventID = 1
+	s.lastAckedEventID = 1
+	s.haveEvent = false
+	s.getRIP = false
+	for _, mode := range []PageTrackMode{PageTrackExec, PageTrackAccess, PageTrackWrite} {
+		for gfn := range s.tracked {
+			s.untrackGFN(gfn, mode)
+		}
+	}
+	return nil
+}
+
+//CmdReadGuestMemory reads size bytes from gpa. Like the kernel, reads may not cross a page boundary.
+//The wbinvdCPU parameter is ignored
+func (s *SimulatedVM) CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size == 0 || (gpa&(pageSize-1))+size-1 > pageSize-1 || gpa+size > uint64(len(s.memory)) {
+		return nil, simIoctlError(ioctlNameReadGuestMemory, syscall.EINVAL)
+	}
+	res := make([]byte, size)
+	if hostDecryption || s.EncryptBlock == nil {
+		copy(res, s.memory[gpa:gpa+size])
+		return res, nil
+	}
+	//encrypt whole aligned blocks, then cut out the requested range
+	start := gpa &^ 0xf
+	end := (gpa + size + 0xf) &^ 0xf
+	buf := make([]byte, 0, end-start)
+	for blockGPA := start; blockGPA < end; blockGPA += 16 {
+		block := make([]byte, 16)
+		copy(block, s.memory[blockGPA:])
+		buf = append(buf, s.EncryptBlock(blockGPA, block)...)
+	}
+	copy(res, buf[gpa-start:])
+	return res, nil
+}
+
+func (s *SimulatedVM) CmdAckEvent(id uint64) error {
+	return s.ackEvent(id, -1)
+}
+
+//ackEvent acks the event with id. If vcpu is not negative, the event must belong to it
+func (s *SimulatedVM) ackEvent(id uint64, vcpu int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.inited {
+		return simIoctlError(ioctlNameAckEvent, syscall.EINVAL)
+	}
+	if id != s.lastSentEventID || (vcpu >= 0 && s.sentEvent.VCPU != vcpu) {
+		return &IoctlError{Name: ioctlNameAckEvent, ReturnValue: ackEventReturnIDMismatch}
+	}
+	s.lastAckedEventID = s.lastSentEventID
+	return nil
+}
+
+//CmdPollEvent lets the guest run and returns the pending event, if any. Returns ErrUnknownVCPU
+//once the guest stopped on an access of a vCPU the VM does not have
+func (s *SimulatedVM) CmdPollEvent() (*Event, bool, error) {
+	return s.pollEvent(-1)
+}
+
+//pollEvent returns the pending event. If vcpu is not negative, events of other vCPUs stay pending
+func (s *SimulatedVM) pollEvent(vcpu int) (*Event, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.inited {
+		return nil, false, simIoctlError(ioctlNamePollEvent, syscall.EINVAL)
+	}
+	if !s.haveEvent {
+		s.runGuest(s.AccessesPerCall)
+	}
+	if !s.haveEvent {
+		return nil, false, s.guestErr
+	}
+	if vcpu >= 0 && s.sentEvent.VCPU != vcpu {
+		return nil, false, nil
+	}
+	s.haveEvent = false
+	ev := s.sentEvent
+	return &ev, true, nil
+}
+
+func (s *SimulatedVM) CmdTrackPage(gpa uint64, trackMode PageTrackMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := validateTrackMode(trackMode); err != nil {
+		return err
+	}
+	s.trackGFN(gpa>>pageShift, trackMode)
+	return nil
+}
+
+func (s *SimulatedVM) CmdTrackAllPages(trackMode PageTrackMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := validateTrackMode(trackMode); err != nil {
+		return err
+	}
+	for gfn := uint64(0); gfn < uint64(len(s.memory))/pageSize; gfn++ {
+		s.trackGFN(gfn, trackMode)
+	}
+	return nil
+}
+
+func (s *SimulatedVM) CmdUnTrackAllPages(trackMode PageTrackMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := validateTrackMode(trackMode); err != nil {
+		return err
+	}
+	for gfn := range s.tracked {
+		s.untrackGFN(gfn, trackMode)
+	}
+	return nil
+}
+
+func (s *SimulatedVM) CmdSetupRetInstrPerf(cpu int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.perfCPU = cpu
+	return nil
+}
+
+//CmdReadRetInstrPerf returns the retired instructions of the guest, if the counter was
+//programmed on cpu. Otherwise, zero is returned
+func (s *SimulatedVM) CmdReadRetInstrPerf(cpu int) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cpu != s.perfCPU && !(s.batch.setupPerfCounter && cpu == s.batch.perfCPU) {
+		return 0, nil
+	}
+	return s.perfCounter, nil
+}
+
+func (s *SimulatedVM) CmdBatchTrackingStart(trackingType PageTrackMode, expectedEvents uint64, perfCPU int, retrack bool) error {
+	if err := validateTrackMode(trackingType); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batch = simBatchState{
+		isActive:         true,
+		trackingType:     trackingType,
+		retrack:          retrack,
+		events:           make([]Event, expectedEvents),
+		retrackBacklog:   make([]uint64, 0, retrackBacklogSize),
+		perfCPU:          perfCPU,
+		setupPerfCounter: true,
+	}
+	return nil
+}
+
+//CmdBatchTrackingEventCount lets the guest run and returns the number of events recorded so far.
+//Like in the kernel, this also counts events that were dropped because the buffer was full
+func (s *SimulatedVM) CmdBatchTrackingEventCount() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runGuest(s.AccessesPerCall)
+	return s.batch.eventNextIdx, s.guestErr
+}
+
+func (s *SimulatedVM) CmdBatchTrackingStopAndGet(eventCount uint64) ([]*Event, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.batch.isActive {
+		return nil, false, simIoctlError(ioctlNameBatchTrackStop, syscall.EFAULT)
+	}
+	s.batch.isActive = false
+	//the kernel would read beyond its event buffer in the second case
+	if eventCount > s.batch.eventNextIdx || eventCount > uint64(len(s.batch.events)) {
+		return nil, false, simIoctlError(ioctlNameBatchTrackStop, syscall.EFAULT)
+	}
+	events := make([]*Event, eventCount)
+	for i := range events {
+		ev := s.batch.events[i]
+		events[i] = &ev
+	}
+	errorOccurred := s.batch.errorOccurred
+	s.batch.events = nil
+	return events, errorOccurred, nil
+}
+
+//Close resets the simulated VM
+func (s *SimulatedVM) Close() error {
+	return s.CmdReset()
+}
+
+var _ Tracker = (*SimulatedVM)(nil)
@@ -0,0 +1,236 @@
+package sevStep
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//fakeClock is a manually advanced clock for SimulatedVM.Now
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func faultedGPAs(events []*Event) []uint64 {
+	res := make([]uint64, 0, len(events))
+	for _, v := range events {
+		res = append(res, v.FaultedGPA)
+	}
+	return res
+}
+
+func TestSimulatedVM_InteractiveOneShot(t *testing.T) {
+	script := []GuestAccess{
+		{GPA: 0x1010, Kind: AccessRead, RIP: 0x400000},
+		{GPA: 0x1020, Kind: AccessRead, RIP: 0x400004},
+		{GPA: 0x2000, Kind: AccessWrite, RIP: 0x400008, Data: []byte{0xaa}},
+	}
+	vm := NewSimulatedVM(4, script, true)
+
+	if err := vm.CmdTrackPage(0x1000, PageTrackAccess); err != nil {
+		t.Fatalf("CmdTrackPage failed : %v", err)
+	}
+	if err := vm.CmdTrackPage(0x2000, PageTrackWrite); err != nil {
+		t.Fatalf("CmdTrackPage failed : %v", err)
+	}
+
+	ev, ok, err := vm.CmdPollEvent()
+	if err != nil || !ok {
+		t.Fatalf("CmdPollEvent() got = %v, %v, want event", ok, err)
+	}
+	want := &Event{ID: 2, FaultedGPA: 0x1000, ErrorCode: 0, HaveRipInfo: true, RIP: 0x400000, Timestamp: ev.Timestamp}
+	if !reflect.DeepEqual(ev, want) {
+		t.Errorf("CmdPollEvent() got = %v, want %v", ev, want)
+	}
+
+	//guest must be blocked until we ack
+	if _, ok, _ := vm.CmdPollEvent(); ok {
+		t.Errorf("CmdPollEvent() returned event while guest should be blocked")
+	}
+	if err := vm.CmdAckEvent(ev.ID); err != nil {
+		t.Fatalf("CmdAckEvent failed : %v", err)
+	}
+
+	//second access to 0x1000 must not fault, as tracking is one shot
+	ev, ok, err = vm.CmdPollEvent()
+	if err != nil || !ok {
+		t.Fatalf("CmdPollEvent() got = %v, %v, want event", ok, err)
+	}
+	if ev.ID != 3 || ev.FaultedGPA != 0x2000 || ev.ErrorCode != ErrorCode(PfErrorPresent|PfErrorWrite) {
+		t.Errorf("CmdPollEvent() got = %v, want write fault on 0x2000 with id 3", ev)
+	}
+	if err := vm.CmdAckEvent(ev.ID); err != nil {
+		t.Fatalf("CmdAckEvent failed : %v", err)
+	}
+	if _, ok, _ := vm.CmdPollEvent(); ok || !vm.GuestDone() {
+		t.Errorf("guest should have finished without further events")
+	}
+
+	mem, err := vm.CmdReadGuestMemory(0x2000, 1, true, -1)
+	if err != nil || !bytes.Equal(mem, []byte{0xaa}) {
+		t.Errorf("CmdReadGuestMemory() got = %x, %v, want aa", mem, err)
+	}
+}
+
+func TestSimulatedVM_AckTimeout(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	script := []GuestAccess{
+		{GPA: 0x1000, Kind: AccessExec},
+		{GPA: 0x2000, Kind: AccessExec},
+		{GPA: 0x3000, Kind: AccessExec},
+	}
+	vm := NewSimulatedVM(4, script, false)
+	vm.Now = clock.Now
+	if err := vm.CmdTrackAllPages(PageTrackExec); err != nil {
+		t.Fatalf("CmdTrackAllPages failed : %v", err)
+	}
+
+	ev, ok, err := vm.CmdPollEvent()
+	if err != nil || !ok {
+		t.Fatalf("CmdPollEvent() got = %v, %v, want event", ok, err)
+	}
+
+	//do not ack, let timeout expire. Next fault is dropped as ids are out of sync
+	clock.now = clock.now.Add(2 * time.Second)
+	if _, ok, _ := vm.CmdPollEvent(); ok {
+		t.Errorf("CmdPollEvent() returned event although ids are out of sync")
+	}
+	if vm.TimedOutAcks() != 1 || vm.DroppedEvents() != 2 {
+		t.Errorf("got %d timed out acks and %d dropped events, want 1 and 2", vm.TimedOutAcks(), vm.DroppedEvents())
+	}
+
+	//late ack brings ids back in sync
+	if err := vm.CmdAckEvent(ev.ID); err != nil {
+		t.Errorf("late CmdAckEvent failed : %v", err)
+	}
+	if err := vm.CmdAckEvent(ev.ID + 1); err == nil {
+		t.Errorf("CmdAckEvent with wrong id did not fail")
+	}
+}
+
+func TestSimulatedVM_Batch(t *testing.T) {
+	type args struct {
+		expectedEvents uint64
+		retrack        bool
+	}
+	//code page 1 and 2 alternate. The second access to page 2 retires no instructions,
+	//emulating an instruction that needs both pages
+	script := []GuestAccess{
+		{GPA: 0x1000, Kind: AccessExec, RetiredInstructions: 10},
+		{GPA: 0x2000, Kind: AccessExec, RetiredInstructions: 10},
+		{GPA: 0x1000, Kind: AccessExec, RetiredInstructions: 10},
+		{GPA: 0x2000, Kind: AccessExec, RetiredInstructions: 10},
+		{GPA: 0x1000, Kind: AccessExec, RetiredInstructions: 1},
+		{GPA: 0x2000, Kind: AccessExec, RetiredInstructions: 10},
+	}
+	tests := []struct {
+		name          string
+		args          args
+		wantGPAs      []uint64
+		wantCount     uint64
+		wantBatchErr  bool
+		wantRetInstrs []uint64
+	}{
+		{
+			name:      "Without retrack",
+			args:      args{expectedEvents: 10, retrack: false},
+			wantGPAs:  []uint64{0x1000, 0x2000},
+			wantCount: 2,
+		},
+		{
+			name:          "With retrack",
+			args:          args{expectedEvents: 10, retrack: true},
+			wantGPAs:      []uint64{0x1000, 0x2000, 0x1000, 0x2000, 0x1000},
+			wantCount:     5,
+			wantRetInstrs: []uint64{0, 20, 10, 10, 1},
+		},
+		{
+			name:         "Buffer overflow",
+			args:         args{expectedEvents: 3, retrack: true},
+			wantGPAs:     []uint64{0x1000, 0x2000, 0x1000},
+			wantCount:    5,
+			wantBatchErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewSimulatedVM(4, script, false)
+			if err := vm.CmdTrackAllPages(PageTrackExec); err != nil {
+				t.Fatalf("CmdTrackAllPages failed : %v", err)
+			}
+			if err := vm.CmdBatchTrackingStart(PageTrackExec, tt.args.expectedEvents, 0, tt.args.retrack); err != nil {
+				t.Fatalf("CmdBatchTrackingStart failed : %v", err)
+			}
+			count, err := vm.CmdBatchTrackingEventCount()
+			if err != nil {
+				t.Fatalf("CmdBatchTrackingEventCount failed : %v", err)
+			}
+			if count != tt.wantCount {
+				t.Errorf("CmdBatchTrackingEventCount() got = %v, want %v", count, tt.wantCount)
+			}
+			if count > tt.args.expectedEvents {
+				count = tt.args.expectedEvents
+			}
+			events, batchErr, err := vm.CmdBatchTrackingStopAndGet(count)
+			if err != nil {
+				t.Fatalf("CmdBatchTrackingStopAndGet failed : %v", err)
+			}
+			if batchErr != tt.wantBatchErr {
+				t.Errorf("CmdBatchTrackingStopAndGet() batch error = %v, want %v", batchErr, tt.wantBatchErr)
+			}
+			if got := faultedGPAs(events); !reflect.DeepEqual(got, tt.wantGPAs) {
+				t.Errorf("CmdBatchTrackingStopAndGet() got = %x, want %x", got, tt.wantGPAs)
+			}
+			if tt.wantRetInstrs != nil {
+				got := make([]uint64, 0, len(events))
+				for _, v := range events {
+					got = append(got, v.RetiredInstructions)
+				}
+				if !reflect.DeepEqual(got, tt.wantRetInstrs) {
+					t.Errorf("retired instructions got = %v, want %v", got, tt.wantRetInstrs)
+				}
+			}
+		})
+	}
+}
+
+func TestSimulatedVM_InvalidTrackMode(t *testing.T) {
+	vm := NewSimulatedVM(1, nil, false)
+	if err := vm.CmdTrackPage(0, PageTrackMode(5)); !errors.Is(err, ErrInvalidTrackMode) {
+		t.Errorf("CmdTrackPage with invalid mode got err = %v, want %v", err, ErrInvalidTrackMode)
+	}
+	if err := vm.CmdAckEvent(42); !errors.Is(err, ErrAckMismatch) {
+		t.Errorf("CmdAckEvent with wrong id got err = %v, want %v", err, ErrAckMismatch)
+	}
+	if err := vm.CmdReset(); err != nil {
+		t.Fatalf("CmdReset failed : %v", err)
+	}
+	if _, _, err := vm.CmdPollEvent(); !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("CmdPollEvent after CmdReset got err = %v, want %v", err, ErrNotRegistered)
+	}
+}
+
+func TestSimulatedVM_InvalidVCPU(t *testing.T) {
+	vm := NewSimulatedVM(2, []GuestAccess{
+		{GPA: 0x0, Kind: AccessRead},
+		{GPA: 0x1000, Kind: AccessRead, VCPU: 1},
+	}, false)
+	if err := vm.CmdTrackPage(0x1000, PageTrackAccess); err != nil {
+		t.Fatalf("CmdTrackPage failed : %v", err)
+	}
+	if _, ok, err := vm.CmdPollEvent(); ok || !errors.Is(err, ErrUnknownVCPU) {
+		t.Errorf("CmdPollEvent() got = %v, %v, want %v", ok, err, ErrUnknownVCPU)
+	}
+	if vm.GuestDone() {
+		t.Errorf("guest should stop at the access of the unknown vCPU")
+	}
+	if _, err := vm.CmdBatchTrackingEventCount(); !errors.Is(err, ErrUnknownVCPU) {
+		t.Errorf("CmdBatchTrackingEventCount() got err = %v, want %v", err, ErrUnknownVCPU)
+	}
+}
@@ -0,0 +1,103 @@
+package sevStep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+//ErrStopStepping may be returned by a StepHook to end the stepping session without error
+var ErrStopStepping = errors.New("stop stepping")
+
+//StepHook is called by Stepper for each step. step is the one-based index of the step.
+//Returning an error ends the stepping session
+type StepHook func(step uint64, ev *Event) error
+
+//Stepper drives a page fault granular single stepping session: all pages are tracked and on
+//each fault, the previously faulted page is re-tracked. The faulted page itself is untracked by
+//the kernel and re-tracked on the next fault, as back to back accesses to the same page cannot
+//be tracked (see KVM_TRACK_PAGE). Thus, consecutive accesses to the same page result in a single step.
+//The exported fields must not be changed while Run is executing
+type Stepper struct {
+	//TrackMode is used to track all pages at the start and to re-track faulted pages
+	TrackMode PageTrackMode
+	//MaxSteps ends the session after the given number of steps. Zero means no limit
+	MaxSteps uint64
+	//BeforeStep is called while the VM waits for the event to be acknowledged,
+	//e.g. to read guest memory
+	BeforeStep StepHook
+	//AfterStep is called after the event was acknowledged and the VM continues
+	AfterStep StepHook
+	//Loop is the underlying EventLoop. It can be used to configure the poll backoff, the retired
+	//instructions counter and memory capture for the stepped events
+	Loop *EventLoop
+
+	tracker Tracker
+}
+
+//NewStepper creates a Stepper that tracks pages with trackMode
+func NewStepper(tracker Tracker, trackMode PageTrackMode) *Stepper {
+	return &Stepper{
+		TrackMode: trackMode,
+		Loop:      NewEventLoop(tracker),
+		tracker:   tracker,
+	}
+}
+
+func callStepHook(hook StepHook, step uint64, ev *Event) error {
+	if hook == nil {
+		return nil
+	}
+	return hook(step, ev)
+}
+
+//Run tracks all pages and steps until MaxSteps is reached, a hook returns an error or ctx is done.
+//Afterwards, all pages are untracked to let the VM continue. Returns the number of steps.
+//If the session was ended by a hook returning ErrStopStepping, the returned error is nil
+func (s *Stepper) Run(ctx context.Context) (uint64, error) {
+	s.Loop.RetrackMode = s.TrackMode
+	if err := s.tracker.CmdTrackAllPages(s.TrackMode); err != nil {
+		return 0, fmt.Errorf("CmdTrackAllPages failed : %w", err)
+	}
+
+	steps, err := s.step(ctx)
+
+	if untrackErr := s.tracker.CmdUnTrackAllPages(s.TrackMode); untrackErr != nil {
+		if err == nil {
+			return steps, fmt.Errorf("CmdUnTrackAllPages failed : %w", untrackErr)
+		}
+		return steps, fmt.Errorf("%w, CmdUnTrackAllPages also failed : %v", err, untrackErr)
+	}
+	if errors.Is(err, ErrStopStepping) {
+		return steps, nil
+	}
+	return steps, err
+}
+
+func (s *Stepper) step(ctx context.Context) (uint64, error) {
+	var steps uint64
+	for s.MaxSteps == 0 || steps < s.MaxSteps {
+		ev, err := s.Loop.NextEvent(ctx)
+		if err != nil {
+			return steps, err
+		}
+		steps++
+
+		hookErr := callStepHook(s.BeforeStep, steps, ev)
+		action := EventActionRetrack
+		if hookErr != nil || steps == s.MaxSteps {
+			action = EventActionStop
+		}
+		if _, err := s.Loop.HandleEvent(ev, action); err != nil {
+			return steps, err
+		}
+		if hookErr != nil {
+			return steps, hookErr
+		}
+
+		if err := callStepHook(s.AfterStep, steps, ev); err != nil {
+			return steps, err
+		}
+	}
+	return steps, nil
+}
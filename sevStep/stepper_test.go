@@ -0,0 +1,119 @@
+package sevStep
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestStepper_Run(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxSteps  uint64
+		stopAfter uint64
+		want      []uint64
+	}{
+		{
+			name:     "MaxSteps",
+			maxSteps: 3,
+			want:     []uint64{0x1000, 0x2000, 0x1000},
+		},
+		{
+			name:      "Stopped by hook",
+			stopAfter: 2,
+			want:      []uint64{0x1000, 0x2000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewSimulatedVM(4, alternatingExecScript(6), false)
+			stepper := NewStepper(vm, PageTrackExec)
+			stepper.MaxSteps = tt.maxSteps
+
+			got := make([]uint64, 0)
+			stepper.BeforeStep = func(step uint64, ev *Event) error {
+				got = append(got, ev.FaultedGPA)
+				return nil
+			}
+			stepper.AfterStep = func(step uint64, ev *Event) error {
+				if step == tt.stopAfter {
+					return ErrStopStepping
+				}
+				return nil
+			}
+
+			steps, err := stepper.Run(context.Background())
+			if err != nil {
+				t.Errorf("Run() error = %v", err)
+			}
+			if steps != uint64(len(tt.want)) {
+				t.Errorf("Run() steps = %v, want %v", steps, len(tt.want))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Run() got = %x, want %x", got, tt.want)
+			}
+			//all pages are untracked after the session
+			if _, ok, _ := vm.CmdPollEvent(); ok || !vm.GuestDone() {
+				t.Errorf("guest should have finished without further events")
+			}
+		})
+	}
+}
+
+func TestStepper_Run_RetInstr(t *testing.T) {
+	script := []GuestAccess{
+		{GPA: 0x1000, Kind: AccessExec, RetiredInstructions: 3},
+		{GPA: 0x2000, Kind: AccessExec, RetiredInstructions: 5},
+		{GPA: 0x1000, Kind: AccessExec, RetiredInstructions: 1},
+	}
+	vm := NewSimulatedVM(4, script, false)
+	stepper := NewStepper(vm, PageTrackExec)
+	stepper.MaxSteps = uint64(len(script))
+	var err error
+	if stepper.Loop.RetInstr, err = NewRetInstrCounter(vm, 0); err != nil {
+		t.Fatalf("NewRetInstrCounter failed : %v", err)
+	}
+
+	got := make([]uint64, 0)
+	stepper.BeforeStep = func(step uint64, ev *Event) error {
+		if !ev.HaveRetiredInstructions {
+			t.Errorf("step %v has no retired instructions", step)
+		}
+		got = append(got, ev.RetiredInstructions)
+		return nil
+	}
+	if _, err := stepper.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if want := []uint64{3, 5, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("retired instructions = %v, want %v", got, want)
+	}
+}
+
+func TestStepper_Run_Capture(t *testing.T) {
+	vm := NewSimulatedVM(4, alternatingExecScript(2), false)
+	for _, gpa := range []uint64{0x1008, 0x2008} {
+		if err := vm.WriteGuestMemory(gpa, []byte{byte(gpa >> 12)}); err != nil {
+			t.Fatalf("WriteGuestMemory failed : %v", err)
+		}
+	}
+	stepper := NewStepper(vm, PageTrackExec)
+	stepper.MaxSteps = 2
+	stepper.Loop.Capture = NewCapturePolicy(MemoryViewHostDecrypted, CaptureRange{GPA: 0x8, Size: 1, RelativeToFault: true})
+
+	got := make([][]MemoryRegion, 0)
+	stepper.BeforeStep = func(step uint64, ev *Event) error {
+		got = append(got, ev.Regions)
+		return nil
+	}
+	if _, err := stepper.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	want := [][]MemoryRegion{
+		{{GPA: 0x1008, Content: []byte{0x1}}},
+		{{GPA: 0x2008, Content: []byte{0x2}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("captured regions = %v, want %v", got, want)
+	}
+}
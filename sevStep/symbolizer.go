@@ -0,0 +1,338 @@
+package sevStep
+
+//This file contains a symbolizer that maps guest virtual addresses, e.g. Event.RIP, to the symbols of
+//loaded ELF binaries and vice versa
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	//ErrUnknownSymbol is returned if a symbol name is not found in any module
+	ErrUnknownSymbol = errors.New("unknown symbol")
+	//ErrAmbiguousSymbol is returned if a symbol name exists in multiple modules. Qualify it as "module!name"
+	ErrAmbiguousSymbol = errors.New("ambiguous symbol")
+)
+
+//moduleSeparator separates the module from the symbol name in qualified names, e.g. "libc.so.6!memcpy"
+const moduleSeparator = "!"
+
+//Symbol is a function or object of a loaded module
+type Symbol struct {
+	Name string
+	//Module is the name of the module containing the symbol
+	Module string
+	//Addr is the guest virtual address, i.e. including the load base of the module
+	Addr uint64
+	//Size in bytes. Symbols without size information extend to the next symbol of the module
+	Size uint64
+}
+
+//End returns the first address after the symbol
+func (s Symbol) End() uint64 {
+	if s.Size == 0 {
+		return s.Addr + 1
+	}
+	return s.Addr + s.Size
+}
+
+//Pages returns the page aligned guest virtual addresses of all pages the symbol spans
+func (s Symbol) Pages() []uint64 {
+	res := make([]uint64, 0)
+	for page := s.Addr &^ (pageSize - 1); page < s.End(); page += pageSize {
+		res = append(res, page)
+	}
+	return res
+}
+
+//QualifiedName returns "module!name"
+func (s Symbol) QualifiedName() string {
+	return s.Module + moduleSeparator + s.Name
+}
+
+//SymbolLocation is an address resolved to a symbol
+type SymbolLocation struct {
+	Symbol Symbol
+	//Offset of the address from Symbol.Addr
+	Offset uint64
+}
+
+func (l SymbolLocation) String() string {
+	if l.Offset == 0 {
+		return l.Symbol.QualifiedName()
+	}
+	return fmt.Sprintf("%s+0x%x", l.Symbol.QualifiedName(), l.Offset)
+}
+
+//symbolModule is a loaded binary with its symbols sorted by address
+type symbolModule struct {
+	name    string
+	symbols []Symbol
+	//start and end of the address range covered by the module
+	start, end uint64
+}
+
+//Symbolizer resolves guest virtual addresses to symbols of one or more loaded modules, e.g. the
+//victim executable, its shared libraries and the guest kernel. Symbolizer is safe for concurrent use
+type Symbolizer struct {
+	mu      sync.RWMutex
+	modules []*symbolModule
+}
+
+//NewSymbolizer creates a Symbolizer without any modules
+func NewSymbolizer() *Symbolizer {
+	return &Symbolizer{
+		modules: make([]*symbolModule, 0),
+	}
+}
+
+//LoadELF loads the symbols of the ELF file at path, see AddELF. The module is named after the file
+func (s *Symbolizer) LoadELF(path string, base uint64) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %v : %w", path, err)
+	}
+	defer f.Close()
+	return s.addELFFile(f, filepath.Base(path), base)
+}
+
+//AddELF loads the function and object symbols of the ELF binary in r as module name. base is added to
+//all symbol values, i.e. it is the load address for position independent executables and shared libraries
+//and zero for non PIE executables. If the binary has no symbol table, the dynamic symbols are used
+func (s *Symbolizer) AddELF(r io.ReaderAt, name string, base uint64) error {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return fmt.Errorf("failed to parse %v : %w", name, err)
+	}
+	return s.addELFFile(f, name, base)
+}
+
+func (s *Symbolizer) addELFFile(f *elf.File, name string, base uint64) error {
+	elfSymbols, err := f.Symbols()
+	if errors.Is(err, elf.ErrNoSymbols) {
+		elfSymbols, err = f.DynamicSymbols()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read symbols of %v : %w", name, err)
+	}
+
+	symbols := make([]Symbol, 0, len(elfSymbols))
+	for _, v := range elfSymbols {
+		symbolType := elf.ST_TYPE(v.Info)
+		if (symbolType != elf.STT_FUNC && symbolType != elf.STT_OBJECT) || v.Section == elf.SHN_UNDEF || v.Name == "" {
+			continue
+		}
+		symbols = append(symbols, Symbol{
+			Name:   v.Name,
+			Module: name,
+			Addr:   base + v.Value,
+			Size:   v.Size,
+		})
+	}
+
+	module := &symbolModule{name: name}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		if module.end == 0 || base+p.Vaddr < module.start {
+			module.start = base + p.Vaddr
+		}
+		if base+p.Vaddr+p.Memsz > module.end {
+			module.end = base + p.Vaddr + p.Memsz
+		}
+	}
+	s.addModule(module, symbols)
+	return nil
+}
+
+//addModule sorts symbols, resolves missing sizes and adds the module. If module has no address
+//range, it is derived from the symbols
+func (s *Symbolizer) addModule(module *symbolModule, symbols []Symbol) {
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return symbols[i].Addr < symbols[j].Addr
+	})
+	if module.end == 0 && len(symbols) > 0 {
+		last := symbols[len(symbols)-1]
+		module.start = symbols[0].Addr
+		module.end = last.End()
+	}
+	for i := range symbols {
+		if symbols[i].Size != 0 {
+			continue
+		}
+		for j := i + 1; j < len(symbols); j++ {
+			if symbols[j].Addr > symbols[i].Addr {
+				symbols[i].Size = symbols[j].Addr - symbols[i].Addr
+				break
+			}
+		}
+		if symbols[i].Size == 0 && module.end > symbols[i].Addr {
+			symbols[i].Size = module.end - symbols[i].Addr
+		}
+	}
+	module.symbols = symbols
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modules = append(s.modules, module)
+}
+
+//Modules returns the names of all loaded modules in load order
+func (s *Symbolizer) Modules() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := make([]string, 0, len(s.modules))
+	for _, v := range s.modules {
+		res = append(res, v.name)
+	}
+	return res
+}
+
+//Lookup resolves vaddr to the symbol containing it. Returns false if no symbol contains vaddr
+func (s *Symbolizer) Lookup(vaddr uint64) (SymbolLocation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, m := range s.modules {
+		if vaddr < m.start || vaddr >= m.end {
+			continue
+		}
+		//first symbol starting after vaddr
+		idx := sort.Search(len(m.symbols), func(i int) bool {
+			return m.symbols[i].Addr > vaddr
+		})
+		if idx == 0 || vaddr >= m.symbols[idx-1].End() {
+			continue
+		}
+		sym := m.symbols[idx-1]
+		return SymbolLocation{Symbol: sym, Offset: vaddr - sym.Addr}, true
+	}
+	return SymbolLocation{}, false
+}
+
+//Symbol returns the symbol with the given name. Use "module!name" if name exists in multiple modules
+func (s *Symbolizer) Symbol(name string) (Symbol, error) {
+	module := ""
+	if idx := strings.Index(name, moduleSeparator); idx >= 0 {
+		module, name = name[:idx], name[idx+len(moduleSeparator):]
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	matches := make([]Symbol, 0)
+	for _, m := range s.modules {
+		if module != "" && m.name != module {
+			continue
+		}
+		for _, v := range m.symbols {
+			if v.Name == name {
+				matches = append(matches, v)
+				//aliases inside the same module are fine, take the first one
+				break
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return Symbol{}, fmt.Errorf("%w %q", ErrUnknownSymbol, name)
+	case 1:
+		return matches[0], nil
+	default:
+		return Symbol{}, fmt.Errorf("%w %q, found in %v modules", ErrAmbiguousSymbol, name, len(matches))
+	}
+}
+
+//SymbolPages returns the page aligned guest virtual addresses spanned by the symbol name, e.g.
+//to use them with EventsBetweenMarkerPage or PageTableWalker.TrackVirtualPage
+func (s *Symbolizer) SymbolPages(name string) ([]uint64, error) {
+	sym, err := s.Symbol(name)
+	if err != nil {
+		return nil, err
+	}
+	return sym.Pages(), nil
+}
+
+//TrackSymbol translates all pages of the symbol name with walker and tracks them with tracker.
+//Returns the GPAs of the tracked pages
+func (s *Symbolizer) TrackSymbol(walker *PageTableWalker, tracker Tracker, cr3 uint64, name string, trackMode PageTrackMode) ([]uint64, error) {
+	pages, err := s.SymbolPages(name)
+	if err != nil {
+		return nil, err
+	}
+	gpas := make([]uint64, 0, len(pages))
+	for _, v := range pages {
+		gpa, err := walker.TrackVirtualPage(tracker, cr3, v, trackMode)
+		if err != nil {
+			return gpas, fmt.Errorf("failed to track page 0x%x of %v : %w", v, name, err)
+		}
+		gpas = append(gpas, gpa)
+	}
+	return gpas, nil
+}
+
+//EventString returns ev.String() extended by the symbol of the RIP, if available
+func (s *Symbolizer) EventString(ev *Event) string {
+	if !ev.HaveRipInfo {
+		return ev.String()
+	}
+	loc, ok := s.Lookup(ev.RIP)
+	if !ok {
+		return ev.String()
+	}
+	return fmt.Sprintf("%v, Symbol %v", ev.String(), loc)
+}
+
+//MatchSymbol returns true if the RIP of ev resolves to a symbol matching one of patterns.
+//Patterns use the path.Match syntax and are matched against the symbol name or, if they contain
+//a "!", against the qualified name. Events without RIP never match
+func (s *Symbolizer) MatchSymbol(ev *Event, patterns ...string) (bool, error) {
+	if !ev.HaveRipInfo {
+		return false, nil
+	}
+	loc, ok := s.Lookup(ev.RIP)
+	if !ok {
+		return false, nil
+	}
+	for _, v := range patterns {
+		name := loc.Symbol.Name
+		if strings.Contains(v, moduleSeparator) {
+			name = loc.Symbol.QualifiedName()
+		}
+		matched, err := path.Match(v, name)
+		if err != nil {
+			return false, fmt.Errorf("invalid symbol pattern %q : %w", v, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//SymbolFilter returns a filter for FilterEvents that keeps events whose RIP matches one of
+//patterns, see MatchSymbol. If exclude is set, the matching events are dropped instead,
+//e.g. to remove noise from timer interrupt handlers
+func (s *Symbolizer) SymbolFilter(exclude bool, patterns ...string) (func(ev *Event) bool, error) {
+	for _, v := range patterns {
+		if _, err := path.Match(v, ""); err != nil {
+			return nil, fmt.Errorf("invalid symbol pattern %q : %w", v, err)
+		}
+	}
+	return func(ev *Event) bool {
+		//patterns were validated above
+		matched, _ := s.MatchSymbol(ev, patterns...)
+		return matched != exclude
+	}, nil
+}
+
+//IsKernelEvent returns true if the fault was caused by guest kernel code, i.e. PfErrorUser is not set
+func IsKernelEvent(ev *Event) bool {
+	return !ev.ErrorCode.User()
+}
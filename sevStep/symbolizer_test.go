@@ -0,0 +1,114 @@
+package sevStep
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func testSymbolizer() *Symbolizer {
+	s := NewSymbolizer()
+	s.addModule(&symbolModule{name: "victim"}, []Symbol{
+		{Name: "decrypt", Module: "victim", Addr: 0x401ff0, Size: 0x30},
+		{Name: "main", Module: "victim", Addr: 0x401000, Size: 0x80},
+		{Name: "_start", Module: "victim", Addr: 0x400f00},
+		{Name: "memcpy", Module: "victim", Addr: 0x403000, Size: 0x10},
+	})
+	s.addModule(&symbolModule{name: "libc.so.6"}, []Symbol{
+		{Name: "memcpy", Module: "libc.so.6", Addr: 0x7f0000001000, Size: 0x100},
+	})
+	return s
+}
+
+func TestSymbolizer_Lookup(t *testing.T) {
+	tests := []struct {
+		name   string
+		vaddr  uint64
+		want   string
+		wantOk bool
+	}{
+		{name: "symbol start", vaddr: 0x401000, want: "victim!main", wantOk: true},
+		{name: "with offset", vaddr: 0x401ff8, want: "victim!decrypt+0x8", wantOk: true},
+		{name: "size from next symbol", vaddr: 0x400fff, want: "victim!_start+0xff", wantOk: true},
+		{name: "gap after symbol", vaddr: 0x401080, wantOk: false},
+		{name: "other module", vaddr: 0x7f0000001010, want: "libc.so.6!memcpy+0x10", wantOk: true},
+		{name: "outside of modules", vaddr: 0x1000, wantOk: false},
+	}
+	s := testSymbolizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := s.Lookup(tt.vaddr)
+			if ok != tt.wantOk {
+				t.Fatalf("Lookup() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && got.String() != tt.want {
+				t.Errorf("Lookup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSymbolizer_Symbol(t *testing.T) {
+	tests := []struct {
+		name      string
+		symbol    string
+		wantPages []uint64
+		wantErr   error
+	}{
+		{name: "single page", symbol: "main", wantPages: []uint64{0x401000}},
+		{name: "crossing pages", symbol: "decrypt", wantPages: []uint64{0x401000, 0x402000}},
+		{name: "qualified", symbol: "libc.so.6!memcpy", wantPages: []uint64{0x7f0000001000}},
+		{name: "ambiguous", symbol: "memcpy", wantErr: ErrAmbiguousSymbol},
+		{name: "unknown", symbol: "encrypt", wantErr: ErrUnknownSymbol},
+		{name: "unknown module", symbol: "libm.so.6!memcpy", wantErr: ErrUnknownSymbol},
+	}
+	s := testSymbolizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.SymbolPages(tt.symbol)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SymbolPages() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.wantPages) {
+				t.Errorf("SymbolPages() = %x, want %x", got, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestSymbolizer_LoadELF(t *testing.T) {
+	tests := []struct {
+		name string
+		base uint64
+	}{
+		{name: "no base", base: 0},
+		{name: "with base", base: 0x7f0000000000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSymbolizer()
+			if err := s.LoadELF("testdata/victim.elf", tt.base); err != nil {
+				t.Fatalf("LoadELF failed : %v", err)
+			}
+			if got := s.Modules(); !reflect.DeepEqual(got, []string{"victim.elf"}) {
+				t.Errorf("Modules() = %v", got)
+			}
+
+			decrypt, err := s.Symbol("victim.elf!decrypt")
+			if err != nil {
+				t.Fatalf("Symbol() error = %v", err)
+			}
+			if decrypt.Addr != tt.base+0x401000 || decrypt.Size != 35 {
+				t.Errorf("Symbol() = %+v", decrypt)
+			}
+
+			ev := &Event{HaveRipInfo: true, RIP: tt.base + 0x401010}
+			if want := ev.String() + ", Symbol victim.elf!decrypt+0x10"; s.EventString(ev) != want {
+				t.Errorf("EventString() = %v, want %v", s.EventString(ev), want)
+			}
+			if got, ok := s.Lookup(tt.base + 0x402008); !ok || got.String() != "victim.elf!secret+0x8" {
+				t.Errorf("Lookup() = %v, %v, want victim.elf!secret+0x8", got, ok)
+			}
+		})
+	}
+}
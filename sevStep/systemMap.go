@@ -0,0 +1,90 @@
+package sevStep
+
+//This file contains the parser for guest kernel symbols in System.map or /proc/kallsyms format
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//systemMapSymbolTypes are the nm symbol types that are loaded from System.map and kallsyms,
+//i.e. text and data symbols. Lower case types are local symbols
+const systemMapSymbolTypes = "TtWwDdBbRrVv"
+
+//LoadSystemMap loads the symbols of the System.map or kallsyms dump at path, see AddSystemMap.
+//The module is named after the file
+func (s *Symbolizer) LoadSystemMap(path string, slide uint64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %v : %w", path, err)
+	}
+	defer f.Close()
+	return s.AddSystemMap(f, filepath.Base(path), slide)
+}
+
+//AddSystemMap loads the symbols of a System.map or kallsyms dump, i.e. lines in the format
+//"address type name [module]", as module name. slide is added to all addresses, e.g. the KASLR offset of the
+//guest kernel, see KASLRSlide. Symbols of kernel modules, as listed in kallsyms, are added as
+//separate modules named after the kernel module. Sizes are derived from the next symbol
+func (s *Symbolizer) AddSystemMap(r io.Reader, name string, slide uint64) error {
+	symbolsByModule := map[string][]Symbol{name: make([]Symbol, 0)}
+	moduleOrder := []string{name}
+	allZero := true
+
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 || len(fields) > 4 {
+			return fmt.Errorf("%v line %v : expected \"address type name [module]\", got %q", name, lineNo, sc.Text())
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			return fmt.Errorf("%v line %v : invalid address %q : %w", name, lineNo, fields[0], err)
+		}
+		if addr != 0 {
+			allZero = false
+		}
+		if len(fields[1]) != 1 || !strings.Contains(systemMapSymbolTypes, fields[1]) {
+			continue
+		}
+		module := name
+		if len(fields) == 4 {
+			module = strings.Trim(fields[3], "[]")
+			if _, ok := symbolsByModule[module]; !ok {
+				moduleOrder = append(moduleOrder, module)
+			}
+		}
+		symbolsByModule[module] = append(symbolsByModule[module], Symbol{
+			Name:   fields[2],
+			Module: module,
+			Addr:   addr + slide,
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed to read %v : %w", name, err)
+	}
+	if lineNo > 0 && allZero {
+		return fmt.Errorf("%v only contains zero addresses, read kallsyms as root or set kernel.kptr_restrict=0", name)
+	}
+
+	for _, v := range moduleOrder {
+		s.addModule(&symbolModule{name: v}, symbolsByModule[v])
+	}
+	return nil
+}
+
+//KASLRSlide returns the slide to pass to AddSystemMap, given the address of a symbol in System.map,
+//e.g. "_text", and its address in the running guest
+func KASLRSlide(mapAddr, runtimeAddr uint64) uint64 {
+	return runtimeAddr - mapAddr
+}
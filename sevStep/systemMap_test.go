@@ -0,0 +1,140 @@
+package sevStep
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSystemMap = `ffffffff81000000 T _text
+ffffffff81000000 T startup_64
+ffffffff81001000 t hrtimer_interrupt
+ffffffff81001200 T smp_apic_timer_interrupt
+ffffffff81002000 T do_syscall_64
+ffffffff81002400 D jiffies
+0000000000000000 A __per_cpu_start
+`
+
+const testKallsyms = `ffffffff81001000 t hrtimer_interrupt
+ffffffff81002000 T do_syscall_64
+ffffffff81003000 T _etext
+ffffffffc0001000 t ext4_readpage	[ext4]
+ffffffffc0001100 t ext4_writepage	[ext4]
+`
+
+func TestSymbolizer_AddSystemMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		slide    uint64
+		vaddr    uint64
+		want     string
+		wantErr  bool
+		wantMods []string
+	}{
+		{
+			name:     "System.map without slide",
+			input:    testSystemMap,
+			vaddr:    0xffffffff81001010,
+			want:     "System.map!hrtimer_interrupt+0x10",
+			wantMods: []string{"System.map"},
+		},
+		{
+			name:     "System.map with KASLR slide",
+			input:    testSystemMap,
+			slide:    KASLRSlide(0xffffffff81000000, 0xffffffff9a000000),
+			vaddr:    0xffffffff9a002008,
+			want:     "System.map!do_syscall_64+0x8",
+			wantMods: []string{"System.map"},
+		},
+		{
+			name:     "kallsyms with kernel module",
+			input:    testKallsyms,
+			vaddr:    0xffffffffc0001004,
+			want:     "ext4!ext4_readpage+0x4",
+			wantMods: []string{"System.map", "ext4"},
+		},
+		{
+			name:    "restricted kallsyms",
+			input:   "0000000000000000 T _text\n0000000000000000 T startup_64\n",
+			wantErr: true,
+		},
+		{
+			name:    "malformed line",
+			input:   "ffffffff81000000 _text\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSymbolizer()
+			err := s.AddSystemMap(strings.NewReader(tt.input), "System.map", tt.slide)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddSystemMap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := s.Modules(); strings.Join(got, ",") != strings.Join(tt.wantMods, ",") {
+				t.Errorf("Modules() = %v, want %v", got, tt.wantMods)
+			}
+			if got, ok := s.Lookup(tt.vaddr); !ok || got.String() != tt.want {
+				t.Errorf("Lookup() = %v, %v, want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestSymbolizer_SymbolFilter(t *testing.T) {
+	s := NewSymbolizer()
+	if err := s.AddSystemMap(strings.NewReader(testSystemMap), "System.map", 0); err != nil {
+		t.Fatalf("AddSystemMap failed : %v", err)
+	}
+	events := []*Event{
+		{ID: 2, HaveRipInfo: true, RIP: 0xffffffff81001004},
+		{ID: 3, HaveRipInfo: true, RIP: 0xffffffff81002010},
+		{ID: 4, HaveRipInfo: true, RIP: 0xffffffff81001208},
+		{ID: 5, HaveRipInfo: false},
+		{ID: 6, HaveRipInfo: true, RIP: 0x401000, ErrorCode: ErrorCode(PfErrorUser)},
+	}
+
+	tests := []struct {
+		name     string
+		exclude  bool
+		patterns []string
+		want     []uint64
+		wantErr  bool
+	}{
+		{name: "keep", patterns: []string{"do_syscall_64"}, want: []uint64{3}},
+		{name: "exclude timer", exclude: true, patterns: []string{"*timer_interrupt"}, want: []uint64{3, 5, 6}},
+		{name: "qualified", patterns: []string{"System.map!hrtimer_*"}, want: []uint64{2}},
+		{name: "invalid pattern", patterns: []string{"[timer"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := s.SymbolFilter(tt.exclude, tt.patterns...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SymbolFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := make([]uint64, 0)
+			for _, v := range FilterEvents(events, filter) {
+				got = append(got, v.ID)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("FilterEvents() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("FilterEvents() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	kernelEvents := FilterEvents(events, IsKernelEvent)
+	if len(kernelEvents) != 4 {
+		t.Errorf("IsKernelEvent kept %v events, want 4", len(kernelEvents))
+	}
+}
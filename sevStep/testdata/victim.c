@@ -0,0 +1,18 @@
+//Test input for TestSymbolizer_LoadELF. Rebuild victim.elf with
+//gcc -O1 -nostdlib -static -no-pie -fno-asynchronous-unwind-tables -Wl,--build-id=none -o victim.elf victim.c
+
+unsigned char secret[64];
+
+int decrypt(int key) {
+	int res = 0;
+	for (int i = 0; i < 64; i++) {
+		res += secret[i] ^ key;
+	}
+	return res;
+}
+
+void _start(void) {
+	decrypt(42);
+	for (;;) {
+	}
+}
@@ -0,0 +1,384 @@
+package sevStep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+//Binary trace format:
+//The file starts with traceMagic, followed by the format version (uint16), and the length (uint32)
+//of the JSON encoded TraceHeader. All integers are little endian.
+//Afterwards, each event is stored as a fixed size record of traceRecordSize bytes that mirrors
+//page_fault_event_t from c_definitions.h, followed by contentLength bytes of Event.Content.
+//Since version 2, the record ends with the number of captured regions. Each region follows the
+//content as GPA (uint64), length (uint32) and the captured bytes. Version 1 records are 64 bytes long
+//and have no regions
+
+const (
+	//TraceFormatVersion is the version of the binary trace format written by EventWriter
+	TraceFormatVersion = uint16(2)
+	traceMagic         = "SEVSTEPT"
+	traceRecordSize    = 72
+	traceRecordSizeV1  = 64
+	//traceRegionHeaderSize is the size of GPA and length before each region
+	traceRegionHeaderSize = 12
+	//traceMaxHeaderSize and traceMaxContentSize protect against allocating huge buffers for corrupted files
+	traceMaxHeaderSize  = 1 << 20
+	traceMaxContentSize = 1 << 24
+)
+
+//Bits for the flags field of the binary record
+const (
+	traceFlagHaveRipInfo = uint32(1) << iota
+	traceFlagHaveRetiredInstructions
+	//traceFlagContentIsFirstRegion means that MonitorGPA and Content are not stored in the record,
+	//as they are equal to the first region
+	traceFlagContentIsFirstRegion
+)
+
+//ErrInvalidTrace is returned by EventReader if the input is not a binary trace with a supported version
+var ErrInvalidTrace = errors.New("invalid binary trace")
+
+//TraceHeader contains metadata about the session in which the trace was recorded
+type TraceHeader struct {
+	//Version is set by EventWriter and EventReader. It is ignored when passed to NewEventWriter
+	Version uint16 `json:"version"`
+	//Created is the time at which the trace was written
+	Created time.Time `json:"created"`
+	//TrackMode that was used to record the events
+	TrackMode PageTrackMode `json:"track_mode"`
+	//Metadata contains arbitrary information about the session, e.g. the victim binary
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+//EventWriter writes events in the binary trace format. Call Flush once all events are written
+type EventWriter struct {
+	w      *bufio.Writer
+	record [traceRecordSize]byte
+}
+
+//NewEventWriter writes the header to w and returns an EventWriter for the events
+func NewEventWriter(w io.Writer, header TraceHeader) (*EventWriter, error) {
+	header.Version = TraceFormatVersion
+	rawHeader, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal header : %v", err)
+	}
+	ew := &EventWriter{w: bufio.NewWriter(w)}
+
+	prefix := make([]byte, len(traceMagic)+2+4)
+	copy(prefix, traceMagic)
+	binary.LittleEndian.PutUint16(prefix[len(traceMagic):], TraceFormatVersion)
+	binary.LittleEndian.PutUint32(prefix[len(traceMagic)+2:], uint32(len(rawHeader)))
+	if _, err := ew.w.Write(prefix); err != nil {
+		return nil, fmt.Errorf("failed to write header : %w", err)
+	}
+	if _, err := ew.w.Write(rawHeader); err != nil {
+		return nil, fmt.Errorf("failed to write header : %w", err)
+	}
+	return ew, nil
+}
+
+//Write appends ev to the trace
+func (ew *EventWriter) Write(ev *Event) error {
+	if len(ev.Content) > traceMaxContentSize {
+		return fmt.Errorf("content of event %v has %d bytes, max is %d", ev.ID, len(ev.Content), traceMaxContentSize)
+	}
+	for _, v := range ev.Regions {
+		if len(v.Content) > traceMaxContentSize {
+			return fmt.Errorf("region 0x%x of event %v has %d bytes, max is %d", v.GPA, ev.ID, len(v.Content), traceMaxContentSize)
+		}
+	}
+	flags := uint32(0)
+	if ev.HaveRipInfo {
+		flags |= traceFlagHaveRipInfo
+	}
+	if ev.HaveRetiredInstructions {
+		flags |= traceFlagHaveRetiredInstructions
+	}
+	monitorGPA, content := ev.MonitorGPA, ev.Content
+	if len(ev.Regions) > 0 && ev.Regions[0].GPA == monitorGPA && bytes.Equal(ev.Regions[0].Content, content) {
+		flags |= traceFlagContentIsFirstRegion
+		monitorGPA, content = 0, nil
+	}
+	//zero time is not representable in unix nanoseconds
+	timestamp := int64(0)
+	if !ev.Timestamp.IsZero() {
+		timestamp = ev.Timestamp.UnixNano()
+	}
+
+	r := ew.record[:]
+	binary.LittleEndian.PutUint64(r[0:], ev.ID)
+	binary.LittleEndian.PutUint64(r[8:], ev.FaultedGPA)
+	binary.LittleEndian.PutUint32(r[16:], uint32(ev.ErrorCode))
+	binary.LittleEndian.PutUint32(r[20:], flags)
+	binary.LittleEndian.PutUint64(r[24:], ev.RIP)
+	binary.LittleEndian.PutUint64(r[32:], uint64(timestamp))
+	binary.LittleEndian.PutUint64(r[40:], ev.RetiredInstructions)
+	binary.LittleEndian.PutUint64(r[48:], monitorGPA)
+	binary.LittleEndian.PutUint32(r[56:], uint32(len(content)))
+	//bytes 60 to 63 were reserved in the first version and are thus zero for vCPU 0
+	binary.LittleEndian.PutUint32(r[60:], uint32(ev.VCPU))
+	binary.LittleEndian.PutUint32(r[64:], uint32(len(ev.Regions)))
+	//bytes 68 to 71 were reserved in version 2 and are thus zero for error codes that fit into 32 bits
+	binary.LittleEndian.PutUint32(r[68:], uint32(ev.ErrorCode>>32))
+
+	if _, err := ew.w.Write(r); err != nil {
+		return fmt.Errorf("failed to write event %v : %w", ev.ID, err)
+	}
+	if _, err := ew.w.Write(content); err != nil {
+		return fmt.Errorf("failed to write content of event %v : %w", ev.ID, err)
+	}
+	regionHeader := make([]byte, traceRegionHeaderSize)
+	for _, v := range ev.Regions {
+		binary.LittleEndian.PutUint64(regionHeader[0:], v.GPA)
+		binary.LittleEndian.PutUint32(regionHeader[8:], uint32(len(v.Content)))
+		if _, err := ew.w.Write(regionHeader); err != nil {
+			return fmt.Errorf("failed to write region 0x%x of event %v : %w", v.GPA, ev.ID, err)
+		}
+		if _, err := ew.w.Write(v.Content); err != nil {
+			return fmt.Errorf("failed to write region 0x%x of event %v : %w", v.GPA, ev.ID, err)
+		}
+	}
+	return nil
+}
+
+//Flush writes any buffered data to the underlying io.Writer
+func (ew *EventWriter) Flush() error {
+	return ew.w.Flush()
+}
+
+//EventSink is implemented by the writers of both event formats, EventWriter and JSONEventWriter
+type EventSink interface {
+	Write(ev *Event) error
+	//Flush writes buffered events
+	Flush() error
+}
+
+//JSONEventWriter writes events in the JSON lines format, as read by ParseInputFile and
+//EventScanner. Call Flush once all events are written
+type JSONEventWriter struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+//NewJSONEventWriter creates a JSONEventWriter that writes to w
+func NewJSONEventWriter(w io.Writer) *JSONEventWriter {
+	bw := bufio.NewWriter(w)
+	return &JSONEventWriter{w: bw, encoder: json.NewEncoder(bw)}
+}
+
+func (jw *JSONEventWriter) Write(ev *Event) error {
+	return jw.encoder.Encode(ev)
+}
+
+func (jw *JSONEventWriter) Flush() error {
+	return jw.w.Flush()
+}
+
+//Names of the event formats for NewEventSink
+const (
+	EventFormatJSON  = "json"
+	EventFormatTrace = "trace"
+)
+
+//NewEventSink creates a writer for format, which is EventFormatJSON or EventFormatTrace.
+//header is only used for binary traces
+func NewEventSink(w io.Writer, format string, header TraceHeader) (EventSink, error) {
+	switch format {
+	case EventFormatJSON:
+		return NewJSONEventWriter(w), nil
+	case EventFormatTrace:
+		return NewEventWriter(w, header)
+	default:
+		return nil, fmt.Errorf("invalid format %q, expected %q or %q", format, EventFormatJSON, EventFormatTrace)
+	}
+}
+
+//EventReader reads events in the binary trace format
+type EventReader struct {
+	r      *bufio.Reader
+	header TraceHeader
+	record [traceRecordSize]byte
+	//recordSize depends on the version of the trace
+	recordSize int
+}
+
+//IsBinaryTrace returns true if r starts with the magic of a binary trace. No input is consumed,
+//thus r can be passed to NewEventReader or EventScanner afterwards
+func IsBinaryTrace(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(traceMagic))
+	return err == nil && string(magic) == traceMagic
+}
+
+//NewEventReader parses the header from r. Returns ErrInvalidTrace if r does not contain a binary
+//trace or if the version is not supported
+func NewEventReader(r io.Reader) (*EventReader, error) {
+	er := &EventReader{r: bufio.NewReader(r)}
+
+	prefix := make([]byte, len(traceMagic)+2+4)
+	if _, err := io.ReadFull(er.r, prefix); err != nil {
+		return nil, fmt.Errorf("%w : failed to read header : %v", ErrInvalidTrace, err)
+	}
+	if string(prefix[:len(traceMagic)]) != traceMagic {
+		return nil, fmt.Errorf("%w : bad magic", ErrInvalidTrace)
+	}
+	version := binary.LittleEndian.Uint16(prefix[len(traceMagic):])
+	if version == 0 || version > TraceFormatVersion {
+		return nil, fmt.Errorf("%w : unsupported version %d", ErrInvalidTrace, version)
+	}
+	headerLen := binary.LittleEndian.Uint32(prefix[len(traceMagic)+2:])
+	if headerLen > traceMaxHeaderSize {
+		return nil, fmt.Errorf("%w : header length %d exceeds max of %d", ErrInvalidTrace, headerLen, traceMaxHeaderSize)
+	}
+	rawHeader := make([]byte, headerLen)
+	if _, err := io.ReadFull(er.r, rawHeader); err != nil {
+		return nil, fmt.Errorf("%w : failed to read header : %v", ErrInvalidTrace, err)
+	}
+	if err := json.Unmarshal(rawHeader, &er.header); err != nil {
+		return nil, fmt.Errorf("%w : failed to parse header : %v", ErrInvalidTrace, err)
+	}
+	er.header.Version = version
+	er.recordSize = traceRecordSize
+	if version == 1 {
+		er.recordSize = traceRecordSizeV1
+	}
+	return er, nil
+}
+
+//Header returns the header of the trace
+func (er *EventReader) Header() TraceHeader {
+	return er.header
+}
+
+//Read returns the next event. Returns io.EOF if there are no more events and an error
+//wrapping io.ErrUnexpectedEOF if the trace ends in the middle of an event
+func (er *EventReader) Read() (*Event, error) {
+	r := er.record[:er.recordSize]
+	if _, err := io.ReadFull(er.r, r); err != nil {
+		return nil, err
+	}
+	flags := binary.LittleEndian.Uint32(r[20:])
+	ev := &Event{
+		ID:                      binary.LittleEndian.Uint64(r[0:]),
+		VCPU:                    int(binary.LittleEndian.Uint32(r[60:])),
+		FaultedGPA:              binary.LittleEndian.Uint64(r[8:]),
+		ErrorCode:               ErrorCode(binary.LittleEndian.Uint32(r[16:])),
+		HaveRipInfo:             flags&traceFlagHaveRipInfo != 0,
+		RIP:                     binary.LittleEndian.Uint64(r[24:]),
+		HaveRetiredInstructions: flags&traceFlagHaveRetiredInstructions != 0,
+		RetiredInstructions:     binary.LittleEndian.Uint64(r[40:]),
+		MonitorGPA:              binary.LittleEndian.Uint64(r[48:]),
+	}
+	if timestamp := int64(binary.LittleEndian.Uint64(r[32:])); timestamp != 0 {
+		ev.Timestamp = time.Unix(0, timestamp)
+	}
+
+	content, err := er.readBlob(binary.LittleEndian.Uint32(r[56:]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content of event %v : %w", ev.ID, err)
+	}
+	if len(content) > 0 {
+		ev.Content = content
+	}
+
+	regionCount := uint32(0)
+	if er.recordSize > traceRecordSizeV1 {
+		regionCount = binary.LittleEndian.Uint32(r[64:])
+		ev.ErrorCode |= ErrorCode(binary.LittleEndian.Uint32(r[68:])) << 32
+	}
+	regionHeader := make([]byte, traceRegionHeaderSize)
+	for i := uint32(0); i < regionCount; i++ {
+		if _, err := io.ReadFull(er.r, regionHeader); err != nil {
+			return nil, fmt.Errorf("failed to read region %d of event %v : %w", i, ev.ID, unexpectedEOF(err))
+		}
+		region := MemoryRegion{GPA: binary.LittleEndian.Uint64(regionHeader[0:])}
+		if region.Content, err = er.readBlob(binary.LittleEndian.Uint32(regionHeader[8:])); err != nil {
+			return nil, fmt.Errorf("failed to read region %d of event %v : %w", i, ev.ID, err)
+		}
+		ev.Regions = append(ev.Regions, region)
+	}
+	if flags&traceFlagContentIsFirstRegion != 0 && len(ev.Regions) > 0 {
+		ev.MonitorGPA = ev.Regions[0].GPA
+		ev.Content = ev.Regions[0].Content
+	}
+	return ev, nil
+}
+
+//readBlob reads length bytes that follow a record
+func (er *EventReader) readBlob(length uint32) ([]byte, error) {
+	if length > traceMaxContentSize {
+		return nil, fmt.Errorf("%w : length %d exceeds max of %d", ErrInvalidTrace, length, traceMaxContentSize)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(er.r, buf); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf, nil
+}
+
+//unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF, for reads in the middle of an event
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//ConvertJSONToTrace reads events in the JSON lines format from r, as parsed by ParseInputFile,
+//and writes them to w in the binary trace format. Non JSON lines are skipped.
+//Returns the number of converted events
+func ConvertJSONToTrace(r io.Reader, w io.Writer, header TraceHeader) (uint64, error) {
+	ew, err := NewEventWriter(w, header)
+	if err != nil {
+		return 0, err
+	}
+	sc := NewEventScanner(r)
+	count := uint64(0)
+	for sc.Scan() {
+		if err := ew.Write(sc.Event()); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if sc.Err() != nil {
+		return count, sc.Err()
+	}
+	return count, ew.Flush()
+}
+
+//ConvertTraceToJSON reads events in the binary trace format from r and writes them to w in the
+//JSON lines format. Returns the header of the trace and the number of converted events
+func ConvertTraceToJSON(r io.Reader, w io.Writer) (TraceHeader, uint64, error) {
+	er, err := NewEventReader(r)
+	if err != nil {
+		return TraceHeader{}, 0, err
+	}
+	jw := NewJSONEventWriter(w)
+	count := uint64(0)
+	for {
+		ev, err := er.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return er.Header(), count, fmt.Errorf("failed to read event %d : %w", count, err)
+		}
+		if err := jw.Write(ev); err != nil {
+			return er.Header(), count, fmt.Errorf("failed to write event %d : %w", count, err)
+		}
+		count++
+	}
+	return er.Header(), count, jw.Flush()
+}
+
+var (
+	_ EventSink = (*EventWriter)(nil)
+	_ EventSink = (*JSONEventWriter)(nil)
+)
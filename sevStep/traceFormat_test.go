@@ -0,0 +1,224 @@
+package sevStep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testTraceEvents() []*Event {
+	return []*Event{
+		{
+			ID:                      2,
+			FaultedGPA:              0x1000,
+			ErrorCode:               ErrorCode(PfErrorPresent | PfErrorFetch | PfErrorGuestFinal),
+			HaveRipInfo:             true,
+			RIP:                     0x7fffffff1000,
+			Timestamp:               time.Unix(0, 1650000000123456789),
+			HaveRetiredInstructions: true,
+			RetiredInstructions:     42,
+		},
+		{
+			ID:         3,
+			FaultedGPA: 0x2000,
+			ErrorCode:  ErrorCode(PfErrorWrite),
+			MonitorGPA: 0x2010,
+			Content:    []byte{0xde, 0xad, 0xbe, 0xef},
+			VCPU:       1,
+		},
+		{
+			ID:         4,
+			FaultedGPA: 0x3000,
+			MonitorGPA: 0x3000,
+			Content:    []byte{0x1},
+			Regions: []MemoryRegion{
+				{GPA: 0x3000, Content: []byte{0x1}},
+				{GPA: 0x5ff8, Content: make([]byte, 16)},
+			},
+		},
+	}
+}
+
+//equalTraceEvents compares events, ignoring the location of the timestamps
+func equalTraceEvents(t *testing.T, got, want []*Event) {
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].Timestamp.Equal(want[i].Timestamp) {
+			t.Errorf("event %d has timestamp %v, want %v", i, got[i].Timestamp, want[i].Timestamp)
+		}
+		gotCopy := *got[i]
+		gotCopy.Timestamp = want[i].Timestamp
+		if !reflect.DeepEqual(&gotCopy, want[i]) {
+			t.Errorf("event %d = %v, want %v", i, &gotCopy, want[i])
+		}
+	}
+}
+
+func TestEventWriter_EventReader(t *testing.T) {
+	want := testTraceEvents()
+	header := TraceHeader{
+		Created:   time.Unix(1650000000, 0).UTC(),
+		TrackMode: PageTrackExec,
+		Metadata:  map[string]string{"victim": "openssl"},
+	}
+
+	buf := &bytes.Buffer{}
+	ew, err := NewEventWriter(buf, header)
+	if err != nil {
+		t.Fatalf("NewEventWriter failed : %v", err)
+	}
+	for _, v := range want {
+		if err := ew.Write(v); err != nil {
+			t.Fatalf("Write failed : %v", err)
+		}
+	}
+	if err := ew.Flush(); err != nil {
+		t.Fatalf("Flush failed : %v", err)
+	}
+	raw := buf.Bytes()
+
+	er, err := NewEventReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("NewEventReader failed : %v", err)
+	}
+	header.Version = TraceFormatVersion
+	if !reflect.DeepEqual(er.Header(), header) {
+		t.Errorf("Header() = %+v, want %+v", er.Header(), header)
+	}
+	got := make([]*Event, 0)
+	for {
+		ev, err := er.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed : %v", err)
+		}
+		got = append(got, ev)
+	}
+	equalTraceEvents(t, got, want)
+
+	//truncated region
+	er, err = NewEventReader(bytes.NewReader(raw[:len(raw)-1]))
+	if err != nil {
+		t.Fatalf("NewEventReader failed : %v", err)
+	}
+	for i := 0; i < len(want)-1; i++ {
+		if _, err := er.Read(); err != nil {
+			t.Fatalf("Read failed : %v", err)
+		}
+	}
+	if _, err := er.Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Read on truncated trace got err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	//version 1 records have no regions
+	v1 := make([]byte, len(traceMagic)+2+4+2+traceRecordSizeV1)
+	copy(v1, traceMagic)
+	binary.LittleEndian.PutUint16(v1[len(traceMagic):], 1)
+	binary.LittleEndian.PutUint32(v1[len(traceMagic)+2:], 2)
+	copy(v1[len(traceMagic)+6:], "{}")
+	binary.LittleEndian.PutUint64(v1[len(traceMagic)+8:], 7)
+	er, err = NewEventReader(bytes.NewReader(v1))
+	if err != nil {
+		t.Fatalf("NewEventReader on version 1 failed : %v", err)
+	}
+	if ev, err := er.Read(); err != nil || ev.ID != 7 {
+		t.Errorf("Read on version 1 got = %v, %v, want event 7", ev, err)
+	}
+	if _, err := er.Read(); err != io.EOF {
+		t.Errorf("Read at end of version 1 trace got err = %v, want %v", err, io.EOF)
+	}
+
+	if _, err := NewEventReader(bytes.NewReader([]byte("{\"id\":2}\n"))); !errors.Is(err, ErrInvalidTrace) {
+		t.Errorf("NewEventReader on JSON got err = %v, want %v", err, ErrInvalidTrace)
+	}
+}
+
+func TestConvertJSONToTrace_ConvertTraceToJSON(t *testing.T) {
+	want := testTraceEvents()
+	jsonInput := &bytes.Buffer{}
+	jsonInput.WriteString("some log output\n")
+	for _, v := range want {
+		if err := json.NewEncoder(jsonInput).Encode(v); err != nil {
+			t.Fatalf("failed to encode input : %v", err)
+		}
+	}
+
+	if IsBinaryTrace(bufio.NewReader(bytes.NewReader(jsonInput.Bytes()))) {
+		t.Errorf("IsBinaryTrace() = true for JSON input")
+	}
+	trace := &bytes.Buffer{}
+	count, err := ConvertJSONToTrace(jsonInput, trace, TraceHeader{TrackMode: PageTrackAccess})
+	if err != nil || count != uint64(len(want)) {
+		t.Fatalf("ConvertJSONToTrace() got = %v, %v, want %v", count, err, len(want))
+	}
+	if !IsBinaryTrace(bufio.NewReader(bytes.NewReader(trace.Bytes()))) {
+		t.Errorf("IsBinaryTrace() = false for binary trace")
+	}
+
+	jsonOutput := &bytes.Buffer{}
+	header, count, err := ConvertTraceToJSON(trace, jsonOutput)
+	if err != nil || count != uint64(len(want)) {
+		t.Fatalf("ConvertTraceToJSON() got = %v, %v, want %v", count, err, len(want))
+	}
+	if header.TrackMode != PageTrackAccess {
+		t.Errorf("header track mode = %v, want %v", header.TrackMode, PageTrackAccess)
+	}
+	got, err := ParseInputFile(jsonOutput)
+	if err != nil {
+		t.Fatalf("ParseInputFile failed : %v", err)
+	}
+	equalTraceEvents(t, got, want)
+}
+
+func TestNewEventSink(t *testing.T) {
+	tests := []struct {
+		format  string
+		wantErr bool
+	}{
+		{format: EventFormatJSON},
+		{format: EventFormatTrace},
+		{format: "csv", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			sink, err := NewEventSink(buf, tt.format, TraceHeader{TrackMode: PageTrackExec})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewEventSink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			want := testTraceEvents()
+			for _, v := range want {
+				if err := sink.Write(v); err != nil {
+					t.Fatalf("Write failed : %v", err)
+				}
+			}
+			if err := sink.Flush(); err != nil {
+				t.Fatalf("Flush failed : %v", err)
+			}
+			if _, err := NewEventReader(bytes.NewReader(buf.Bytes())); (err == nil) != (tt.format == EventFormatTrace) {
+				t.Errorf("output has the wrong format")
+			}
+			if tt.format == EventFormatTrace {
+				return
+			}
+			got, err := ParseInputFile(buf)
+			if err != nil {
+				t.Fatalf("ParseInputFile failed : %v", err)
+			}
+			equalTraceEvents(t, got, want)
+		})
+	}
+}
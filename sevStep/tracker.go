@@ -0,0 +1,37 @@
+package sevStep
+
+//Tracker is the sev-step api surface. IoctlAPI implements it by issuing the ioctls
+//from c_definitions.h against the patched kernel. Code that only depends on Tracker
+//can be used with other backends, e.g. to test attack logic without a patched host kernel.
+//See the corresponding IoctlAPI methods for the semantics of each command
+type Tracker interface {
+	//CmdReset stops all page tracking and resets the internal state of the backend
+	CmdReset() error
+	//CmdReadGuestMemory reads size bytes from gpa. See IoctlAPI.CmdReadGuestMemory
+	CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error)
+	//CmdAckEvent acknowledges the event with the given id, allowing the VM to continue
+	CmdAckEvent(id uint64) error
+	//CmdPollEvent returns new event if available. See IoctlAPI.CmdPollEvent
+	CmdPollEvent() (*Event, bool, error)
+	//CmdTrackPage tracks the next access of type trackMode to the page containing gpa
+	CmdTrackPage(gpa uint64, trackMode PageTrackMode) error
+	//CmdTrackAllPages tracks the next access of type trackMode to all pages of the VM
+	CmdTrackAllPages(trackMode PageTrackMode) error
+	//CmdUnTrackAllPages removes tracking of type trackMode from all pages of the VM
+	CmdUnTrackAllPages(trackMode PageTrackMode) error
+	//CmdSetupRetInstrPerf programs the retired instructions performance counter on cpu
+	CmdSetupRetInstrPerf(cpu int) error
+	//CmdReadRetInstrPerf reads the retired instructions performance counter on cpu
+	CmdReadRetInstrPerf(cpu int) (uint64, error)
+	//CmdBatchTrackingStart starts batch tracking. See IoctlAPI.CmdBatchTrackingStart
+	CmdBatchTrackingStart(trackingType PageTrackMode, expectedEvents uint64, perfCPU int, retrack bool) error
+	//CmdBatchTrackingEventCount returns the number of events recorded by the current batch
+	CmdBatchTrackingEventCount() (uint64, error)
+	//CmdBatchTrackingStopAndGet stops batch tracking and returns the first eventCount events
+	//as well as a flag indicating whether an error occurred during batch tracking
+	CmdBatchTrackingStopAndGet(eventCount uint64) ([]*Event, bool, error)
+	//Close releases the backend. Implementations should reset tracking before closing
+	Close() error
+}
+
+var _ Tracker = (*IoctlAPI)(nil)